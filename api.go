@@ -0,0 +1,489 @@
+package placemat
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cybozu-go/log"
+)
+
+// NetworkStatus represents the live state of a Network returned by the API.
+type NetworkStatus struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	UseNAT  bool     `json:"use_nat"`
+	Address string   `json:"address,omitempty"`
+	Taps    []string `json:"taps"`
+	Veths   []string `json:"veths"`
+}
+
+// VolumeStatus represents the live state of a Node volume returned by the API.
+type VolumeStatus struct {
+	Node string `json:"node"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// NodeStatus represents the live state of a Node returned by the API.
+type NodeStatus struct {
+	Name       string         `json:"name"`
+	Serial     string         `json:"serial"`
+	CPU        int            `json:"cpu,omitempty"`
+	Memory     string         `json:"memory,omitempty"`
+	Interfaces []string       `json:"interfaces"`
+	MACs       []string       `json:"macs"`
+	Taps       []string       `json:"taps"`
+	Volumes    []VolumeStatus `json:"volumes"`
+	BMCAddress string         `json:"bmc_address,omitempty"`
+	Running    bool           `json:"running"`
+	PID        int            `json:"pid,omitempty"`
+	Restarts   int            `json:"restarts"`
+	Socket     string         `json:"socket"`
+	ConsoleLog string         `json:"console_log,omitempty"`
+}
+
+// PodStatus represents the live state of a Pod returned by the API.
+type PodStatus struct {
+	Name       string             `json:"name"`
+	Interfaces []PodInterfaceSpec `json:"interfaces"`
+	Veths      []string           `json:"veths"`
+	Apps       []string           `json:"apps"`
+	Running    bool               `json:"running"`
+	PID        int                `json:"pid,omitempty"`
+	Restarts   int                `json:"restarts"`
+}
+
+// PowerRequest is the request body to change the power state of a Node.
+type PowerRequest struct {
+	// Action is one of "on", "off", or "reset".
+	Action string `json:"action"`
+}
+
+type apiServer struct {
+	cluster *Cluster
+	runtime *Runtime
+	bmc     *bmcServer
+}
+
+func newAPIServer(c *Cluster, r *Runtime, bmc *bmcServer) *apiServer {
+	return &apiServer{
+		cluster: c,
+		runtime: r,
+		bmc:     bmc,
+	}
+}
+
+// serve serves the control API on a UNIX domain socket at p until ctx is cancelled.
+func (s *apiServer) serve(ctx context.Context, p string) error {
+	os.Remove(p)
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(p)
+
+	log.Info("serving control API", map[string]interface{}{
+		"socket": p,
+	})
+
+	server := &http.Server{Handler: s}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	err = server.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if len(p) == 1 && p[0] == "reload" {
+		// reload modifies the cluster; do not hold the lock.
+		s.handleReload(w, r)
+		return
+	}
+	if len(p) == 2 && p[0] == "capture" {
+		// capture streams packets until the client disconnects;
+		// do not hold the lock.
+		s.handleCapture(w, r, p[1])
+		return
+	}
+
+	s.cluster.mu.RLock()
+	defer s.cluster.mu.RUnlock()
+
+	switch {
+	case len(p) == 1 && p[0] == "networks":
+		s.handleNetworks(w, r)
+	case len(p) == 1 && p[0] == "nodes":
+		s.handleNodes(w, r)
+	case len(p) == 2 && p[0] == "nodes":
+		s.handleNode(w, r, p[1])
+	case len(p) == 3 && p[0] == "nodes" && p[2] == "power":
+		s.handleNodePower(w, r, p[1])
+	case len(p) == 1 && p[0] == "pods":
+		s.handlePods(w, r)
+	case len(p) == 2 && p[0] == "pods":
+		s.handlePod(w, r, p[1])
+	case len(p) == 1 && p[0] == "volumes":
+		s.handleVolumes(w, r)
+	case len(p) == 1 && p[0] == "faults":
+		s.handleFaults(w, r)
+	case len(p) == 2 && p[0] == "faults":
+		s.handleFault(w, r, p[1])
+	default:
+		renderError(w, http.StatusNotFound, "not found: "+r.URL.Path)
+	}
+}
+
+func renderJSON(w http.ResponseWriter, data interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Error("failed to output JSON", map[string]interface{}{
+			log.FnError: err.Error(),
+		})
+	}
+}
+
+func renderError(w http.ResponseWriter, status int, msg string) {
+	renderJSON(w, map[string]interface{}{
+		"status": status,
+		"error":  msg,
+	}, status)
+}
+
+func (s *apiServer) networkStatus(n *Network) NetworkStatus {
+	taps, veths := n.devices()
+	return NetworkStatus{
+		Name:    n.Name,
+		Type:    n.Type,
+		UseNAT:  n.UseNAT,
+		Address: n.Address,
+		Taps:    taps,
+		Veths:   veths,
+	}
+}
+
+func (s *apiServer) volumeStatus(n *Node, vol NodeVolume) VolumeStatus {
+	st := VolumeStatus{
+		Node: n.Name,
+		Name: vol.Name(),
+		Kind: vol.Kind(),
+	}
+
+	if vv, ok := vol.(*vvfatVolume); ok {
+		if vv.folder != nil {
+			st.Path = vv.folder.Path()
+		}
+		return st
+	}
+
+	st.Path = volumePath(s.runtime.volumeDir(n.Name), vol.Name())
+	fi, err := os.Stat(st.Path)
+	if err == nil {
+		st.Size = fi.Size()
+	}
+	return st
+}
+
+func (s *apiServer) nodeStatus(n *Node) NodeStatus {
+	st := NodeStatus{
+		Name:       n.Name,
+		Serial:     n.SMBIOS.Serial,
+		CPU:        n.CPU,
+		Memory:     n.Memory,
+		Interfaces: n.networkNames(),
+		MACs:       n.macAddresses(s.runtime),
+		Taps:       append([]string{}, n.taps...),
+		Volumes:    []VolumeStatus{},
+		Restarts:   n.Restarts(),
+		Socket:     s.runtime.socketPath(n.Name),
+	}
+	if !s.runtime.graphic {
+		st.ConsoleLog = s.runtime.consoleLogPath(n.Name)
+	}
+	for _, vol := range n.volumes {
+		st.Volumes = append(st.Volumes, s.volumeStatus(n, vol))
+	}
+
+	vm := s.bmc.nodeVM(n.SMBIOS.Serial)
+	if vm != nil {
+		st.Running = vm.IsRunning()
+		st.PID = vm.pid()
+	}
+	st.BMCAddress = s.bmc.bmcAddress(n.SMBIOS.Serial)
+	return st
+}
+
+func (s *apiServer) podStatus(p *Pod) PodStatus {
+	st := PodStatus{
+		Name:       p.Name,
+		Interfaces: p.Interfaces,
+		Veths:      append([]string{}, p.veths...),
+		Restarts:   p.Restarts(),
+	}
+	for _, a := range p.Apps {
+		st.Apps = append(st.Apps, a.Name)
+	}
+	st.Running, st.PID = p.status()
+	return st
+}
+
+func (s *apiServer) handleNetworks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	networks := make([]NetworkStatus, 0, len(s.cluster.Networks))
+	for _, n := range s.cluster.Networks {
+		networks = append(networks, s.networkStatus(n))
+	}
+	renderJSON(w, networks, http.StatusOK)
+}
+
+func (s *apiServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	nodes := make([]NodeStatus, 0, len(s.cluster.Nodes))
+	for _, n := range s.cluster.Nodes {
+		nodes = append(nodes, s.nodeStatus(n))
+	}
+	renderJSON(w, nodes, http.StatusOK)
+}
+
+func (s *apiServer) handleNode(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	n, err := s.cluster.GetNode(name)
+	if err != nil {
+		renderError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	renderJSON(w, s.nodeStatus(n), http.StatusOK)
+}
+
+func (s *apiServer) handleNodePower(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	n, err := s.cluster.GetNode(name)
+	if err != nil {
+		renderError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	vm := s.bmc.nodeVM(n.SMBIOS.Serial)
+	if vm == nil {
+		renderError(w, http.StatusServiceUnavailable, "node is not started: "+name)
+		return
+	}
+
+	var req PowerRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch req.Action {
+	case "on":
+		err = vm.PowerOn()
+	case "off":
+		err = vm.PowerOff()
+	case "reset":
+		err = powerCycle(vm)
+	default:
+		renderError(w, http.StatusBadRequest, "unknown action: "+req.Action)
+		return
+	}
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Info("changed power state via API", map[string]interface{}{
+		"node":   name,
+		"action": req.Action,
+	})
+	renderJSON(w, s.nodeStatus(n), http.StatusOK)
+}
+
+func (s *apiServer) handlePods(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	pods := make([]PodStatus, 0, len(s.cluster.Pods))
+	for _, p := range s.cluster.Pods {
+		pods = append(pods, s.podStatus(p))
+	}
+	renderJSON(w, pods, http.StatusOK)
+}
+
+func (s *apiServer) handlePod(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	p, err := s.cluster.GetPod(name)
+	if err != nil {
+		renderError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	renderJSON(w, s.podStatus(p), http.StatusOK)
+}
+
+func (s *apiServer) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	volumes := []VolumeStatus{}
+	for _, n := range s.cluster.Nodes {
+		for _, vol := range n.volumes {
+			volumes = append(volumes, s.volumeStatus(n, vol))
+		}
+	}
+	renderJSON(w, volumes, http.StatusOK)
+}
+
+func (s *apiServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.runtime.loader == nil {
+		renderError(w, http.StatusNotImplemented, "reload is not configured")
+		return
+	}
+
+	next, err := s.runtime.loader()
+	if err == nil {
+		err = s.cluster.Reload(r.Context(), next)
+	}
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	renderJSON(w, map[string]interface{}{"status": http.StatusOK}, http.StatusOK)
+}
+
+func (s *apiServer) handleFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderJSON(w, s.runtime.listFaults(), http.StatusOK)
+
+	case http.MethodPost:
+		var spec FaultSpec
+		err := json.NewDecoder(r.Body).Decode(&spec)
+		if err != nil {
+			renderError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f, err := s.runtime.injectFault(s.cluster, &spec)
+		if err != nil {
+			renderError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		renderJSON(w, f, http.StatusOK)
+
+	case http.MethodDelete:
+		s.runtime.clearFaults()
+		renderJSON(w, map[string]interface{}{"status": http.StatusOK}, http.StatusOK)
+
+	default:
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *apiServer) handleFault(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodDelete {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		renderError(w, http.StatusNotFound, "no such fault: "+id)
+		return
+	}
+	err = s.runtime.removeFault(n)
+	if err != nil {
+		renderError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	renderJSON(w, map[string]interface{}{"status": http.StatusOK}, http.StatusOK)
+}
+
+// flushWriter flushes each write to the client.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+func (s *apiServer) handleCapture(w http.ResponseWriter, r *http.Request, target string) {
+	if r.Method != http.MethodGet {
+		renderError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.cluster.mu.RLock()
+	dev, err := s.cluster.captureDevice(target)
+	s.cluster.mu.RUnlock()
+	if err != nil {
+		renderError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	pc, err := openCapture(dev)
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Info("capturing packets", map[string]interface{}{
+		"target": target,
+		"device": dev,
+	})
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	err = pc.run(r.Context(), flushWriter{w})
+	if err != nil {
+		log.Warn("capture stopped", map[string]interface{}{
+			log.FnError: err,
+			"target":    target,
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package placemat
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testAPIServer(t *testing.T) *apiServer {
+	yaml := `
+kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+smbios:
+  serial: abc
+---
+kind: Pod
+name: pod1
+interfaces:
+  - network: net0
+    addresses:
+      - 10.0.0.1/24
+apps:
+  - name: bird
+    image: docker://quay.io/cybozu/bird:2.0
+`
+	cluster, err := ReadYaml(bufio.NewReader(strings.NewReader(yaml)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Runtime{runDir: "/run/placemat", dataDir: "/var/scratch/placemat"}
+	return newAPIServer(cluster, r, newBMCServer(r, cluster.Networks, nil))
+}
+
+func testAPIList(t *testing.T) {
+	t.Parallel()
+	s := testAPIServer(t)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/nodes", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code)
+	}
+	var nodes []NodeStatus
+	err := json.Unmarshal(w.Body.Bytes(), &nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 {
+		t.Fatal("len(nodes) != 1,", len(nodes))
+	}
+	if nodes[0].Name != "node1" || nodes[0].Serial != "abc" || nodes[0].Running {
+		t.Error("unexpected node status:", nodes[0])
+	}
+	if nodes[0].Socket != "/run/placemat/node1.socket" {
+		t.Error("unexpected socket path:", nodes[0].Socket)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/pods/pod1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code)
+	}
+	var pod PodStatus
+	err = json.Unmarshal(w.Body.Bytes(), &pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.Name != "pod1" || len(pod.Apps) != 1 || pod.Apps[0] != "bird" {
+		t.Error("unexpected pod status:", pod)
+	}
+}
+
+func testAPIErrors(t *testing.T) {
+	t.Parallel()
+	s := testAPIServer(t)
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"GET", "/foo", "", http.StatusNotFound},
+		{"GET", "/nodes/node2", "", http.StatusNotFound},
+		{"POST", "/nodes", "", http.StatusMethodNotAllowed},
+		{"POST", "/nodes/node1/power", `{"action":"on"}`, http.StatusServiceUnavailable},
+		{"GET", "/capture/node2:0", "", http.StatusNotFound},
+		{"POST", "/capture/net0", "", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if w.Code != c.status {
+			t.Error(c.method, c.path, "unexpected status:", w.Code)
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	t.Run("List", testAPIList)
+	t.Run("Errors", testAPIErrors)
+}
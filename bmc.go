@@ -23,6 +23,7 @@ const (
 )
 
 type bmcServer struct {
+	runtime  *Runtime
 	nodeCh   <-chan bmcInfo
 	networks []*Network
 
@@ -30,14 +31,24 @@ type bmcServer struct {
 	nodeVMs map[string]*NodeVM // key: serial
 
 	muSerials   sync.Mutex
-	nodeSerials map[string]string // key: address
+	nodeSerials map[string]string   // key: address
+	ports       map[string]*bmcPort // key: address
 }
 
-func newBMCServer(vms map[string]*NodeVM, networks []*Network, ch <-chan bmcInfo) *bmcServer {
+// bmcPort is an address added to a BMC network for a node.
+type bmcPort struct {
+	address string // with prefix length
+	bridge  string
+	cancel  context.CancelFunc
+}
+
+func newBMCServer(r *Runtime, networks []*Network, ch <-chan bmcInfo) *bmcServer {
 	s := &bmcServer{
+		runtime:     r,
 		nodeCh:      ch,
-		nodeVMs:     vms,
+		nodeVMs:     make(map[string]*NodeVM),
 		nodeSerials: make(map[string]string),
+		ports:       make(map[string]*bmcPort),
 	}
 	for _, n := range networks {
 		if n.typ == NetworkBMC {
@@ -77,6 +88,7 @@ func (s *bmcServer) handleIPMIGetChassisStatus(addr *net.UDPAddr, server *net.UD
 	session, ok := ipmi.GetSession(wrapper.SessionId)
 	if !ok {
 		fmt.Printf("Unable to find session 0x%08x\n", wrapper.SessionId)
+		ipmiRequests.WithLabelValues("get-chassis-status", "no-session").Inc()
 		return
 	}
 
@@ -84,6 +96,7 @@ func (s *bmcServer) handleIPMIGetChassisStatus(addr *net.UDPAddr, server *net.UD
 	vm, err := s.getVMByAddress(localIP)
 	if err != nil {
 		fmt.Println(err)
+		ipmiRequests.WithLabelValues("get-chassis-status", "unknown-node").Inc()
 		return
 	}
 
@@ -111,7 +124,12 @@ func (s *bmcServer) handleIPMIGetChassisStatus(addr *net.UDPAddr, server *net.UD
 	obuf := bytes.Buffer{}
 	ipmi.SerializeRMCP(&obuf, rmcp)
 	ipmi.SerializeIPMI(&obuf, responseWrapper, responseMessage, session.User.Password)
-	server.WriteToUDP(obuf.Bytes(), addr)
+	_, err = server.WriteToUDP(obuf.Bytes(), addr)
+	if err != nil {
+		ipmiRequests.WithLabelValues("get-chassis-status", "error").Inc()
+		return
+	}
+	ipmiRequests.WithLabelValues("get-chassis-status", "ok").Inc()
 }
 
 // This function is largely copied from github.com/rmxymh/infra-ecosphere,
@@ -124,12 +142,14 @@ func (s *bmcServer) handleIPMIChassisControl(addr *net.UDPAddr, server *net.UDPC
 	session, ok := ipmi.GetSession(wrapper.SessionId)
 	if !ok {
 		fmt.Printf("Unable to find session 0x%08x\n", wrapper.SessionId)
+		ipmiRequests.WithLabelValues("chassis-control", "no-session").Inc()
 		return
 	}
 
 	bmcUser := session.User
 	code := ipmi.GetAuthenticationCode(wrapper.AuthenticationType, bmcUser.Password, wrapper.SessionId, message, wrapper.SequenceNumber)
-	if bytes.Compare(wrapper.AuthenticationCode[:], code[:]) == 0 {
+	authenticated := bytes.Compare(wrapper.AuthenticationCode[:], code[:]) == 0
+	if authenticated {
 		fmt.Println("      IPMI Authentication Pass.")
 	} else {
 		fmt.Println("      IPMI Authentication Failed.")
@@ -139,25 +159,33 @@ func (s *bmcServer) handleIPMIChassisControl(addr *net.UDPAddr, server *net.UDPC
 	vm, err := s.getVMByAddress(localIP)
 	if err != nil {
 		fmt.Println(err)
+		ipmiRequests.WithLabelValues("chassis-control", "unknown-node").Inc()
 		return
 	}
 
 	switch request.ChassisControl {
 	case ipmi.CHASSIS_CONTROL_POWER_DOWN:
-		vm.PowerOff()
+		err = vm.PowerOff()
 	case ipmi.CHASSIS_CONTROL_POWER_UP:
-		vm.PowerOn()
+		err = vm.PowerOn()
 	case ipmi.CHASSIS_CONTROL_POWER_CYCLE:
-		vm.PowerOff()
-		vm.PowerOn()
+		err = powerCycle(vm)
 	case ipmi.CHASSIS_CONTROL_HARD_RESET:
-		vm.PowerOff()
-		vm.PowerOn()
+		err = powerCycle(vm)
 	case ipmi.CHASSIS_CONTROL_PULSE:
 		// do nothing
 	case ipmi.CHASSIS_CONTROL_POWER_SOFT:
 		//vm.powerSoft()
 	}
+	switch {
+	case !authenticated:
+		ipmiRequests.WithLabelValues("chassis-control", "auth-failed").Inc()
+	case err != nil:
+		fmt.Println(err)
+		ipmiRequests.WithLabelValues("chassis-control", "error").Inc()
+	default:
+		ipmiRequests.WithLabelValues("chassis-control", "ok").Inc()
+	}
 
 	session.Inc()
 
@@ -174,7 +202,18 @@ func (s *bmcServer) handleIPMIChassisControl(addr *net.UDPAddr, server *net.UDPC
 	server.WriteToUDP(obuf.Bytes(), addr)
 }
 
-func (s *bmcServer) listenIPMI(ctx context.Context, addr string) error {
+// powerCycle turns off and on the power of vm.
+func powerCycle(vm *NodeVM) error {
+	err := vm.PowerOff()
+	if err != nil {
+		return err
+	}
+	return vm.PowerOn()
+}
+
+// listenIPMI serves IPMI requests to addr until ctx is cancelled.
+// bound is called once the UDP socket is bound.
+func (s *bmcServer) listenIPMI(ctx context.Context, addr string, bound func()) error {
 	serverAddr, err := net.ResolveUDPAddr("udp", addr+":623")
 	if err != nil {
 		return err
@@ -188,11 +227,15 @@ func (s *bmcServer) listenIPMI(ctx context.Context, addr string) error {
 		<-ctx.Done()
 		server.Close()
 	}()
+	bound()
 
 	buf := make([]byte, 1024)
 	for {
 		_, addr, err := server.ReadFromUDP(buf)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
 
@@ -208,16 +251,25 @@ OUTER:
 	for {
 		select {
 		case info := <-s.nodeCh:
-			err := s.addPort(ctx, info)
+			if s.hasPort(info.bmcAddress) {
+				// the guest notifies the address again after restart.
+				continue
+			}
+			lctx, cancel := context.WithCancel(ctx)
+			err := s.addPort(ctx, info, cancel)
 			if err != nil {
 				log.Warn("failed to add BMC port", map[string]interface{}{
 					log.FnError:   err,
 					"serial":      info.serial,
 					"bmc_address": info.bmcAddress,
 				})
+				cancel()
+				continue
 			}
 			env.Go(func(ctx context.Context) error {
-				return s.listenIPMI(ctx, info.bmcAddress)
+				return s.listenIPMI(lctx, info.bmcAddress, func() {
+					s.notifyRegistered(env, info)
+				})
 			})
 		case <-ctx.Done():
 			break OUTER
@@ -228,7 +280,30 @@ OUTER:
 	return env.Wait()
 }
 
-func (s *bmcServer) addPort(ctx context.Context, info bmcInfo) error {
+// notifyRegistered notifies that the BMC port of a node is ready.
+// It is called after the IPMI socket is bound so that requests sent
+// on the notification are not lost.  Hooks run in env as they may
+// take long.
+func (s *bmcServer) notifyRegistered(env *cmd.Environment, info bmcInfo) {
+	name := s.nodeName(info.serial)
+	s.runtime.emit(EventBMCRegistered, name, map[string]interface{}{
+		"serial":      info.serial,
+		"bmc_address": info.bmcAddress,
+	})
+	if s.runtime.onBMCRegistered != nil {
+		s.runtime.onBMCRegistered(info.serial, info.bmcAddress)
+	}
+	env.Go(func(ctx context.Context) error {
+		s.runtime.runHooks(HookBMCRegistered, map[string]string{
+			"PLACEMAT_NODE":        name,
+			"PLACEMAT_SERIAL":      info.serial,
+			"PLACEMAT_BMC_ADDRESS": info.bmcAddress,
+		})
+		return nil
+	})
+}
+
+func (s *bmcServer) addPort(ctx context.Context, info bmcInfo, cancel context.CancelFunc) error {
 	s.muSerials.Lock()
 	s.nodeSerials[info.bmcAddress] = info.serial
 	s.muSerials.Unlock()
@@ -241,15 +316,27 @@ func (s *bmcServer) addPort(ctx context.Context, info bmcInfo) error {
 	prefixLen, _ := network.Mask.Size()
 	address := info.bmcAddress + "/" + strconv.Itoa(prefixLen)
 
+	s.muSerials.Lock()
+	s.ports[info.bmcAddress] = &bmcPort{address: address, bridge: br, cancel: cancel}
+	s.muSerials.Unlock()
+
 	log.Info("creating BMC port", map[string]interface{}{
 		"serial":      info.serial,
 		"bmc_address": address,
 		"bridge":      br,
 	})
 
-	c := cmd.CommandContext(ctx, "ip", "addr", "add", address, "dev", br)
-	c.Severity = log.LvDebug
-	return c.Run()
+	c := newCommand("ip", "addr", "add", address, "dev", br)
+	c.severity = log.LvDebug
+	err = s.runtime.executor.Run(ctx, c)
+	if err != nil {
+		s.muSerials.Lock()
+		delete(s.ports, info.bmcAddress)
+		s.muSerials.Unlock()
+		return err
+	}
+
+	return nil
 }
 
 func (s *bmcServer) findBridge(address string) (string, *net.IPNet, error) {
@@ -257,19 +344,87 @@ func (s *bmcServer) findBridge(address string) (string, *net.IPNet, error) {
 
 	for _, n := range s.networks {
 		if n.ipNet.Contains(ip) {
-			return n.Name, n.ipNet, nil
+			return n.bridge, n.ipNet, nil
 		}
 	}
 
 	return "", nil, errors.New("BMC address not in range of BMC networks: " + address)
 }
 
+func (s *bmcServer) hasPort(address string) bool {
+	s.muSerials.Lock()
+	defer s.muSerials.Unlock()
+	_, ok := s.ports[address]
+	return ok
+}
+
+// bmcAddress returns the BMC address registered for the serial, or "".
+func (s *bmcServer) bmcAddress(serial string) string {
+	s.muSerials.Lock()
+	defer s.muSerials.Unlock()
+	for addr, sr := range s.nodeSerials {
+		if sr == serial {
+			return addr
+		}
+	}
+	return ""
+}
+
 func (s *bmcServer) registerVM(serial string, vm *NodeVM) {
 	s.muVMs.Lock()
 	s.nodeVMs[serial] = vm
 	s.muVMs.Unlock()
 }
 
+// nodeVM returns the VM registered for the serial, or nil.
+func (s *bmcServer) nodeVM(serial string) *NodeVM {
+	s.muVMs.Lock()
+	defer s.muVMs.Unlock()
+	return s.nodeVMs[serial]
+}
+
+// nodeName returns the name of the node of the serial, or "".
+func (s *bmcServer) nodeName(serial string) string {
+	if vm := s.nodeVM(serial); vm != nil {
+		return vm.name
+	}
+	return ""
+}
+
+// removeNode unregisters the VM, stops the IPMI listener, and removes
+// the BMC address of the node.
+func (s *bmcServer) removeNode(serial string) {
+	s.muVMs.Lock()
+	delete(s.nodeVMs, serial)
+	s.muVMs.Unlock()
+
+	var ports []*bmcPort
+	s.muSerials.Lock()
+	for addr, sr := range s.nodeSerials {
+		if sr != serial {
+			continue
+		}
+		delete(s.nodeSerials, addr)
+		if p, ok := s.ports[addr]; ok {
+			ports = append(ports, p)
+			delete(s.ports, addr)
+		}
+	}
+	s.muSerials.Unlock()
+
+	for _, p := range ports {
+		log.Info("removing BMC port", map[string]interface{}{
+			"serial":      serial,
+			"bmc_address": p.address,
+			"bridge":      p.bridge,
+		})
+		p.cancel()
+		c := newCommand("ip", "addr", "del", p.address, "dev", p.bridge)
+		c.severity = log.LvDebug
+		s.runtime.executor.Run(context.Background(), c)
+	}
+}
+
 // bmcInfo represents BMC information notified by a guest VM.
 type bmcInfo struct {
 	serial     string
@@ -0,0 +1,235 @@
+package placemat
+
+import (
+	"bytes"
+	"io"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// resourceError is an error of a resource that is not read from YAML.
+type resourceError struct {
+	kind string
+	name string
+	err  error
+}
+
+func (e *resourceError) Error() string {
+	return e.kind + " " + e.name + ": " + e.err.Error()
+}
+
+// resourceKind returns the kind and the name of a resource.
+func resourceKind(res interface{}) (string, string) {
+	switch r := res.(type) {
+	case *Network:
+		return "Network", r.Name
+	case *Link:
+		return "Link", r.Name
+	case *Image:
+		return "Image", r.Name
+	case *DataFolder:
+		return "DataFolder", r.Name
+	case *Node:
+		return "Node", r.Name
+	case *Pod:
+		return "Pod", r.Name
+	case *Hook:
+		return "Hook", r.Name
+	case *ChaosSchedule:
+		return "ChaosSchedule", r.Name
+	}
+	return "", ""
+}
+
+// buildError records err of a resource added by a builder method.
+// Errors are reported by Resolve.
+func (c *Cluster) buildError(kind, name string, err error) {
+	if el, ok := err.(ErrorList); ok {
+		for _, e := range el {
+			c.buildError(kind, name, e)
+		}
+		return
+	}
+	c.buildErrs.add(&resourceError{kind: kind, name: name, err: err})
+}
+
+// AddNetwork creates a Network from spec and adds it to c.
+//
+// The Add methods validate spec like ReadYaml and return c so that calls
+// can be chained.  Errors are reported by Resolve together with errors in
+// references between resources:
+//
+//	c := new(placemat.Cluster).
+//		AddNetwork(&placemat.NetworkSpec{Name: "net0", Type: "internal"}).
+//		AddNode(&placemat.NodeSpec{Name: "node1", Interfaces: []placemat.NodeInterfaceSpec{{Network: "net0"}}})
+//	err := c.Resolve()
+func (c *Cluster) AddNetwork(spec *NetworkSpec) *Cluster {
+	spec.Kind = "Network"
+	n, err := NewNetwork(spec)
+	if err != nil {
+		c.buildError(spec.Kind, spec.Name, err)
+		return c
+	}
+	c.Networks = append(c.Networks, n)
+	return c
+}
+
+// AddLink creates a Link from spec and adds it to c.
+func (c *Cluster) AddLink(spec *LinkSpec) *Cluster {
+	spec.Kind = "Link"
+	l, err := NewLink(spec)
+	if err != nil {
+		c.buildError(spec.Kind, spec.Name, err)
+		return c
+	}
+	c.Links = append(c.Links, l)
+	return c
+}
+
+// AddImage creates an Image from spec and adds it to c.
+func (c *Cluster) AddImage(spec *ImageSpec) *Cluster {
+	spec.Kind = "Image"
+	i, err := NewImage(spec)
+	if err != nil {
+		c.buildError(spec.Kind, spec.Name, err)
+		return c
+	}
+	c.Images = append(c.Images, i)
+	return c
+}
+
+// AddDataFolder creates a DataFolder from spec and adds it to c.
+func (c *Cluster) AddDataFolder(spec *DataFolderSpec) *Cluster {
+	spec.Kind = "DataFolder"
+	f, err := NewDataFolder(spec)
+	if err != nil {
+		c.buildError(spec.Kind, spec.Name, err)
+		return c
+	}
+	c.DataFolders = append(c.DataFolders, f)
+	return c
+}
+
+// AddNode creates a Node from spec and adds it to c.
+func (c *Cluster) AddNode(spec *NodeSpec) *Cluster {
+	spec.Kind = "Node"
+	n, err := NewNode(spec)
+	if err != nil {
+		c.buildError(spec.Kind, spec.Name, err)
+		return c
+	}
+	c.Nodes = append(c.Nodes, n)
+	return c
+}
+
+// AddNodeSet creates nodes from spec and adds them to c.
+func (c *Cluster) AddNodeSet(spec *NodeSetSpec) *Cluster {
+	spec.Kind = "NodeSet"
+	nodes, err := spec.Expand()
+	if err != nil {
+		c.buildError(spec.Kind, spec.Name, err)
+		return c
+	}
+	c.Nodes = append(c.Nodes, nodes...)
+	return c
+}
+
+// AddPod creates a Pod from spec and adds it to c.
+func (c *Cluster) AddPod(spec *PodSpec) *Cluster {
+	spec.Kind = "Pod"
+	p, err := NewPod(spec)
+	if err != nil {
+		c.buildError(spec.Kind, spec.Name, err)
+		return c
+	}
+	c.Pods = append(c.Pods, p)
+	return c
+}
+
+// AddHook creates a Hook from spec and adds it to c.
+func (c *Cluster) AddHook(spec *HookSpec) *Cluster {
+	spec.Kind = "Hook"
+	h, err := NewHook(spec)
+	if err != nil {
+		c.buildError(spec.Kind, spec.Name, err)
+		return c
+	}
+	c.Hooks = append(c.Hooks, h)
+	return c
+}
+
+// AddChaosSchedule creates a ChaosSchedule from spec and adds it to c.
+func (c *Cluster) AddChaosSchedule(spec *ChaosScheduleSpec) *Cluster {
+	spec.Kind = "ChaosSchedule"
+	s, err := NewChaosSchedule(spec)
+	if err != nil {
+		c.buildError(spec.Kind, spec.Name, err)
+		return c
+	}
+	c.ChaosSchedules = append(c.ChaosSchedules, s)
+	return c
+}
+
+// WriteYaml writes the resources of c to w as YAML documents.
+//
+// Reading the output by ReadYaml results in an equivalent cluster.
+// Nodes expanded from NodeSet are written as Node resources, and
+// relative paths are written as resolved by ReadYamlFiles.
+func WriteYaml(w io.Writer, c *Cluster) error {
+	var specs []interface{}
+	for _, n := range c.Networks {
+		spec := *n.NetworkSpec
+		spec.Kind = "Network"
+		specs = append(specs, &spec)
+	}
+	for _, l := range c.Links {
+		spec := *l.LinkSpec
+		spec.Kind = "Link"
+		specs = append(specs, &spec)
+	}
+	for _, i := range c.Images {
+		spec := *i.ImageSpec
+		spec.Kind = "Image"
+		specs = append(specs, &spec)
+	}
+	for _, f := range c.DataFolders {
+		spec := *f.DataFolderSpec
+		spec.Kind = "DataFolder"
+		specs = append(specs, &spec)
+	}
+	for _, n := range c.Nodes {
+		spec := *n.NodeSpec
+		spec.Kind = "Node"
+		specs = append(specs, &spec)
+	}
+	for _, p := range c.Pods {
+		spec := *p.PodSpec
+		spec.Kind = "Pod"
+		specs = append(specs, &spec)
+	}
+	for _, h := range c.Hooks {
+		spec := *h.HookSpec
+		spec.Kind = "Hook"
+		specs = append(specs, &spec)
+	}
+	for _, cs := range c.ChaosSchedules {
+		spec := *cs.ChaosScheduleSpec
+		spec.Kind = "ChaosSchedule"
+		specs = append(specs, &spec)
+	}
+
+	var buf bytes.Buffer
+	for i, spec := range specs {
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		data, err := yaml.Marshal(spec)
+		if err != nil {
+			return err
+		}
+		// escape variable references for templates.
+		buf.Write(bytes.Replace(data, []byte("${"), []byte("$${"), -1))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,115 @@
+package placemat
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func testBuilder(t *testing.T) {
+	t.Parallel()
+
+	c := new(Cluster).
+		AddNetwork(&NetworkSpec{Name: "net0", Type: "internal"}).
+		AddNetwork(&NetworkSpec{Name: "net1", Type: "unknown"}).
+		AddImage(&ImageSpec{Name: "ubuntu", File: "/tmp/ubuntu.img"}).
+		AddNode(&NodeSpec{
+			Name:       "node1",
+			Interfaces: []NodeInterfaceSpec{{Network: "net0"}, {Network: "net2"}},
+			Volumes: []NodeVolumeSpec{
+				{Kind: "image", Name: "root", Image: "ubuntu"},
+			},
+		}).
+		AddNodeSet(&NodeSetSpec{Name: "worker", Replicas: 2})
+
+	if len(c.Networks) != 1 || len(c.Nodes) != 3 {
+		t.Fatal("unexpected resources:", c.Networks, c.Nodes)
+	}
+
+	err := c.Resolve()
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	expected := []string{
+		"Network net1: unknown type: unknown",
+		"Node node1: interfaces: no such network: net2",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+}
+
+func testWriteYaml(t *testing.T) {
+	t.Parallel()
+
+	c := new(Cluster).
+		AddNetwork(&NetworkSpec{Name: "net0", Type: "external", UseNAT: true, Address: "10.0.0.1/24"}).
+		AddImage(&ImageSpec{Name: "ubuntu", URL: "https://example.com/ubuntu.img"}).
+		AddDataFolder(&DataFolderSpec{Name: "data", Dir: "/tmp/data"}).
+		AddNode(&NodeSpec{
+			Name:       "node1",
+			Interfaces: []NodeInterfaceSpec{{Network: "net0", MAC: "02:00:00:00:00:01"}},
+			Volumes: []NodeVolumeSpec{
+				{Kind: "image", Name: "root", Image: "ubuntu", CopyOnWrite: true},
+			},
+			CPU:    2,
+			SMBIOS: SMBIOSConfig{Serial: "${not-a-variable}"},
+		}).
+		AddPod(&PodSpec{
+			Name:       "pod1",
+			Interfaces: []PodInterfaceSpec{{Network: "net0", Addresses: []string{"10.0.0.2/24"}}},
+			Volumes:    []*PodVolumeSpec{{Name: "data", Kind: "host", Folder: "data"}},
+			Apps: []*PodAppSpec{{
+				Name:  "app",
+				Image: "docker://example",
+				Mount: []PodAppMountSpec{{Volume: "data", Target: "/data"}},
+			}},
+		})
+	err := c.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = WriteYaml(&buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := ReadYaml(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err, buf.String())
+	}
+	err = c2.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.Networks[0].NetworkSpec, c2.Networks[0].NetworkSpec) {
+		t.Error("network is not round-tripped:", c2.Networks[0].NetworkSpec)
+	}
+	if !reflect.DeepEqual(c.Images[0].ImageSpec, c2.Images[0].ImageSpec) {
+		t.Error("image is not round-tripped:", c2.Images[0].ImageSpec)
+	}
+	if !reflect.DeepEqual(c.DataFolders[0].DataFolderSpec, c2.DataFolders[0].DataFolderSpec) {
+		t.Error("data folder is not round-tripped:", c2.DataFolders[0].DataFolderSpec)
+	}
+	if !reflect.DeepEqual(c.Nodes[0].NodeSpec, c2.Nodes[0].NodeSpec) {
+		t.Error("node is not round-tripped:", c2.Nodes[0].NodeSpec)
+	}
+	if !reflect.DeepEqual(c.Pods[0].PodSpec, c2.Pods[0].PodSpec) {
+		t.Error("pod is not round-tripped:", c2.Pods[0].PodSpec)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	t.Run("Builder", testBuilder)
+	t.Run("WriteYaml", testWriteYaml)
+}
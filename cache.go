@@ -74,9 +74,16 @@ func downloadData(ctx context.Context, u *url.URL, decomp Decompressor, c *cache
 	urlString := u.String()
 
 	if c.Contains(urlString) {
+		cacheHits.Inc()
 		return nil
 	}
+	cacheMisses.Inc()
+	return fetchData(ctx, u, decomp, c)
+}
 
+// fetchData downloads data from u into c even if it is already cached.
+func fetchData(ctx context.Context, u *url.URL, decomp Decompressor, c *cache) error {
+	urlString := u.String()
 	req, err := http.NewRequest("GET", urlString, nil)
 	if err != nil {
 		return err
@@ -97,9 +104,12 @@ func downloadData(ctx context.Context, u *url.URL, decomp Decompressor, c *cache
 		return fmt.Errorf("failed to download: %s: %s", res.Status, urlString)
 	}
 
-	size, err := strconv.Atoi(res.Header.Get("Content-Length"))
-	if err != nil {
-		return err
+	size := -1
+	if cl := res.Header.Get("Content-Length"); cl != "" {
+		size, err = strconv.Atoi(cl)
+		if err != nil {
+			return err
+		}
 	}
 
 	log.Info("Downloading data...", map[string]interface{}{
@@ -107,9 +117,9 @@ func downloadData(ctx context.Context, u *url.URL, decomp Decompressor, c *cache
 		"size": size,
 	})
 
-	var src io.Reader = res.Body
+	var src io.Reader = countingReader{res.Body}
 	if decomp != nil {
-		newSrc, err := decomp.Decompress(res.Body)
+		newSrc, err := decomp.Decompress(src)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,228 @@
+package placemat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/cybozu-go/log"
+)
+
+const (
+	// captureBufferSize is large enough for GSO packets of tap devices.
+	captureBufferSize = 256 << 10
+
+	// captureTimeout is the receive timeout of the socket to check
+	// cancellation of a capture.
+	captureTimeout = 200 * time.Millisecond
+)
+
+// packetCapture captures packets on a device by an AF_PACKET socket.
+type packetCapture struct {
+	dev string
+	fd  int
+}
+
+// packetMreq is struct packet_mreq in linux/if_packet.h.
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]byte
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// openCapture opens an AF_PACKET socket bound to dev in promiscuous mode.
+// A bridge in promiscuous mode passes all the frames it forwards to the
+// socket.
+func openCapture(dev string) (*packetCapture, error) {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	// protocol 0 receives no packets until the socket is bound to dev.
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  ifi.Index,
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	mreq := packetMreq{
+		ifindex: int32(ifi.Index),
+		typ:     syscall.PACKET_MR_PROMISC,
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd),
+		syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP,
+		uintptr(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq), 0)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+
+	tv := syscall.NsecToTimeval(int64(captureTimeout))
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return &packetCapture{dev: dev, fd: fd}, nil
+}
+
+// run writes captured packets to w in pcapng format until ctx is done.
+// The socket is closed when run returns.
+func (pc *packetCapture) run(ctx context.Context, w io.Writer) error {
+	defer pc.Close()
+
+	pw, err := newPcapngWriter(w, pc.dev)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, captureBufferSize)
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		// reads time out in captureTimeout to check ctx.
+		n, err := syscall.Read(pc.fd, buf)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = pw.writePacket(time.Now(), buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the socket.
+func (pc *packetCapture) Close() error {
+	return syscall.Close(pc.fd)
+}
+
+// captureDevice returns the host side device to capture packets of target.
+// target is a network or a link name, or a node or a pod name and an interface
+// separated by a colon.  The interface is an index or a network name.
+func (c *Cluster) captureDevice(target string) (string, error) {
+	i := strings.IndexByte(target, ':')
+	if i == -1 {
+		n, err := c.GetNetwork(target)
+		if err != nil {
+			return "", err
+		}
+		if n.link != nil {
+			return n.link.device()
+		}
+		if n.bridge == "" {
+			return "", errors.New("network is not created: " + target)
+		}
+		return n.bridge, nil
+	}
+
+	name, iface := target[:i], target[i+1:]
+	var networks []*Network
+	var devices []string
+	if n, err := c.GetNode(name); err == nil {
+		networks, devices = n.networks, n.taps
+	} else if p, err := c.GetPod(name); err == nil {
+		networks, devices = p.networks, p.veths
+	} else {
+		return "", errors.New("no such node or pod: " + name)
+	}
+
+	idx := -1
+	if v, err := strconv.Atoi(iface); err == nil {
+		if v >= 0 && v < len(networks) {
+			idx = v
+		}
+	} else {
+		for j, nw := range networks {
+			if nw.Name == iface {
+				idx = j
+				break
+			}
+		}
+	}
+	if idx == -1 {
+		return "", errors.New("no such interface: " + target)
+	}
+	if idx >= len(devices) {
+		return "", errors.New("interface is not running: " + target)
+	}
+	if devices[idx] == "" {
+		return "", errors.New("cannot capture link between pods: " + target)
+	}
+	return devices[idx], nil
+}
+
+func (r *Runtime) capturePath(network string) string {
+	return filepath.Join(r.dataDir, "capture", network+".pcapng")
+}
+
+// startCapture starts capturing packets on the bridge of n to a file.
+func (n *Network) startCapture(r *Runtime) error {
+	p := r.capturePath(n.Name)
+	if r.dryRun {
+		r.note("capture packets on %s to %s", n.bridge, p)
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	pc, err := openCapture(n.bridge)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	log.Info("capturing packets", map[string]interface{}{
+		"network": n.Name,
+		"file":    p,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := pc.run(ctx, f)
+		if err != nil {
+			log.Error("failed to capture packets", map[string]interface{}{
+				log.FnError: err,
+				"network":   n.Name,
+			})
+		}
+		f.Close()
+	}()
+	n.stopCapture = func() {
+		cancel()
+		<-done
+	}
+	return nil
+}
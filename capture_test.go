@@ -0,0 +1,105 @@
+package placemat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func testPcapng(t *testing.T) {
+	t.Parallel()
+
+	buf := new(bytes.Buffer)
+	pw, err := newPcapngWriter(buf, "br0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := buf.Len()
+	err = pw.writePacket(time.Unix(1, 2000), []byte{1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// section header block and interface description block with if_name
+	if header != 28+32 {
+		t.Fatal("unexpected header length:", header)
+	}
+	if binary.LittleEndian.Uint32(data[0:]) != pcapngSectionHeader ||
+		binary.LittleEndian.Uint32(data[8:]) != pcapngByteOrderMagic {
+		t.Error("invalid section header block")
+	}
+	idb := data[28:header]
+	if binary.LittleEndian.Uint32(idb[0:]) != pcapngInterfaceDesc ||
+		binary.LittleEndian.Uint16(idb[8:]) != pcapngLinkTypeEthernet ||
+		string(idb[20:23]) != "br0" {
+		t.Errorf("invalid interface description block: %v", idb)
+	}
+
+	epb := data[header:]
+	if len(epb) != 40 || binary.LittleEndian.Uint32(epb[4:]) != 40 || binary.LittleEndian.Uint32(epb[36:]) != 40 {
+		t.Fatalf("invalid enhanced packet block: %v", epb)
+	}
+	ts := uint64(binary.LittleEndian.Uint32(epb[12:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[16:]))
+	if ts != 1000002 {
+		t.Error("unexpected timestamp:", ts)
+	}
+	if binary.LittleEndian.Uint32(epb[20:]) != 5 || !bytes.Equal(epb[28:33], []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("unexpected packet: %v", epb)
+	}
+}
+
+func testCaptureDevice(t *testing.T) {
+	t.Parallel()
+
+	c, _, _ := testFaultCluster(t)
+	c.Networks[0].bridge = "net0"
+
+	cases := []struct {
+		target   string
+		expected string
+	}{
+		{"net0", "net0"},
+		{"node1:0", "pm0"},
+		{"node2:net0", "pm1"},
+		{"pod1:net0", "pm2"},
+	}
+	for _, tc := range cases {
+		dev, err := c.captureDevice(tc.target)
+		if err != nil {
+			t.Error(tc.target, err)
+			continue
+		}
+		if dev != tc.expected {
+			t.Errorf("%s: expected %s, actual %s", tc.target, tc.expected, dev)
+		}
+	}
+
+	errCases := []struct {
+		target   string
+		expected string
+	}{
+		{"net1", "no such network: net1"},
+		{"node3:0", "no such node or pod: node3"},
+		{"node1:1", "no such interface: node1:1"},
+		{"pod1:net1", "no such interface: pod1:net1"},
+	}
+	for _, tc := range errCases {
+		_, err := c.captureDevice(tc.target)
+		if err == nil || err.Error() != tc.expected {
+			t.Errorf("%s: expected %q, actual %v", tc.target, tc.expected, err)
+		}
+	}
+
+	c.Pods[0].veths = nil
+	_, err := c.captureDevice("pod1:0")
+	if err == nil || err.Error() != "interface is not running: pod1:0" {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	t.Run("Pcapng", testPcapng)
+	t.Run("Device", testCaptureDevice)
+}
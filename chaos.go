@@ -0,0 +1,230 @@
+package placemat
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// ChaosActionSpec represents an action of a ChaosSchedule in YAML.
+//
+// An action fires At after the cluster gets ready.  If Every is not
+// zero, it fires repeatedly at the interval; the first one fires at
+// Every unless At is given.  An action either injects Fault and removes
+// it after Duration, or powers off the node of PowerCycle and powers it
+// on again after Duration.  A fault without Duration stays until the
+// cluster stops.
+type ChaosActionSpec struct {
+	At         time.Duration `yaml:"at,omitempty"`
+	Every      time.Duration `yaml:"every,omitempty"`
+	Duration   time.Duration `yaml:"duration,omitempty"`
+	Fault      *FaultSpec    `yaml:"fault,omitempty"`
+	PowerCycle string        `yaml:"power-cycle,omitempty"`
+}
+
+func (s *ChaosActionSpec) validate() error {
+	switch {
+	case s.Fault == nil && s.PowerCycle == "":
+		return errors.New("either fault or power-cycle must be specified")
+	case s.Fault != nil && s.PowerCycle != "":
+		return errors.New("fault and power-cycle are exclusive")
+	case s.At < 0 || s.Every < 0 || s.Duration < 0:
+		return errors.New("negative time")
+	case s.Every > 0 && s.Duration >= s.Every:
+		return errors.New("duration must be shorter than every")
+	case s.Every > 0 && s.Fault != nil && s.Duration == 0:
+		return errors.New("repeated fault needs duration")
+	}
+	if s.Fault != nil {
+		return s.Fault.validate()
+	}
+	return nil
+}
+
+// first returns the time from the start of the schedule to the first
+// firing of the action.
+func (s *ChaosActionSpec) first() time.Duration {
+	if s.At == 0 {
+		return s.Every
+	}
+	return s.At
+}
+
+// ChaosScheduleSpec represents a ChaosSchedule specification in YAML.
+type ChaosScheduleSpec struct {
+	Kind    string            `yaml:"kind"`
+	Name    string            `yaml:"name"`
+	Actions []ChaosActionSpec `yaml:"actions"`
+}
+
+// ChaosSchedule runs actions that break the cluster on a timeline
+// after the cluster gets ready.
+type ChaosSchedule struct {
+	*ChaosScheduleSpec
+}
+
+// NewChaosSchedule creates a ChaosSchedule from spec.
+func NewChaosSchedule(spec *ChaosScheduleSpec) (*ChaosSchedule, error) {
+	if spec.Name == "" {
+		return nil, errors.New("chaos schedule name is empty")
+	}
+
+	var errs ErrorList
+	if len(spec.Actions) == 0 {
+		errs.add(&fieldError{field: "actions", err: errors.New("no actions")})
+	}
+	for i := range spec.Actions {
+		err := spec.Actions[i].validate()
+		if err != nil {
+			errs.add(&fieldError{field: "actions", err: errors.New("action " + strconv.Itoa(i) + ": " + err.Error())})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return &ChaosSchedule{ChaosScheduleSpec: spec}, nil
+}
+
+// Resolve checks references to nodes, pods, and networks in the actions.
+// It returns ErrorList if there are errors.
+func (s *ChaosSchedule) Resolve(c *Cluster) error {
+	var errs ErrorList
+	for i, a := range s.Actions {
+		var names []string
+		if a.PowerCycle != "" {
+			_, err := c.GetNode(a.PowerCycle)
+			if err != nil {
+				errs.add(&fieldError{field: "actions", value: a.PowerCycle, err: errors.New("action " + strconv.Itoa(i) + ": " + err.Error())})
+			}
+			continue
+		}
+
+		_, err := c.GetNetwork(a.Fault.Network)
+		if err != nil {
+			errs.add(&fieldError{field: "actions", value: a.Fault.Network, err: errors.New("action " + strconv.Itoa(i) + ": " + err.Error())})
+		}
+		if a.Fault.Target != "" {
+			names = append(names, a.Fault.Target)
+		}
+		for _, g := range a.Fault.Groups {
+			names = append(names, g...)
+		}
+		for _, name := range names {
+			_, err1 := c.GetNode(name)
+			_, err2 := c.GetPod(name)
+			if err1 != nil && err2 != nil {
+				errs.add(&fieldError{field: "actions", value: name, err: errors.New("action " + strconv.Itoa(i) + ": no such node or pod: " + name)})
+			}
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// run runs the actions until ctx is cancelled.
+func (s *ChaosSchedule) run(ctx context.Context, c *Cluster, r *Runtime, bmc *bmcServer) {
+	log.Info("starting chaos schedule", map[string]interface{}{
+		"name": s.Name,
+	})
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := range s.Actions {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runAction(ctx, c, r, bmc, start, i)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *ChaosSchedule) runAction(ctx context.Context, c *Cluster, r *Runtime, bmc *bmcServer, start time.Time, i int) {
+	a := &s.Actions[i]
+	next := a.first()
+	for {
+		if !sleepUntil(ctx, start.Add(next)) {
+			return
+		}
+		s.fire(ctx, c, r, bmc, i)
+		if a.Every == 0 {
+			return
+		}
+		next += a.Every
+	}
+}
+
+// sleepUntil waits until t.  It returns false if ctx is cancelled.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// fire runs the i-th action once.  Errors are logged and do not stop
+// the schedule.
+func (s *ChaosSchedule) fire(ctx context.Context, c *Cluster, r *Runtime, bmc *bmcServer, i int) {
+	a := &s.Actions[i]
+	fields := map[string]interface{}{
+		"name":     s.Name,
+		"action":   i,
+		"duration": a.Duration.String(),
+	}
+
+	if a.PowerCycle != "" {
+		fields["power_cycle"] = a.PowerCycle
+		log.Info("chaos: power cycle", fields)
+
+		c.mu.RLock()
+		n, err := c.GetNode(a.PowerCycle)
+		c.mu.RUnlock()
+		var vm *NodeVM
+		if err == nil {
+			vm = bmc.nodeVM(n.SMBIOS.Serial)
+		}
+		if vm == nil {
+			log.Error("chaos: node is not running", fields)
+			return
+		}
+		vm.PowerOff()
+		if !sleepUntil(ctx, time.Now().Add(a.Duration)) {
+			// do not power on the node being torn down.
+			return
+		}
+		vm.PowerOn()
+		return
+	}
+
+	fields["fault"] = a.Fault.Kind
+	fields["network"] = a.Fault.Network
+	if a.Fault.Target != "" {
+		fields["target"] = a.Fault.Target
+	}
+	log.Info("chaos: inject fault", fields)
+
+	c.mu.RLock()
+	f, err := r.injectFault(c, a.Fault)
+	c.mu.RUnlock()
+	if err != nil {
+		fields[log.FnError] = err
+		log.Error("chaos: failed to inject fault", fields)
+		return
+	}
+	if a.Duration == 0 {
+		return
+	}
+	if !sleepUntil(ctx, time.Now().Add(a.Duration)) {
+		// faults are cleared when the cluster stops.
+		return
+	}
+	r.removeFault(f.ID)
+}
@@ -0,0 +1,169 @@
+package placemat
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testChaosYaml(t *testing.T) {
+	t.Parallel()
+	yaml := `kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+---
+kind: ChaosSchedule
+name: flaky
+actions:
+  - at: 30s
+    duration: 10s
+    fault:
+      kind: netem
+      target: node1
+      network: net0
+      loss: 10
+  - every: 5m
+    duration: 1m
+    power-cycle: node1
+---
+kind: ChaosSchedule
+name: broken
+actions:
+  - every: 1m
+    fault:
+      kind: link-down
+      network: net0
+  - power-cycle: node1
+    fault:
+      kind: link-down
+      network: net0
+---
+kind: ChaosSchedule
+name: empty
+`
+
+	_, err := readYaml(bytes.NewReader([]byte(yaml)), "test.yml", nil)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	expected := []string{
+		"test.yml:26: actions: action 0: repeated fault needs duration",
+		"test.yml:26: actions: action 1: fault and power-cycle are exclusive",
+		"test.yml:36: actions: no actions",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+
+	yaml = strings.SplitN(yaml, "---\nkind: ChaosSchedule\nname: broken", 2)[0]
+	cluster, err := readYaml(bytes.NewReader([]byte(yaml)), "test.yml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := cluster.ChaosSchedules[0].Actions
+	if a[0].first() != 30*time.Second || a[1].first() != 5*time.Minute || a[0].Fault.Loss != 10 {
+		t.Error("unexpected actions:", a)
+	}
+}
+
+func testChaosResolve(t *testing.T) {
+	t.Parallel()
+	yaml := `kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+---
+kind: ChaosSchedule
+name: flaky
+actions:
+  - power-cycle: node2
+  - fault:
+      kind: partition
+      network: net1
+      groups:
+        - [node1]
+        - [pod1]
+`
+
+	cluster, err := readYaml(bytes.NewReader([]byte(yaml)), "test.yml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	expected := []string{
+		"test.yml:13: actions: action 0: no such node: node2",
+		"test.yml:16: actions: action 1: no such network: net1",
+		"test.yml:19: actions: action 1: no such node or pod: pod1",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+}
+
+func testChaosRun(t *testing.T) {
+	t.Parallel()
+
+	c, r, buf := testFaultCluster(t)
+
+	s, err := NewChaosSchedule(&ChaosScheduleSpec{
+		Name: "flaky",
+		Actions: []ChaosActionSpec{
+			{
+				At:       time.Millisecond,
+				Duration: 10 * time.Millisecond,
+				Fault:    &FaultSpec{Kind: FaultLinkDown, Target: "node2", Network: "net0"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s.run(ctx, c, r, nil)
+
+	expected := "ip link set pm1 down\nip link set pm1 up\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected commands:\n%s", buf.String())
+	}
+	if len(r.listFaults()) != 0 {
+		t.Error("fault is not removed")
+	}
+}
+
+func TestChaos(t *testing.T) {
+	t.Run("Yaml", testChaosYaml)
+	t.Run("Resolve", testChaosResolve)
+	t.Run("Run", testChaosRun)
+}
@@ -3,8 +3,11 @@ package placemat
 import (
 	"context"
 	"errors"
+	"net"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/cybozu-go/cmd"
 	"github.com/cybozu-go/log"
@@ -13,10 +16,14 @@ import (
 // Cluster is a set of resources in a virtual data center.
 type Cluster struct {
 	Networks    []*Network
+	Links       []*Link
 	Images      []*Image
 	DataFolders []*DataFolder
 	Nodes       []*Node
 	Pods        []*Pod
+	Hooks       []*Hook
+
+	ChaosSchedules []*ChaosSchedule
 
 	// private fields will be initialized by Resolve.
 	netMap    map[string]*Network
@@ -24,32 +31,130 @@ type Cluster struct {
 	folderMap map[string]*DataFolder
 	nodeMap   map[string]*Node
 	podMap    map[string]*Pod
+
+	// sources maps resources read by ReadYaml to their documents.
+	sources map[interface{}]*document
+
+	// buildErrs are errors in resources added by AddNetwork etc.
+	buildErrs ErrorList
+
+	// mu protects the resource lists and maps while the cluster is running.
+	mu         sync.RWMutex
+	supervisor *supervisor
 }
 
 // Append appends another cluster into the receiver.
 func (c *Cluster) Append(other *Cluster) *Cluster {
 	c.Networks = append(c.Networks, other.Networks...)
+	c.Links = append(c.Links, other.Links...)
 	c.Images = append(c.Images, other.Images...)
 	c.DataFolders = append(c.DataFolders, other.DataFolders...)
 	c.Nodes = append(c.Nodes, other.Nodes...)
 	c.Pods = append(c.Pods, other.Pods...)
+	c.Hooks = append(c.Hooks, other.Hooks...)
+	c.ChaosSchedules = append(c.ChaosSchedules, other.ChaosSchedules...)
+	if len(other.sources) > 0 && c.sources == nil {
+		c.sources = make(map[interface{}]*document)
+	}
+	for res, d := range other.sources {
+		c.sources[res] = d
+	}
+	c.buildErrs.add(other.buildErrs)
 	return c
 }
 
+// wrapError adds the source location of res to err if res was read by ReadYaml,
+// or the kind and the name of res otherwise.
+func (c *Cluster) wrapError(res interface{}, err error) error {
+	if err == nil {
+		return nil
+	}
+	if d, ok := c.sources[res]; ok {
+		return d.wrap(err)
+	}
+	kind, name := resourceKind(res)
+	if el, ok := err.(ErrorList); ok {
+		var errs ErrorList
+		for _, e := range el {
+			errs.add(&resourceError{kind: kind, name: name, err: e})
+		}
+		return errs
+	}
+	return &resourceError{kind: kind, name: name, err: err}
+}
+
+// checkBridgeNames checks that the names of bridges for networks
+// fit in maxNetworkNameLen with the cluster name of r.
+func (c *Cluster) checkBridgeNames(r *Runtime, networks []*Network) error {
+	var errs ErrorList
+	for _, n := range networks {
+		br := r.bridgeName(n.Name)
+		if len(br) > maxNetworkNameLen {
+			errs.add(c.wrapError(n, &fieldError{
+				field: "name",
+				value: n.Name,
+				err:   errors.New("too long name with cluster name: " + br),
+			}))
+		}
+	}
+	return errs.errorOrNil()
+}
+
+func duplicateError(kind, name string) error {
+	return &fieldError{field: "name", value: name, err: errors.New("duplicate " + kind + ": " + name)}
+}
+
 // Resolve resolves inter-resource references and checks unique constraints.
+//
+// This checks all the resources and returns all the errors in ErrorList.
 func (c *Cluster) Resolve() error {
+	var errs ErrorList
+	errs.add(c.buildErrs)
+	errs.add(c.index())
+	var nodeErrs ErrorList
+	for _, n := range c.Nodes {
+		nodeErrs.add(c.wrapError(n, n.Resolve(c)))
+	}
+	errs.add(nodeErrs.unique())
+	for _, p := range c.Pods {
+		errs.add(c.wrapError(p, p.Resolve(c)))
+	}
+	for _, l := range c.Links {
+		errs.add(c.wrapError(l, l.Resolve(c)))
+	}
+	for _, s := range c.ChaosSchedules {
+		errs.add(c.wrapError(s, s.Resolve(c)))
+	}
+	return errs.errorOrNil()
+}
+
+// index builds maps to look up resources by name.
+// It returns ErrorList if names are duplicated.
+func (c *Cluster) index() error {
+	var errs ErrorList
+
 	c.netMap = make(map[string]*Network)
 	for _, n := range c.Networks {
 		if _, ok := c.netMap[n.Name]; ok {
-			return errors.New("duplicate network: " + n.Name)
+			errs.add(c.wrapError(n, duplicateError("network", n.Name)))
+			continue
 		}
 		c.netMap[n.Name] = n
 	}
+	// interfaces refer to links in place of networks.
+	for _, l := range c.Links {
+		if _, ok := c.netMap[l.Name]; ok {
+			errs.add(c.wrapError(l, duplicateError("network or link", l.Name)))
+			continue
+		}
+		c.netMap[l.Name] = l.network
+	}
 
 	c.imageMap = make(map[string]*Image)
 	for _, i := range c.Images {
 		if _, ok := c.imageMap[i.Name]; ok {
-			return errors.New("duplicate image: " + i.Name)
+			errs.add(c.wrapError(i, duplicateError("image", i.Name)))
+			continue
 		}
 		c.imageMap[i.Name] = i
 	}
@@ -57,36 +162,68 @@ func (c *Cluster) Resolve() error {
 	c.folderMap = make(map[string]*DataFolder)
 	for _, f := range c.DataFolders {
 		if _, ok := c.folderMap[f.Name]; ok {
-			return errors.New("duplicate data folder: " + f.Name)
+			errs.add(c.wrapError(f, duplicateError("data folder", f.Name)))
+			continue
 		}
 		c.folderMap[f.Name] = f
 	}
 
 	c.nodeMap = make(map[string]*Node)
 	for _, n := range c.Nodes {
-		err := n.Resolve(c)
-		if err != nil {
-			return err
-		}
 		if _, ok := c.nodeMap[n.Name]; ok {
-			return errors.New("duplicate node: " + n.Name)
+			errs.add(c.wrapError(n, duplicateError("node", n.Name)))
+			continue
 		}
 		c.nodeMap[n.Name] = n
 	}
 
+	macs := make(map[string]bool)
+	for _, n := range c.Nodes {
+		for _, iface := range n.Interfaces {
+			if iface.MAC == "" {
+				continue
+			}
+			hw, _ := net.ParseMAC(iface.MAC)
+			if macs[hw.String()] {
+				errs.add(c.wrapError(n, &fieldError{
+					field: "interfaces",
+					value: iface.MAC,
+					err:   errors.New("duplicate MAC address: " + iface.MAC),
+				}))
+				continue
+			}
+			macs[hw.String()] = true
+		}
+	}
+
 	c.podMap = make(map[string]*Pod)
 	for _, p := range c.Pods {
-		err := p.Resolve(c)
-		if err != nil {
-			return err
-		}
 		if _, ok := c.podMap[p.Name]; ok {
-			return errors.New("duplicate pod: " + p.Name)
+			errs.add(c.wrapError(p, duplicateError("pod", p.Name)))
+			continue
 		}
 		c.podMap[p.Name] = p
 	}
 
-	return nil
+	hooks := make(map[string]bool)
+	for _, h := range c.Hooks {
+		if hooks[h.Name] {
+			errs.add(c.wrapError(h, duplicateError("hook", h.Name)))
+			continue
+		}
+		hooks[h.Name] = true
+	}
+
+	schedules := make(map[string]bool)
+	for _, s := range c.ChaosSchedules {
+		if schedules[s.Name] {
+			errs.add(c.wrapError(s, duplicateError("chaos schedule", s.Name)))
+			continue
+		}
+		schedules[s.Name] = true
+	}
+
+	return errs.errorOrNil()
 }
 
 // GetNetwork looks up the network by name.
@@ -141,105 +278,264 @@ func (c *Cluster) GetPod(name string) (*Pod, error) {
 
 // Start constructs the virtual data center with given resources.
 // It stop when ctx is cancelled.
+//
+// If r is created by NewDryRunRuntime, this prints the commands to
+// construct and destroy the virtual data center and returns immediately.
 func (c *Cluster) Start(ctx context.Context, r *Runtime) error {
-	defer os.RemoveAll(r.tempDir)
+	err := c.checkBridgeNames(r, c.Networks)
+	if err != nil {
+		return err
+	}
+	r.setHooks(c.Hooks)
 
-	root, err := NewRootfs()
+	if !r.dryRun {
+		defer os.RemoveAll(r.tempDir)
+
+		j, err := openJournal(journalPath(r.runDir))
+		if err != nil {
+			return err
+		}
+		r.journal = j
+		defer j.remove()
+	}
+
+	started := time.Now()
+	if r.metricsAddr != "" && !r.dryRun {
+		l, err := net.Listen("tcp", r.metricsAddr)
+		if err != nil {
+			return err
+		}
+		mctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			err := serveMetrics(mctx, l, c)
+			if err != nil {
+				log.Error("failed to serve metrics", map[string]interface{}{
+					log.FnError: err,
+				})
+			}
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+
+	root, err := newRootfs(r)
 	if err != nil {
 		return err
 	}
 	defer root.Destroy()
 
-	err = createNatRules()
+	err = createNatRules(r)
 	if err != nil {
 		return err
 	}
-	defer destroyNatRules()
+	defer destroyNatRules(r)
 
-	for _, n := range c.Networks {
+	phaseStarted := time.Now()
+	for i, n := range c.Networks {
 		log.Info("Creating network", map[string]interface{}{"name": n.Name})
-		err := n.Create(r.nameGenerator())
+		err := n.Create(r)
 		if err != nil {
+			destroyNetworks(r, c.Networks[:i])
 			return err
 		}
-		defer n.Destroy()
 	}
+	// networks may be added or deleted by reload.
+	defer c.destroyNetworks(r)
+	for _, l := range c.Links {
+		defer l.Destroy(r)
+	}
+	observePhase(phaseNetworks, phaseStarted)
+	defer r.clearFaults()
+	r.runHooks(HookNetworksCreated, networksHookEnv(c.Networks))
 
+	phaseStarted = time.Now()
 	for _, df := range c.DataFolders {
 		log.Info("initializing data folder", map[string]interface{}{
 			"name": df.Name,
 		})
-		err := df.Prepare(ctx, r.tempDir, r.dataCache)
+		err := df.Prepare(ctx, r, r.tempDir, r.dataCache)
 		if err != nil {
 			return err
 		}
 	}
+	observePhase(phaseDataFolders, phaseStarted)
 
+	phaseStarted = time.Now()
 	for _, img := range c.Images {
 		log.Info("initializing image resource", map[string]interface{}{
 			"name": img.Name,
 		})
-		err := img.Prepare(ctx, r.imageCache)
+		err := img.Prepare(ctx, r, r.imageCache)
 		if err != nil {
 			return err
 		}
 	}
+	observePhase(phaseImages, phaseStarted)
 
+	phaseStarted = time.Now()
 	for _, p := range c.Pods {
-		err := p.Prepare(ctx)
+		err := p.Prepare(ctx, r)
 		if err != nil {
 			return err
 		}
 	}
+	observePhase(phasePods, phaseStarted)
+
+	if r.dryRun {
+		return c.startDryRun(ctx, r, root)
+	}
+
+	// resources are torn down after before-shutdown hooks finish.
+	var shutdownOnce sync.Once
+	beforeShutdown := func() {
+		shutdownOnce.Do(func() {
+			r.runHooks(HookBeforeShutdown, nil)
+		})
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			beforeShutdown()
+			cancel()
+		case <-runCtx.Done():
+		}
+	}()
 
 	nodeCh := make(chan bmcInfo, len(c.Nodes))
+	bmcServer := newBMCServer(r, c.Networks, nodeCh)
+
+	env := cmd.NewEnvironment(runCtx)
+	s := newSupervisor(runCtx, env, c, r, root.Path(), bmcServer, nodeCh)
+	defer s.stopAll()
+	// the cluster also stops when a node, a pod, or a server fails.
+	defer beforeShutdown()
 
-	var mu sync.Mutex
-	vms := make(map[string]*NodeVM)
+	var linkWg sync.WaitGroup
+	linkCtx, stopLinks := context.WithCancel(runCtx)
+	for _, l := range c.Links {
+		l := l
+		linkWg.Add(1)
+		go func() {
+			defer linkWg.Done()
+			l.watch(linkCtx, r)
+		}()
+	}
+	defer linkWg.Wait()
+	defer stopLinks()
 
-	env := cmd.NewEnvironment(ctx)
+	phaseStarted = time.Now()
+	startEnv := cmd.NewEnvironment(runCtx)
 	for _, n := range c.Nodes {
 		n := n
-		env.Go(func(ctx2 context.Context) error {
-			// reference the original context because ctx2 will soon be cancelled.
-			vm, err := n.Start(ctx, r, nodeCh)
-			if err != nil {
-				return err
-			}
-			mu.Lock()
-			vms[n.SMBIOS.Serial] = vm
-			mu.Unlock()
-			return nil
+		startEnv.Go(func(ctx2 context.Context) error {
+			return s.startNode(n)
 		})
 	}
-	env.Stop()
-	err = env.Wait()
-	defer func() {
-		for _, vm := range vms {
-			vm.cleanup()
-		}
-	}()
+	startEnv.Stop()
+	err = startEnv.Wait()
 	if err != nil {
 		return err
 	}
+	observePhase(phaseNodes, phaseStarted)
 
-	bmcServer := newBMCServer(vms, c.Networks, nodeCh)
+	apiServer := newAPIServer(c, r, bmcServer)
 
-	env = cmd.NewEnvironment(ctx)
 	env.Go(bmcServer.handleNode)
+	env.Go(func(ctx context.Context) error {
+		return apiServer.serve(ctx, r.apiSocketPath())
+	})
+	env.Go(s.run)
 	for _, p := range c.Pods {
-		p := p
-		env.Go(func(ctx context.Context) error {
-			return p.Start(ctx, r, root.Path())
-		})
+		s.startPod(p)
 	}
-	for _, vm := range vms {
-		vm := vm
+	observePhase(phaseTotal, started)
+	r.emit(EventClusterReady, "", nil)
+	r.setReady()
+
+	for _, cs := range c.ChaosSchedules {
+		cs := cs
 		env.Go(func(ctx context.Context) error {
-			return vm.cmd.Wait()
+			cs.run(ctx, c, r, bmcServer)
+			return nil
 		})
 	}
 	env.Stop()
 
-	return env.Wait()
+	err = env.Wait()
+	r.emit(EventShutdown, "", map[string]interface{}{
+		"error": errorString(err),
+	})
+	return err
+}
+
+// startDryRun starts nodes and pods one by one so that the commands are
+// printed in a stable order.  Pod network namespaces are deleted after
+// all resources are started, as they would be at shutdown.
+func (c *Cluster) startDryRun(ctx context.Context, r *Runtime, root *Rootfs) error {
+	for _, n := range c.Nodes {
+		_, err := n.Start(ctx, r, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range c.Pods {
+		err := p.setupNetwork(ctx, r)
+		if err != nil {
+			return err
+		}
+		defer deletePodNS(context.Background(), r, p.Name)
+		defer p.releaseLinks(r)
+
+		err = p.runInitScripts(ctx, r)
+		if err != nil {
+			return err
+		}
+		_, err = p.startRkt(r, root.Path())
+		if err != nil {
+			return err
+		}
+		if r.onPodStarted != nil {
+			r.onPodStarted(p)
+		}
+	}
+
+	r.setReady()
+	r.runHooks(HookBeforeShutdown, nil)
+	return nil
+}
+
+// destroyNetworks destroys the networks of the running cluster,
+// including those added by reload.
+func (c *Cluster) destroyNetworks(r *Runtime) {
+	c.mu.RLock()
+	networks := append([]*Network(nil), c.Networks...)
+	c.mu.RUnlock()
+	destroyNetworks(r, networks)
+}
+
+// destroyNetworks destroys networks in the reverse order of creation.
+func destroyNetworks(r *Runtime, networks []*Network) {
+	for i := len(networks) - 1; i >= 0; i-- {
+		networks[i].Destroy(r)
+	}
+}
+
+func networksHookEnv(networks []*Network) map[string]string {
+	names := make([]string, len(networks))
+	bridges := make([]string, len(networks))
+	for i, n := range networks {
+		names[i] = n.Name
+		bridges[i] = n.bridge
+	}
+	return map[string]string{
+		"PLACEMAT_NETWORKS": strings.Join(names, " "),
+		"PLACEMAT_BRIDGES":  strings.Join(bridges, " "),
+	}
 }
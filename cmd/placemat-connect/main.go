@@ -18,14 +18,22 @@ const (
 )
 
 var (
-	runDir = flag.String("run-dir", defaultRunPath, "run directory")
+	runDir      = flag.String("run-dir", defaultRunPath, "run directory")
+	clusterName = flag.String("cluster-name", "", "name of the cluster given to placemat")
 )
 
+func clusterRunDir() string {
+	return filepath.Join(*runDir, *clusterName)
+}
+
 func socketPath(host string) string {
-	return filepath.Join(*runDir, host+".socket")
+	return filepath.Join(clusterRunDir(), host+".socket")
 }
 
 func ptyPath(host string) string {
+	if *clusterName != "" {
+		host = *clusterName + "_" + host
+	}
 	return filepath.Join("/tmp", "placemat_"+host)
 }
 
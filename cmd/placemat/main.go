@@ -1,14 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"flag"
-	"math/rand"
+	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"time"
+	"strings"
+	"syscall"
 
 	"github.com/cybozu-go/cmd"
 	"github.com/cybozu-go/log"
@@ -27,71 +28,152 @@ var (
 	flgDataDir  = flag.String("data-dir", defaultDataDir, "directory to store data")
 	flgGraphic  = flag.Bool("graphic", false, "run QEMU with graphical console")
 	flgDebug    = flag.Bool("debug", false, "show QEMU's and Pod's stdout and stderr")
+	flgDryRun   = flag.Bool("dry-run", false, "print commands to be run instead of running them")
+	flgCluster  = flag.String("cluster-name", "", "name to run multiple clusters on a host")
+	flgSeed     = flag.String("seed", "", "seed to derive MAC addresses of nodes")
+
+	flgShutdownTimeout = flag.Duration("shutdown-timeout", placemat.DefaultShutdownTimeout, "time to wait for VMs and pods to shut down gracefully")
+	flgEventFile       = flag.String("event-file", "", "append lifecycle events as JSON lines to this file")
+	flgEventSocket     = flag.String("event-socket", "", "stream lifecycle events as JSON lines over this UNIX domain socket")
+	flgMetricsAddr     = flag.String("metrics-addr", "", "serve Prometheus metrics at this address (e.g. :9100)")
+	flgConsoleLogSize  = flag.Int64("console-log-size", placemat.DefaultConsoleLogSize, "size in bytes to rotate serial console logs")
+	flgConsoleBackups  = flag.Int("console-log-backups", placemat.DefaultConsoleLogBackups, "number of rotated serial console logs to keep")
+
+	flgVars = make(varsFlag)
 )
 
-func loadClusterFromFile(p string) (*placemat.Cluster, error) {
-	f, err := os.Open(p)
-	if err != nil {
-		return nil, err
+func init() {
+	flag.Var(flgVars, "var", "set a template variable as key=value (can be repeated)")
+}
+
+// varsFlag is a flag.Value to set template variables.
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	var kvs []string
+	for k, val := range v {
+		kvs = append(kvs, k+"="+val)
 	}
-	defer f.Close()
-	return placemat.ReadYaml(bufio.NewReader(f))
+	return strings.Join(kvs, ",")
 }
 
-func loadClusterFromFiles(args []string) (*placemat.Cluster, error) {
-	var cluster placemat.Cluster
-	for _, p := range args {
-		c, err := loadClusterFromFile(p)
-		if err != nil {
-			return nil, err
-		}
+func (v varsFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return errors.New("invalid variable: " + s)
+	}
+	v[kv[0]] = kv[1]
+	return nil
+}
 
-		cluster.Append(c)
+// clusterDir returns the directory for the cluster under dir.
+// Each cluster on a host has its own run and data directories.
+func clusterDir(dir string) string {
+	if *flgCluster == "" {
+		return dir
 	}
-	return &cluster, nil
+	return filepath.Join(dir, *flgCluster)
 }
 
-func run(yamls []string) error {
+// cacheDir returns the directory for cache data.
+// The cache directory is shared among clusters.
+func cacheDir() string {
+	if *flgCacheDir == "" {
+		if os.Getenv("SUDO_USER") != "" {
+			*flgCacheDir = "/home/${SUDO_USER}/placemat_data"
+		} else {
+			*flgCacheDir = *flgDataDir
+		}
+	}
+	return os.ExpandEnv(*flgCacheDir)
+}
+
+// loadCluster reads YAML files and resolves the cluster.
+// YAML files may be given as HTTP or HTTPS URLs.
+func loadCluster(yamls []string) (*placemat.Cluster, error) {
 	if len(yamls) == 0 {
-		return errors.New("no YAML files specified")
+		return nil, errors.New("no YAML files specified")
 	}
 
-	// make all YAML paths absolute
+	// make all YAML paths absolute so that they can be reloaded
+	// and relative paths in them are resolved consistently.
 	for i, p := range yamls {
+		if strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") {
+			continue
+		}
 		abs, err := filepath.Abs(p)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		yamls[i] = abs
 	}
 
-	err := os.Chdir(filepath.Dir(yamls[0]))
+	cluster, err := placemat.ReadYamlFiles(yamls, flgVars, cacheDir())
 	if err != nil {
-		log.Warn("cannot chdir to YAML directory", map[string]interface{}{
-			log.FnError: err.Error(),
-		})
+		return nil, err
 	}
-
-	if *flgCacheDir == "" {
-		if os.Getenv("SUDO_USER") != "" {
-			*flgCacheDir = "/home/${SUDO_USER}/placemat_data"
-		} else {
-			*flgCacheDir = *flgDataDir
-		}
+	err = cluster.Resolve()
+	if err != nil {
+		return nil, err
 	}
-	runDir := os.ExpandEnv(*flgRunDir)
-	dataDir := os.ExpandEnv(*flgDataDir)
-	cacheDir := os.ExpandEnv(*flgCacheDir)
-	r, err := placemat.NewRuntime(*flgGraphic, runDir, dataDir, cacheDir)
+	return cluster, nil
+}
+
+func run(yamls []string) error {
+	cluster, err := loadCluster(yamls)
 	if err != nil {
 		return err
 	}
 
-	cluster, err := loadClusterFromFiles(yamls)
+	opts := &placemat.RuntimeOptions{
+		Graphic:     *flgGraphic,
+		RunDir:      clusterDir(os.ExpandEnv(*flgRunDir)),
+		DataDir:     clusterDir(os.ExpandEnv(*flgDataDir)),
+		CacheDir:    cacheDir(),
+		ClusterName: *flgCluster,
+		Seed:        *flgSeed,
+	}
+
+	if *flgDryRun {
+		r, err := placemat.NewDryRunRuntime(os.Stdout, opts)
+		if err != nil {
+			return err
+		}
+		return cluster.Start(context.Background(), r)
+	}
+
+	opts.ShutdownTimeout = *flgShutdownTimeout
+	opts.MetricsAddr = *flgMetricsAddr
+	opts.ConsoleLogSize = *flgConsoleLogSize
+	opts.ConsoleLogBackups = *flgConsoleBackups
+	opts.Loader = func() (*placemat.Cluster, error) {
+		return loadCluster(yamls)
+	}
+
+	if *flgEventFile != "" {
+		f, err := os.OpenFile(*flgEventFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		opts.EventWriters = append(opts.EventWriters, f)
+	}
+	if *flgEventSocket != "" {
+		s, err := placemat.ListenEvents(*flgEventSocket)
+		if err != nil {
+			return err
+		}
+		// closed after the cluster is destroyed to deliver all events.
+		defer s.Close()
+		opts.EventWriters = append(opts.EventWriters, s)
+		cmd.Go(s.Serve)
+	}
+
+	err = os.MkdirAll(opts.RunDir, 0755)
 	if err != nil {
 		return err
 	}
-	err = cluster.Resolve()
+	r, err := placemat.NewRuntime(opts)
 	if err != nil {
 		return err
 	}
@@ -99,17 +181,83 @@ func run(yamls []string) error {
 	cmd.Go(func(ctx context.Context) error {
 		return cluster.Start(ctx, r)
 	})
+	cmd.Go(func(ctx context.Context) error {
+		return reloadOnSIGHUP(ctx, cluster, yamls)
+	})
 	cmd.Stop()
 	return cmd.Wait()
 }
 
-func main() {
-	rand.Seed(time.Now().UnixNano())
+// reloadOnSIGHUP reads YAML files again and reloads the cluster
+// when SIGHUP is received.
+func reloadOnSIGHUP(ctx context.Context, cluster *placemat.Cluster, yamls []string) error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil
+		}
 
+		log.Info("reloading YAML files", map[string]interface{}{
+			"files": yamls,
+		})
+		next, err := loadCluster(yamls)
+		if err == nil {
+			err = cluster.Reload(ctx, next)
+		}
+		if err != nil {
+			log.Error("failed to reload", map[string]interface{}{
+				log.FnError: err.Error(),
+			})
+		}
+	}
+}
+
+func validate(yamls []string) error {
+	_, err := loadCluster(yamls)
+	if err != nil {
+		return err
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func cleanup() error {
+	return placemat.Cleanup(clusterDir(os.ExpandEnv(*flgRunDir)))
+}
+
+// exitWithErrors prints each error in errs and exits.
+func exitWithErrors(errs placemat.ErrorList) {
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	fmt.Fprintf(os.Stderr, "%d error(s)\n", len(errs))
+	os.Exit(1)
+}
+
+func main() {
 	flag.Parse()
 	cmd.LogConfig{}.Apply()
 
-	err := run(flag.Args())
+	var err error
+	args := flag.Args()
+	switch {
+	case len(args) > 0 && args[0] == "cleanup":
+		err = cleanup()
+	case len(args) > 0 && args[0] == "validate":
+		err = validate(args[1:])
+	case len(args) > 0 && args[0] == "capture":
+		err = capture(args[1:])
+	default:
+		err = run(args)
+	}
+	if errs, ok := err.(placemat.ErrorList); ok {
+		exitWithErrors(errs)
+	}
 	if err != nil {
 		log.ErrorExit(err)
 	}
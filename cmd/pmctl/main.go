@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultRunPath = "/tmp"
+)
+
+var (
+	runDir      = flag.String("run-dir", defaultRunPath, "run directory")
+	clusterName = flag.String("cluster-name", "", "name of the cluster given to placemat")
+)
+
+func clusterRunDir() string {
+	return filepath.Join(*runDir, *clusterName)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: pmctl [OPTIONS] COMMAND [ARGS...]
+
+Commands:
+  net list                       list networks
+  node list                      list nodes
+  node show NODE                 show a node
+  node power NODE on|off|reset   change the power state of a node
+  pod list                       list pods
+  pod show POD                   show a pod
+  volume list                    list volumes of nodes
+  reload                         reload YAML files and apply changes
+
+  fault list                     list injected faults
+  fault down NODE|POD NETWORK    set the link of an interface down
+  fault netem NODE|POD NETWORK PARAM=VALUE...
+                                 emulate delay, loss, etc. on an interface;
+                                 PARAM is delay, jitter, loss, duplicate,
+                                 or reorder.  e.g. delay=100ms loss=5
+  fault partition NETWORK GROUP GROUP...
+                                 partition a network; GROUP is a comma-
+                                 separated list of nodes and pods
+  fault remove ID                remove a fault; links are set up again
+  fault clear                    remove all faults
+
+Options:
+`)
+	flag.PrintDefaults()
+}
+
+func apiSocketPath() string {
+	return filepath.Join(clusterRunDir(), "placemat-api.socket")
+}
+
+func newClient() *http.Client {
+	sock := apiSocketPath()
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+}
+
+func call(method, p string, body interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://placemat"+p, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := newClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return errors.New(res.Status)
+	}
+
+	var out bytes.Buffer
+	err = json.Indent(&out, data, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+func run(args []string) error {
+	if len(args) == 1 && args[0] == "reload" {
+		return call(http.MethodPost, "/reload", nil)
+	}
+	if len(args) < 2 {
+		usage()
+		return errors.New("too few arguments")
+	}
+
+	cmd := strings.Join(args[:2], " ")
+	args = args[2:]
+	switch cmd {
+	case "net list":
+		return call(http.MethodGet, "/networks", nil)
+	case "node list":
+		return call(http.MethodGet, "/nodes", nil)
+	case "node show":
+		if len(args) != 1 {
+			return errors.New("usage: pmctl node show NODE")
+		}
+		return call(http.MethodGet, "/nodes/"+args[0], nil)
+	case "node power":
+		if len(args) != 2 {
+			return errors.New("usage: pmctl node power NODE on|off|reset")
+		}
+		return call(http.MethodPost, "/nodes/"+args[0]+"/power", map[string]string{"action": args[1]})
+	case "pod list":
+		return call(http.MethodGet, "/pods", nil)
+	case "pod show":
+		if len(args) != 1 {
+			return errors.New("usage: pmctl pod show POD")
+		}
+		return call(http.MethodGet, "/pods/"+args[0], nil)
+	case "volume list":
+		return call(http.MethodGet, "/volumes", nil)
+	case "fault list":
+		return call(http.MethodGet, "/faults", nil)
+	case "fault down":
+		if len(args) != 2 {
+			return errors.New("usage: pmctl fault down NODE|POD NETWORK")
+		}
+		return call(http.MethodPost, "/faults", map[string]interface{}{
+			"kind":    "link-down",
+			"target":  args[0],
+			"network": args[1],
+		})
+	case "fault netem":
+		if len(args) < 3 {
+			return errors.New("usage: pmctl fault netem NODE|POD NETWORK PARAM=VALUE...")
+		}
+		spec, err := netemSpec(args[2:])
+		if err != nil {
+			return err
+		}
+		spec["kind"] = "netem"
+		spec["target"] = args[0]
+		spec["network"] = args[1]
+		return call(http.MethodPost, "/faults", spec)
+	case "fault partition":
+		if len(args) < 3 {
+			return errors.New("usage: pmctl fault partition NETWORK GROUP GROUP...")
+		}
+		var groups [][]string
+		for _, g := range args[1:] {
+			groups = append(groups, strings.Split(g, ","))
+		}
+		return call(http.MethodPost, "/faults", map[string]interface{}{
+			"kind":    "partition",
+			"network": args[0],
+			"groups":  groups,
+		})
+	case "fault remove":
+		if len(args) != 1 {
+			return errors.New("usage: pmctl fault remove ID")
+		}
+		return call(http.MethodDelete, "/faults/"+args[0], nil)
+	case "fault clear":
+		return call(http.MethodDelete, "/faults", nil)
+	}
+
+	usage()
+	return errors.New("unknown command: " + cmd)
+}
+
+// netemSpec converts PARAM=VALUE arguments to fields of a netem fault.
+func netemSpec(args []string) (map[string]interface{}, error) {
+	spec := make(map[string]interface{})
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid parameter: " + arg)
+		}
+		switch kv[0] {
+		case "delay", "jitter":
+			spec[kv[0]] = kv[1]
+		case "loss", "duplicate", "reorder":
+			p, err := strconv.ParseFloat(strings.TrimSuffix(kv[1], "%"), 64)
+			if err != nil {
+				return nil, errors.New("invalid percentage: " + arg)
+			}
+			spec[kv[0]] = p
+		default:
+			return nil, errors.New("unknown parameter: " + kv[0])
+		}
+	}
+	return spec, nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	err := run(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
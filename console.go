@@ -0,0 +1,258 @@
+package placemat
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for rotation of console logs.
+const (
+	DefaultConsoleLogSize    = 10 << 20
+	DefaultConsoleLogBackups = 5
+)
+
+// consoleWriteTimeout is the time to wait for a client to read the output.
+// A client that does not read in time is disconnected so that it does
+// not stall the console log.
+const consoleWriteTimeout = time.Second
+
+// rotatingLog is an io.WriteCloser that appends to a file and rotates it
+// when it grows beyond maxSize.  Rotated files are renamed to path.1,
+// path.2, ..., and at most backups of them are kept.
+type rotatingLog struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingLog(path string, maxSize int64, backups int) (*rotatingLog, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &rotatingLog{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	return nil
+}
+
+func (l *rotatingLog) rotate() error {
+	l.f.Close()
+	l.f = nil
+
+	for i := l.backups; i > 1; i-- {
+		os.Rename(l.path+"."+strconv.Itoa(i-1), l.path+"."+strconv.Itoa(i))
+	}
+	if l.backups > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	if l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		err := l.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// console relays the serial console of a VM.
+//
+// QEMU connects to the serial socket, and clients such as placemat-connect
+// connect to the console socket.  Output of the serial console is written
+// to the log whether or not a client is connected.  A serial port accepts
+// only one client, so a new client replaces the current one.
+type console struct {
+	serial   net.Listener
+	listener net.Listener
+	log      io.WriteCloser
+
+	mu     sync.Mutex
+	qemu   net.Conn
+	client net.Conn
+	closed bool
+}
+
+// newConsole listens on serialPath for QEMU and on sockPath for clients.
+// It must be called before QEMU is started.
+func newConsole(serialPath, sockPath string, log io.WriteCloser) (*console, error) {
+	os.Remove(serialPath)
+	os.Remove(sockPath)
+
+	serial, err := net.Listen("unix", serialPath)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		serial.Close()
+		return nil, err
+	}
+
+	c := &console{
+		serial:   serial,
+		listener: l,
+		log:      log,
+	}
+	go c.relay()
+	go c.accept()
+	return c, nil
+}
+
+// relay accepts the connection from QEMU and copies the output to
+// the log and the client.
+func (c *console) relay() {
+	conn, err := c.serial.Accept()
+	c.serial.Close()
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return
+	}
+	c.qemu = conn
+	c.mu.Unlock()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			c.log.Write(buf[:n])
+
+			c.mu.Lock()
+			if c.client != nil {
+				c.client.SetWriteDeadline(time.Now().Add(consoleWriteTimeout))
+				_, err := c.client.Write(buf[:n])
+				if err != nil {
+					c.client.Close()
+					c.client = nil
+				}
+			}
+			c.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *console) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		if c.client != nil {
+			c.client.Close()
+		}
+		c.client = conn
+		c.mu.Unlock()
+
+		go c.input(conn)
+	}
+}
+
+// input copies input from a client to QEMU.
+func (c *console) input(conn net.Conn) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			c.mu.Lock()
+			qemu := c.qemu
+			c.mu.Unlock()
+			if qemu != nil {
+				qemu.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	if c.client == conn {
+		c.client = nil
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
+
+// Close closes the connections and the listeners, then the log.
+func (c *console) Close() {
+	c.mu.Lock()
+	c.closed = true
+	if c.qemu != nil {
+		c.qemu.Close()
+	}
+	if c.client != nil {
+		c.client.Close()
+	}
+	c.mu.Unlock()
+
+	c.serial.Close()
+	c.listener.Close()
+	c.log.Close()
+}
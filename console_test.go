@@ -0,0 +1,212 @@
+package placemat
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testRotatingLog(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	p := filepath.Join(d, "console", "node1.log")
+	l, err := openRotatingLog(p, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaa", "bbbbbb", "cccc", "dddddd", "eeeeee"} {
+		_, err := l.Write([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		p:        "eeeeee",
+		p + ".1": "dddddd",
+		p + ".2": "bbbbbbcccc",
+	}
+	for f, e := range expected {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != e {
+			t.Errorf("%s: expected %q, actual %q", f, e, string(data))
+		}
+	}
+	_, err = os.Stat(p + ".3")
+	if !os.IsNotExist(err) {
+		t.Error("too many backups are kept")
+	}
+}
+
+func testConsole(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	p := filepath.Join(d, "node1.log")
+	l, err := openRotatingLog(p, DefaultConsoleLogSize, DefaultConsoleLogBackups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialPath := filepath.Join(d, "node1.serial")
+	sockPath := filepath.Join(d, "node1.socket")
+	con, err := newConsole(serialPath, sockPath, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+
+	qemu, err := net.Dial("unix", serialPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qemu.Close()
+	client, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for {
+		con.mu.Lock()
+		ok := con.client != nil
+		con.mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = qemu.Write([]byte("login: "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 7)
+	_, err = io.ReadFull(client, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "login: " {
+		t.Error("unexpected output:", string(buf))
+	}
+
+	_, err = client.Write([]byte("root\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, 5)
+	_, err = io.ReadFull(qemu, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "root\n" {
+		t.Error("unexpected input:", string(buf))
+	}
+
+	con.Close()
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "login: " {
+		t.Error("unexpected log:", string(data))
+	}
+}
+
+func testConsoleStalledClient(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	p := filepath.Join(d, "node1.log")
+	l, err := openRotatingLog(p, 1<<30, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialPath := filepath.Join(d, "node1.serial")
+	sockPath := filepath.Join(d, "node1.socket")
+	con, err := newConsole(serialPath, sockPath, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+
+	qemu, err := net.Dial("unix", serialPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qemu.Close()
+	// the client never reads.
+	client, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for {
+		con.mu.Lock()
+		ok := con.client != nil
+		con.mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// more than socket buffers can hold.
+	output := make([]byte, 16<<20)
+	go qemu.Write(output)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() == int64(len(output)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("console log stalls:", fi.Size())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	con.mu.Lock()
+	dropped := con.client == nil
+	con.mu.Unlock()
+	if !dropped {
+		t.Error("stalled client is not disconnected")
+	}
+}
+
+func TestConsole(t *testing.T) {
+	t.Run("RotatingLog", testRotatingLog)
+	t.Run("Console", testConsole)
+	t.Run("StalledClient", testConsoleStalledClient)
+}
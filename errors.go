@@ -0,0 +1,98 @@
+package placemat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SourceError is an error in a cluster definition with its location.
+type SourceError struct {
+	// File is the name of the YAML file.  It may be empty.
+	File string
+	// Line is the 1-based line number in File, or 0 if unknown.
+	Line int
+	// Field is the name of the offending field.  It may be empty.
+	Field string
+	Err   error
+}
+
+func (e *SourceError) Error() string {
+	var loc string
+	switch {
+	case e.File != "" && e.Line > 0:
+		loc = fmt.Sprintf("%s:%d: ", e.File, e.Line)
+	case e.File != "":
+		loc = e.File + ": "
+	case e.Line > 0:
+		loc = fmt.Sprintf("line %d: ", e.Line)
+	}
+	if e.Field != "" {
+		loc += e.Field + ": "
+	}
+	return loc + e.Err.Error()
+}
+
+// ErrorList is a list of errors found in cluster definitions.
+//
+// ReadYaml and Cluster.Resolve return ErrorList to report all the problems
+// at once rather than stopping at the first one.
+type ErrorList []error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// add appends err to the list.  ErrorList is flattened.  nil is ignored.
+func (l *ErrorList) add(err error) {
+	if err == nil {
+		return
+	}
+	if el, ok := err.(ErrorList); ok {
+		*l = append(*l, el...)
+		return
+	}
+	*l = append(*l, err)
+}
+
+// unique returns the list without errors whose messages are the same
+// as earlier ones.  Nodes expanded from a NodeSet share the location in
+// YAML and report the same errors.
+func (l ErrorList) unique() ErrorList {
+	var ret ErrorList
+	seen := make(map[string]bool)
+	for _, err := range l {
+		msg := err.Error()
+		if seen[msg] {
+			continue
+		}
+		seen[msg] = true
+		ret = append(ret, err)
+	}
+	return ret
+}
+
+// errorOrNil returns nil if the list is empty, or the list itself.
+func (l ErrorList) errorOrNil() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// fieldError is an error on a field of a resource.
+//
+// When the resource was read from YAML, fieldError is converted to
+// SourceError pointing the line of the field that contains value.
+type fieldError struct {
+	field string
+	value string
+	err   error
+}
+
+func (e *fieldError) Error() string {
+	return e.field + ": " + e.err.Error()
+}
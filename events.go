@@ -0,0 +1,169 @@
+package placemat
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// EventType is the type of Event.
+type EventType string
+
+// Event types.
+const (
+	EventClusterReady     = EventType("cluster-ready")
+	EventShutdown         = EventType("shutdown")
+	EventNetworkCreated   = EventType("network-created")
+	EventNetworkDestroyed = EventType("network-destroyed")
+	EventVolumeCreated    = EventType("volume-created")
+	EventVMStarted        = EventType("vm-started")
+	EventVMExited         = EventType("vm-exited")
+	EventBMCRegistered    = EventType("bmc-registered")
+	EventPowerOn          = EventType("power-on")
+	EventPowerOff         = EventType("power-off")
+	EventPodStarted       = EventType("pod-started")
+	EventPodExited        = EventType("pod-exited")
+	EventFaultInjected    = EventType("fault-injected")
+	EventFaultRemoved     = EventType("fault-removed")
+)
+
+// Event is a lifecycle event of a running cluster.
+//
+// Name is the name of the resource the event is about, if any.
+// Fields holds additional information that depends on Type.
+type Event struct {
+	Time   time.Time              `json:"time"`
+	Type   EventType              `json:"type"`
+	Name   string                 `json:"name,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// eventWriter writes events as JSON lines to writers.
+// A nil *eventWriter discards events.
+type eventWriter struct {
+	mu      sync.Mutex
+	writers []io.Writer
+}
+
+func (w *eventWriter) add(out io.Writer) {
+	w.mu.Lock()
+	w.writers = append(w.writers, out)
+	w.mu.Unlock()
+}
+
+func (w *eventWriter) emit(typ EventType, name string, fields map[string]interface{}) {
+	if w == nil {
+		return
+	}
+
+	data, err := json.Marshal(Event{
+		Time:   time.Now().UTC(),
+		Type:   typ,
+		Name:   name,
+		Fields: fields,
+	})
+	if err != nil {
+		log.Error("failed to marshal event", map[string]interface{}{
+			log.FnError: err,
+			"type":      typ,
+		})
+		return
+	}
+	data = append(data, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, out := range w.writers {
+		_, err := out.Write(data)
+		if err != nil {
+			log.Warn("failed to write event", map[string]interface{}{
+				log.FnError: err,
+				"type":      typ,
+			})
+		}
+	}
+}
+
+// EventSocket streams events to clients connected to a UNIX domain socket.
+//
+// Each client receives events emitted after it connects, one JSON object
+// per line.  Clients that cannot receive events are disconnected.
+type EventSocket struct {
+	l net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// ListenEvents creates an EventSocket listening on path.
+// An existing file at path is removed.
+func ListenEvents(path string) (*EventSocket, error) {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &EventSocket{
+		l:     l,
+		conns: make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Serve accepts clients until ctx is cancelled.
+// Connected clients keep receiving events until Close is called.
+func (s *EventSocket) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.l.Close()
+	}()
+
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		// events are sent one way; discard anything sent by clients.
+		go io.Copy(ioutil.Discard, conn)
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+	}
+}
+
+// Write sends p to all the connected clients.  It never fails.
+func (s *EventSocket) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, err := conn.Write(p)
+		if err != nil {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(p), nil
+}
+
+// Close disconnects all the clients and removes the socket.
+func (s *EventSocket) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	s.l.Close()
+}
@@ -0,0 +1,106 @@
+package placemat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testEventWriter(t *testing.T) {
+	t.Parallel()
+
+	var nilWriter *eventWriter
+	nilWriter.emit(EventShutdown, "", nil)
+
+	buf := new(bytes.Buffer)
+	w := new(eventWriter)
+	w.add(buf)
+	w.emit(EventNetworkCreated, "net0", map[string]interface{}{"type": "internal"})
+	w.emit(EventClusterReady, "", nil)
+
+	dec := json.NewDecoder(buf)
+	var e Event
+	err := dec.Decode(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EventNetworkCreated || e.Name != "net0" || e.Fields["type"] != "internal" || e.Time.IsZero() {
+		t.Error("unexpected event:", e)
+	}
+	e = Event{}
+	err = dec.Decode(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EventClusterReady || e.Name != "" || e.Fields != nil {
+		t.Error("unexpected event:", e)
+	}
+}
+
+func testEventSocket(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	p := filepath.Join(d, "events.socket")
+	s, err := ListenEvents(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx)
+
+	conn, err := net.Dial("unix", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w := new(eventWriter)
+	w.add(s)
+	// wait for the socket to accept the connection.
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("connection is not accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.emit(EventBMCRegistered, "node1", map[string]interface{}{"serial": "abc"})
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Event
+	err = json.Unmarshal(line, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EventBMCRegistered || e.Name != "node1" || e.Fields["serial"] != "abc" {
+		t.Error("unexpected event:", e)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	t.Run("Writer", testEventWriter)
+	t.Run("Socket", testEventSocket)
+}
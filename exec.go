@@ -2,16 +2,202 @@ package placemat
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cybozu-go/cmd"
 	"github.com/cybozu-go/log"
 )
 
-func execCommands(ctx context.Context, commands [][]string) error {
+// command represents an external command to be run by an executor.
+type command struct {
+	name   string
+	args   []string
+	stdout io.Writer
+	stderr io.Writer
+
+	// env is added to the environment of the command as "KEY=value".
+	env []string
+
+	// severity is the log level for the command execution log.
+	// If zero, log.LvInfo is used.
+	severity int
+}
+
+func newCommand(name string, args ...string) command {
+	return command{name: name, args: args}
+}
+
+// process is a handle of a command started by an executor.
+type process interface {
+	Pid() int
+	Signal(os.Signal) error
+	Kill() error
+	Wait() error
+}
+
+// executor runs external commands.
+//
+// Every command that placemat runs on the host goes through an executor
+// so that dry-run mode can print the commands instead of running them.
+type executor interface {
+	// Run runs a command and waits for it to finish.
+	Run(ctx context.Context, c command) error
+	// Start starts a command without waiting for it.
+	// The process will be killed when ctx is cancelled.
+	Start(ctx context.Context, c command) (process, error)
+}
+
+type hostExecutor struct{}
+
+func (e hostExecutor) command(ctx context.Context, c command) *cmd.LogCmd {
+	lc := cmd.CommandContext(ctx, c.name, c.args...)
+	if c.severity != 0 {
+		lc.Severity = c.severity
+	}
+	lc.Stdout = c.stdout
+	lc.Stderr = c.stderr
+	if len(c.env) > 0 {
+		lc.Env = append(os.Environ(), c.env...)
+	}
+	return lc
+}
+
+func (e hostExecutor) Run(ctx context.Context, c command) error {
+	return e.command(ctx, c).Run()
+}
+
+func (e hostExecutor) Start(ctx context.Context, c command) (process, error) {
+	lc := e.command(ctx, c)
+	err := lc.Start()
+	if err != nil {
+		return nil, err
+	}
+	return hostProcess{lc}, nil
+}
+
+type hostProcess struct {
+	*cmd.LogCmd
+}
+
+func (p hostProcess) Pid() int {
+	return p.Process.Pid
+}
+
+func (p hostProcess) Signal(sig os.Signal) error {
+	return p.Process.Signal(sig)
+}
+
+func (p hostProcess) Kill() error {
+	return p.Process.Kill()
+}
+
+// dryRunExecutor prints commands instead of running them.
+type dryRunExecutor struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,+@%", r))
+	}) == -1 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func (e *dryRunExecutor) print(c command) {
+	words := make([]string, 0, len(c.env)+len(c.args)+1)
+	for _, e := range c.env {
+		words = append(words, shellQuote(e))
+	}
+	words = append(words, shellQuote(c.name))
+	for _, a := range c.args {
+		words = append(words, shellQuote(a))
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Fprintln(e.w, strings.Join(words, " "))
+}
+
+// note prints a comment line for operations done without external commands.
+func (e *dryRunExecutor) note(format string, args ...interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Fprintf(e.w, "# "+format+"\n", args...)
+}
+
+func (e *dryRunExecutor) Run(ctx context.Context, c command) error {
+	e.print(c)
+	return nil
+}
+
+func (e *dryRunExecutor) Start(ctx context.Context, c command) (process, error) {
+	e.print(c)
+	return dryRunProcess{}, nil
+}
+
+// dryRunProcess is a process that exits immediately with success.
+type dryRunProcess struct{}
+
+func (p dryRunProcess) Pid() int {
+	return 0
+}
+
+func (p dryRunProcess) Signal(os.Signal) error {
+	return nil
+}
+
+func (p dryRunProcess) Kill() error {
+	return nil
+}
+
+func (p dryRunProcess) Wait() error {
+	return nil
+}
+
+// waitProcess waits for p in a goroutine and sends the result to
+// the returned channel.
+func waitProcess(p process) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- p.Wait()
+	}()
+	return ch
+}
+
+// killAfter waits for p, which has been asked to stop, to exit.
+// If p does not exit within timeout, it is killed.  exited must be
+// the channel returned by waitProcess for p.  killed is true if
+// p was killed.
+func killAfter(p process, exited <-chan error, timeout time.Duration) (killed bool, err error) {
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case err = <-exited:
+			return false, err
+		case <-timer.C:
+		}
+	}
+	p.Kill()
+	return true, <-exited
+}
+
+func execCommands(ctx context.Context, e executor, commands [][]string) error {
 	for _, cmds := range commands {
-		c := cmd.CommandContext(ctx, cmds[0], cmds[1:]...)
-		c.Severity = log.LvDebug
-		err := c.Run()
+		c := newCommand(cmds[0], cmds[1:]...)
+		c.severity = log.LvDebug
+		err := e.Run(ctx, c)
 		if err != nil {
 			return err
 		}
@@ -19,14 +205,14 @@ func execCommands(ctx context.Context, commands [][]string) error {
 	return nil
 }
 
-func execCommandsForce(commands [][]string) error {
+func execCommandsForce(e executor, commands [][]string) error {
 	ctx := context.Background()
 
 	var firstError error
 	for _, cmds := range commands {
-		c := cmd.CommandContext(ctx, cmds[0], cmds[1:]...)
-		c.Severity = log.LvDebug
-		err := c.Run()
+		c := newCommand(cmds[0], cmds[1:]...)
+		c.severity = log.LvDebug
+		err := e.Run(ctx, c)
 		if err != nil && firstError == nil {
 			firstError = err
 		}
@@ -0,0 +1,333 @@
+package placemat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newDryRunRuntime returns a dry-run runtime and the buffer where it
+// prints commands.  The directories of the runtime are removed when
+// the test finishes.
+func newDryRunRuntime(t *testing.T) (*Runtime, *bytes.Buffer) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(d)
+	})
+
+	buf := new(bytes.Buffer)
+	r, err := NewDryRunRuntime(buf, &RuntimeOptions{RunDir: d, DataDir: d, CacheDir: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, buf
+}
+
+func testShellQuote(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"":                     "''",
+		"ip":                   "ip",
+		"reboot-timeout=30000": "reboot-timeout=30000",
+		"type=1,serial=abc":    "type=1,serial=abc",
+		"romfile=":             "romfile=",
+		"!":                    "'!'",
+		"it's":                 `'it'\''s'`,
+		"a b":                  "'a b'",
+	}
+	for input, expected := range cases {
+		actual := shellQuote(input)
+		if actual != expected {
+			t.Errorf("shellQuote(%q) = %s, expected %s", input, actual, expected)
+		}
+	}
+}
+
+func testDryRun(t *testing.T) {
+	t.Parallel()
+
+	yaml := `
+kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+volumes:
+  - kind: raw
+    name: data
+    size: 10G
+---
+kind: Pod
+name: pod1
+interfaces:
+  - network: net0
+    addresses:
+      - 10.0.0.1/24
+apps:
+  - name: bird
+    image: docker://quay.io/cybozu/bird:2.0
+`
+	cluster, err := ReadYaml(bufio.NewReader(strings.NewReader(yaml)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, buf := newDryRunRuntime(t)
+	err = cluster.Start(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	expected := []string{
+		"iptables -N PLACEMAT -t filter",
+		"ip link add net0 type bridge",
+		"rkt --pull-policy=new --insecure-options=image fetch docker://quay.io/cybozu/bird:2.0",
+		"qemu-img create -f qcow2 " + r.dataDir + "/volumes/node1/data.img 10G",
+		"ip tuntap add pm0 mode tap",
+		"qemu-system-x86_64 -enable-kvm",
+		"ip link add pm1 type veth peer name pm1_",
+		"ip netns add pm_pod1",
+		"ip netns exec pm_pod1 chroot /placemat-root rkt",
+		"ip netns del pm_pod1",
+		"ip link delete net0 type bridge",
+		"iptables -X PLACEMAT -t nat",
+	}
+	pos := 0
+	for _, e := range expected {
+		i := strings.Index(out[pos:], e)
+		if i == -1 {
+			t.Fatalf("%q is not printed in order:\n%s", e, out)
+		}
+		pos += i + len(e)
+	}
+
+	_, err = os.Stat(journalPath(r.runDir))
+	if !os.IsNotExist(err) {
+		t.Error("journal must not be created in dry-run")
+	}
+}
+
+func testDryRunClusterName(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	cluster := testReadCluster(t, `
+kind: Network
+name: net0
+type: external
+use-nat: true
+address: 10.0.0.1/24
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+---
+kind: Pod
+name: pod1
+interfaces:
+  - network: net0
+    addresses:
+      - 10.0.0.2/24
+apps:
+  - name: bird
+    image: docker://quay.io/cybozu/bird:2.0
+`)
+
+	buf := new(bytes.Buffer)
+	opts := &RuntimeOptions{RunDir: d, DataDir: d, CacheDir: d}
+	for _, name := range []string{"1ci", "ci_1", "toolongname"} {
+		opts.ClusterName = name
+		_, err := NewDryRunRuntime(buf, opts)
+		if err == nil {
+			t.Errorf("cluster name %q should be rejected", name)
+		}
+	}
+	opts.ClusterName = "ci1"
+	r, err := NewDryRunRuntime(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Start(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	expected := []string{
+		"iptables -N PLACEMAT-ci1 -t filter",
+		"ip link add ci1-net0 type bridge",
+		"iptables -t filter -A PLACEMAT-ci1 -i ci1-net0 -j ACCEPT",
+		"ip tuntap add pmci1-0 mode tap",
+		"ip link set pmci1-0 master ci1-net0",
+		"ip link add pmci1-1 type veth peer name pmci1-1_",
+		"ip netns add pmci1_pod1",
+		"ip netns del pmci1_pod1",
+		"ip link delete ci1-net0 type bridge",
+		"iptables -X PLACEMAT-ci1 -t nat",
+	}
+	pos := 0
+	for _, e := range expected {
+		i := strings.Index(out[pos:], e)
+		if i == -1 {
+			t.Fatalf("%q is not printed in order:\n%s", e, out)
+		}
+		pos += i + len(e)
+	}
+	if strings.Contains(out, " PLACEMAT ") || strings.Contains(out, " net0 ") {
+		t.Error("resources are not namespaced:\n", out)
+	}
+	if strings.Contains(out, "forward=0") || strings.Contains(out, "forwarding=0") {
+		t.Error("IP forwarding shared with other clusters is turned off:\n", out)
+	}
+
+	cluster = testReadCluster(t, `
+kind: Network
+name: longnetwork1
+type: internal
+`)
+	err = cluster.Start(context.Background(), r)
+	if err == nil || !strings.Contains(err.Error(), "too long name with cluster name: ci1-longnetwork1") {
+		t.Error("too long bridge name should be rejected:", err)
+	}
+}
+
+// fakeProcess is a process that exits when it is killed or
+// when exit is closed.
+type fakeProcess struct {
+	exit   chan struct{}
+	killed bool
+}
+
+func (p *fakeProcess) Pid() int               { return 1 }
+func (p *fakeProcess) Signal(os.Signal) error { return nil }
+func (p *fakeProcess) Wait() error            { <-p.exit; return nil }
+
+func (p *fakeProcess) Kill() error {
+	p.killed = true
+	close(p.exit)
+	return nil
+}
+
+func testShutdown(t *testing.T) {
+	t.Parallel()
+
+	// guest shuts down by ACPI.
+	p := &fakeProcess{exit: make(chan struct{})}
+	monitor, qemu := net.Pipe()
+	vm := &NodeVM{proc: p, monitor: monitor, running: true}
+	go func() {
+		line, _ := bufio.NewReader(qemu).ReadString('\n')
+		if line == "system_powerdown\n" {
+			close(p.exit)
+		}
+	}()
+	if vm.shutdown(time.Minute, waitProcess(p)) {
+		t.Error("VM should not be killed")
+	}
+
+	// guest ignores ACPI.
+	p = &fakeProcess{exit: make(chan struct{})}
+	monitor, qemu = net.Pipe()
+	vm = &NodeVM{proc: p, monitor: monitor, running: true}
+	go ioutil.ReadAll(qemu)
+	if !vm.shutdown(10*time.Millisecond, waitProcess(p)) || !p.killed {
+		t.Error("VM should be killed")
+	}
+
+	// VM is powered off.
+	p = &fakeProcess{exit: make(chan struct{})}
+	vm = &NodeVM{proc: p}
+	if !vm.shutdown(time.Minute, waitProcess(p)) || !p.killed {
+		t.Error("powered off VM should be killed immediately")
+	}
+}
+
+func testDryRunHooks(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	cluster := new(Cluster).
+		AddNetwork(&NetworkSpec{Name: "net0", Type: "internal"}).
+		AddNode(&NodeSpec{Name: "node1", Interfaces: []NodeInterfaceSpec{{Network: "net0"}}}).
+		AddPod(&PodSpec{
+			Name:       "pod1",
+			Interfaces: []PodInterfaceSpec{{Network: "net0", Addresses: []string{"10.0.0.1/24"}}},
+			Apps:       []*PodAppSpec{{Name: "bird", Image: "docker://quay.io/cybozu/bird:2.0"}},
+		})
+	err = cluster.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var started []string
+	ready := make(chan struct{})
+	r, err := NewDryRunRuntime(ioutil.Discard, &RuntimeOptions{
+		RunDir:   d,
+		DataDir:  d,
+		CacheDir: d,
+		OnNetworkCreated: func(n *Network) {
+			started = append(started, "network "+n.Name)
+		},
+		OnNodeStarted: func(vm *NodeVM) {
+			started = append(started, "node "+vm.Name())
+		},
+		OnPodStarted: func(p *Pod) {
+			started = append(started, "pod "+p.Name)
+		},
+		Ready: ready,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Start(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ready:
+	default:
+		t.Error("Ready is not closed")
+	}
+	expected := []string{"network net0", "node node1", "pod pod1"}
+	if strings.Join(started, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, actual %v", expected, started)
+	}
+}
+
+func TestExec(t *testing.T) {
+	t.Run("ShellQuote", testShellQuote)
+	t.Run("DryRun", testDryRun)
+	t.Run("DryRunClusterName", testDryRunClusterName)
+	t.Run("DryRunHooks", testDryRunHooks)
+	t.Run("Shutdown", testShutdown)
+}
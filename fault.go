@@ -0,0 +1,404 @@
+package placemat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// FaultKind is the kind of a fault injected into a running cluster.
+type FaultKind string
+
+// Fault kinds.
+const (
+	// FaultLinkDown sets the host side of interfaces down.
+	FaultLinkDown = FaultKind("link-down")
+	// FaultNetem emulates delay, loss, duplication, and reordering of
+	// packets sent to interfaces.
+	FaultNetem = FaultKind("netem")
+	// FaultPartition partitions a network into groups that cannot
+	// reach each other.
+	FaultPartition = FaultKind("partition")
+)
+
+// FaultSpec represents a fault to inject.
+//
+// link-down and netem faults apply to the interfaces of Target, a node
+// or a pod, connected to Network.  If Target is empty, they apply to all
+// the interfaces connected to Network.  A partition fault applies to
+// Network and divides the nodes and pods listed in Groups.  Nodes and
+// pods not in Groups can reach all of them.
+type FaultSpec struct {
+	Kind    FaultKind `json:"kind" yaml:"kind"`
+	Target  string    `json:"target,omitempty" yaml:"target,omitempty"`
+	Network string    `json:"network" yaml:"network"`
+
+	// Delay and Jitter are durations like "100ms".  Loss, Duplicate,
+	// and Reorder are percentages.  Reorder requires Delay.
+	Delay     string  `json:"delay,omitempty" yaml:"delay,omitempty"`
+	Jitter    string  `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	Loss      float64 `json:"loss,omitempty" yaml:"loss,omitempty"`
+	Duplicate float64 `json:"duplicate,omitempty" yaml:"duplicate,omitempty"`
+	Reorder   float64 `json:"reorder,omitempty" yaml:"reorder,omitempty"`
+
+	Groups [][]string `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
+// validate checks spec without looking up resources.
+func (s *FaultSpec) validate() error {
+	if s.Network == "" {
+		return errors.New("network is not specified")
+	}
+	switch s.Kind {
+	case FaultLinkDown:
+	case FaultNetem:
+		_, err := s.netemArgs()
+		if err != nil {
+			return err
+		}
+	case FaultPartition:
+		if len(s.Groups) < 2 {
+			return errors.New("partition needs two or more groups")
+		}
+		for _, g := range s.Groups {
+			if len(g) == 0 {
+				return errors.New("empty group")
+			}
+		}
+	default:
+		return errors.New("unknown fault kind: " + string(s.Kind))
+	}
+	return nil
+}
+
+// Fault is a fault injected into a running cluster.
+type Fault struct {
+	ID int `json:"id"`
+	FaultSpec
+	// Devices are the tap or veth devices the fault applies to.
+	Devices []string `json:"devices"`
+
+	apply [][]string
+	undo  [][]string
+	// keys identify what the fault occupies to reject conflicting faults.
+	keys []string
+}
+
+// name returns the name of the resource the fault applies to.
+func (f *Fault) name() string {
+	if f.Target != "" {
+		return f.Target
+	}
+	return f.Network
+}
+
+func (f *Fault) conflicts(other *Fault) bool {
+	for _, k := range f.keys {
+		for _, k2 := range other.keys {
+			if k == k2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// netemArgs returns the arguments of netem qdisc.
+func (s *FaultSpec) netemArgs() ([]string, error) {
+	var args []string
+	if s.Delay != "" {
+		delay, err := time.ParseDuration(s.Delay)
+		if err != nil || delay < 0 {
+			return nil, errors.New("invalid delay: " + s.Delay)
+		}
+		args = append(args, "delay", tcTime(delay))
+		if s.Jitter != "" {
+			jitter, err := time.ParseDuration(s.Jitter)
+			if err != nil || jitter < 0 {
+				return nil, errors.New("invalid jitter: " + s.Jitter)
+			}
+			args = append(args, tcTime(jitter))
+		}
+	} else if s.Jitter != "" {
+		return nil, errors.New("jitter requires delay")
+	}
+
+	for _, p := range []struct {
+		name  string
+		value float64
+	}{
+		{"loss", s.Loss},
+		{"duplicate", s.Duplicate},
+		{"reorder", s.Reorder},
+	} {
+		if p.value < 0 || p.value > 100 {
+			return nil, fmt.Errorf("%s must be between 0 and 100", p.name)
+		}
+		if p.value > 0 {
+			args = append(args, p.name, tcPercent(p.value))
+		}
+	}
+	if s.Reorder > 0 && s.Delay == "" {
+		return nil, errors.New("reorder requires delay")
+	}
+	if len(args) == 0 {
+		return nil, errors.New("no netem parameters")
+	}
+	return args, nil
+}
+
+func tcTime(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Microsecond), 10) + "us"
+}
+
+func tcPercent(p float64) string {
+	return strconv.FormatFloat(p, 'f', -1, 64) + "%"
+}
+
+// interfaceDevices returns the host side devices of the interfaces of
+// target connected to network.  target is a node, a pod, or empty for
+// all of them.
+func (c *Cluster) interfaceDevices(target, network string) ([]string, error) {
+	nw, err := c.GetNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if nw.link != nil && nw.link.pair {
+		return nil, errors.New("cannot inject fault into link between pods: " + network)
+	}
+
+	var devices []string
+	if target == "" {
+		taps, veths := nw.devices()
+		devices = append(taps, veths...)
+		if len(devices) == 0 {
+			return nil, errors.New("no running interface on " + network)
+		}
+		return devices, nil
+	}
+	if n, err := c.GetNode(target); err == nil {
+		for i, nw := range n.networks {
+			if nw.Name == network && i < len(n.taps) {
+				devices = append(devices, n.taps[i])
+			}
+		}
+	} else if p, err := c.GetPod(target); err == nil {
+		for i, nw := range p.networks {
+			if nw.Name == network && i < len(p.veths) {
+				devices = append(devices, p.veths[i])
+			}
+		}
+	} else {
+		return nil, errors.New("no such node or pod: " + target)
+	}
+
+	if len(devices) == 0 {
+		return nil, errors.New(target + " has no running interface on " + network)
+	}
+	return devices, nil
+}
+
+// partitionDevices returns the devices of each group on network.
+func (c *Cluster) partitionDevices(network string, groups [][]string) ([][]string, error) {
+	seen := make(map[string]bool)
+	devices := make([][]string, len(groups))
+	for i, g := range groups {
+		for _, m := range g {
+			if seen[m] {
+				return nil, errors.New("duplicate member: " + m)
+			}
+			seen[m] = true
+
+			d, err := c.interfaceDevices(m, network)
+			if err != nil {
+				return nil, err
+			}
+			devices[i] = append(devices[i], d...)
+		}
+	}
+	return devices, nil
+}
+
+// newFault creates a Fault from spec with commands to apply and undo it.
+func (c *Cluster) newFault(spec *FaultSpec) (*Fault, error) {
+	err := spec.validate()
+	if err != nil {
+		return nil, err
+	}
+	f := &Fault{FaultSpec: *spec}
+
+	switch spec.Kind {
+	case FaultLinkDown:
+		devices, err := c.interfaceDevices(spec.Target, spec.Network)
+		if err != nil {
+			return nil, err
+		}
+		f.Devices = devices
+		for _, d := range devices {
+			f.apply = append(f.apply, []string{"ip", "link", "set", d, "down"})
+			f.undo = append(f.undo, []string{"ip", "link", "set", d, "up"})
+			f.keys = append(f.keys, "link:"+d)
+		}
+
+	case FaultNetem:
+		args, err := spec.netemArgs()
+		if err != nil {
+			return nil, err
+		}
+		devices, err := c.interfaceDevices(spec.Target, spec.Network)
+		if err != nil {
+			return nil, err
+		}
+		f.Devices = devices
+		for _, d := range devices {
+			// netem replaces the link profile of the interface until
+			// the fault is removed.
+			op := "add"
+			var restore [][]string
+			if link := c.deviceLink(d); link != nil {
+				op = "replace"
+				restore, _, _ = link.commands(d)
+			}
+			f.apply = append(f.apply, append([]string{"tc", "qdisc", op, "dev", d, "root", "netem"}, args...))
+			f.undo = append(f.undo, []string{"tc", "qdisc", "del", "dev", d, "root"})
+			f.undo = append(f.undo, restore...)
+			f.keys = append(f.keys, "qdisc:"+d)
+		}
+
+	case FaultPartition:
+		nw, err := c.GetNetwork(spec.Network)
+		if err != nil {
+			return nil, err
+		}
+		if nw.link != nil {
+			return nil, errors.New("cannot partition link: " + spec.Network)
+		}
+		groups, err := c.partitionDevices(spec.Network, spec.Groups)
+		if err != nil {
+			return nil, err
+		}
+		for i, g := range groups {
+			f.Devices = append(f.Devices, g...)
+			for _, g2 := range groups[i+1:] {
+				for _, a := range g {
+					for _, b := range g2 {
+						for _, rule := range [][]string{{"-i", a, "-o", b, "-j", "DROP"}, {"-i", b, "-o", a, "-j", "DROP"}} {
+							f.apply = append(f.apply, append([]string{"ebtables", "-A", "FORWARD"}, rule...))
+							f.undo = append(f.undo, append([]string{"ebtables", "-D", "FORWARD"}, rule...))
+						}
+					}
+				}
+			}
+		}
+		f.keys = []string{"partition:" + spec.Network}
+	}
+	return f, nil
+}
+
+// faultSet is the set of faults injected into a running cluster.
+type faultSet struct {
+	mu     sync.Mutex
+	lastID int
+	faults []*Fault
+}
+
+// injectFault applies a fault described by spec to c.
+// It fails if the fault conflicts with one already injected.
+func (r *Runtime) injectFault(c *Cluster, spec *FaultSpec) (*Fault, error) {
+	f, err := c.newFault(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	r.faults.mu.Lock()
+	defer r.faults.mu.Unlock()
+
+	for _, f2 := range r.faults.faults {
+		if f.conflicts(f2) {
+			return nil, fmt.Errorf("conflicts with fault %d", f2.ID)
+		}
+	}
+
+	r.faults.lastID++
+	f.ID = r.faults.lastID
+	err = r.journal.recordUndo("fault", strconv.Itoa(f.ID), f.undo...)
+	if err != nil {
+		return nil, err
+	}
+	err = execCommands(context.Background(), r.executor, f.apply)
+	if err != nil {
+		execCommandsForce(r.executor, f.undo)
+		return nil, err
+	}
+	r.faults.faults = append(r.faults.faults, f)
+
+	log.Info("injected fault", map[string]interface{}{
+		"id":      f.ID,
+		"kind":    f.Kind,
+		"devices": f.Devices,
+	})
+	r.emit(EventFaultInjected, f.name(), map[string]interface{}{
+		"id":   f.ID,
+		"kind": f.Kind,
+	})
+	return f, nil
+}
+
+// removeFault reverts the fault of id.
+func (r *Runtime) removeFault(id int) error {
+	r.faults.mu.Lock()
+	defer r.faults.mu.Unlock()
+
+	for i, f := range r.faults.faults {
+		if f.ID != id {
+			continue
+		}
+		r.faults.faults = append(r.faults.faults[:i], r.faults.faults[i+1:]...)
+		r.revertFault(f)
+		return nil
+	}
+	return errors.New("no such fault: " + strconv.Itoa(id))
+}
+
+// revertFault runs the undo commands of f.  Errors are logged and ignored
+// because the devices may have been deleted with their node or pod.
+func (r *Runtime) revertFault(f *Fault) {
+	err := execCommandsForce(r.executor, f.undo)
+	if err != nil {
+		log.Warn("failed to revert fault", map[string]interface{}{
+			log.FnError: err,
+			"id":        f.ID,
+		})
+	}
+	log.Info("removed fault", map[string]interface{}{
+		"id":   f.ID,
+		"kind": f.Kind,
+	})
+	r.emit(EventFaultRemoved, f.name(), map[string]interface{}{
+		"id":   f.ID,
+		"kind": f.Kind,
+	})
+}
+
+// listFaults returns the injected faults in the order of injection.
+func (r *Runtime) listFaults() []*Fault {
+	r.faults.mu.Lock()
+	defer r.faults.mu.Unlock()
+	return append([]*Fault{}, r.faults.faults...)
+}
+
+// clearFaults reverts all the faults in the reverse order.
+func (r *Runtime) clearFaults() {
+	r.faults.mu.Lock()
+	defer r.faults.mu.Unlock()
+
+	for i := len(r.faults.faults) - 1; i >= 0; i-- {
+		r.revertFault(r.faults.faults[i])
+	}
+	r.faults.faults = nil
+}
@@ -0,0 +1,146 @@
+package placemat
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testFaultCluster returns a resolved cluster whose nodes and pod have
+// devices, and a dry-run runtime.
+func testFaultCluster(t *testing.T) (*Cluster, *Runtime, *bytes.Buffer) {
+	yaml := `
+kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+---
+kind: Node
+name: node2
+interfaces:
+  - net0
+---
+kind: Pod
+name: pod1
+interfaces:
+  - network: net0
+apps:
+  - name: bird
+    image: docker://quay.io/cybozu/bird:2.0
+`
+	cluster, err := ReadYaml(bufio.NewReader(strings.NewReader(yaml)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.Nodes[0].taps = []string{"pm0"}
+	cluster.Nodes[1].taps = []string{"pm1"}
+	cluster.Pods[0].veths = []string{"pm2"}
+
+	r, buf := newDryRunRuntime(t)
+	return cluster, r, buf
+}
+
+func testFaultInject(t *testing.T) {
+	t.Parallel()
+
+	c, r, buf := testFaultCluster(t)
+
+	specs := []*FaultSpec{
+		{Kind: FaultLinkDown, Target: "node1", Network: "net0"},
+		{Kind: FaultNetem, Target: "pod1", Network: "net0", Delay: "100ms", Jitter: "10ms", Loss: 0.5, Reorder: 25},
+		{Kind: FaultPartition, Network: "net0", Groups: [][]string{{"node1", "pod1"}, {"node2"}}},
+	}
+	for _, spec := range specs {
+		_, err := r.injectFault(c, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{
+		"ip link set pm0 down",
+		"tc qdisc add dev pm2 root netem delay 100000us 10000us loss 0.5% reorder 25%",
+		"ebtables -A FORWARD -i pm0 -o pm1 -j DROP",
+		"ebtables -A FORWARD -i pm1 -o pm0 -j DROP",
+		"ebtables -A FORWARD -i pm2 -o pm1 -j DROP",
+		"ebtables -A FORWARD -i pm1 -o pm2 -j DROP",
+	}
+	if out := strings.TrimSpace(buf.String()); out != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commands:\n%s", out)
+	}
+
+	faults := r.listFaults()
+	if len(faults) != 3 || faults[1].ID != 2 || faults[1].Devices[0] != "pm2" {
+		t.Fatal("unexpected faults:", faults)
+	}
+
+	_, err := r.injectFault(c, &FaultSpec{Kind: FaultNetem, Target: "pod1", Network: "net0", Loss: 1})
+	if err == nil || err.Error() != "conflicts with fault 2" {
+		t.Error("conflicting fault is injected:", err)
+	}
+
+	buf.Reset()
+	err = r.removeFault(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(buf.String()) != "ip link set pm0 up" {
+		t.Errorf("unexpected commands:\n%s", buf.String())
+	}
+	err = r.removeFault(1)
+	if err == nil {
+		t.Error("removed fault is removed again")
+	}
+
+	buf.Reset()
+	r.clearFaults()
+	out := buf.String()
+	if !strings.HasPrefix(out, "ebtables -D FORWARD -i pm0 -o pm1 -j DROP\n") ||
+		!strings.HasSuffix(out, "tc qdisc del dev pm2 root\n") {
+		t.Errorf("faults are not cleared in reverse order:\n%s", out)
+	}
+	if len(r.listFaults()) != 0 {
+		t.Error("faults are not cleared")
+	}
+}
+
+func testFaultErrors(t *testing.T) {
+	t.Parallel()
+
+	c, r, _ := testFaultCluster(t)
+
+	cases := []struct {
+		spec     FaultSpec
+		expected string
+	}{
+		{FaultSpec{Kind: "crash", Network: "net0"}, "unknown fault kind: crash"},
+		{FaultSpec{Kind: FaultLinkDown, Target: "node1"}, "network is not specified"},
+		{FaultSpec{Kind: FaultLinkDown, Target: "node3", Network: "net0"}, "no such node or pod: node3"},
+		{FaultSpec{Kind: FaultLinkDown, Target: "node1", Network: "net1"}, "no such network: net1"},
+		{FaultSpec{Kind: FaultNetem, Target: "node1", Network: "net0"}, "no netem parameters"},
+		{FaultSpec{Kind: FaultNetem, Target: "node1", Network: "net0", Jitter: "1ms"}, "jitter requires delay"},
+		{FaultSpec{Kind: FaultNetem, Target: "node1", Network: "net0", Reorder: 10}, "reorder requires delay"},
+		{FaultSpec{Kind: FaultNetem, Target: "node1", Network: "net0", Loss: 101}, "loss must be between 0 and 100"},
+		{FaultSpec{Kind: FaultPartition, Network: "net0", Groups: [][]string{{"node1"}}}, "partition needs two or more groups"},
+		{FaultSpec{Kind: FaultPartition, Network: "net0", Groups: [][]string{{"node1"}, {"node1"}}}, "duplicate member: node1"},
+	}
+	for _, tc := range cases {
+		_, err := r.injectFault(c, &tc.spec)
+		if err == nil || err.Error() != tc.expected {
+			t.Errorf("%v: expected %q, actual %v", tc.spec, tc.expected, err)
+		}
+	}
+}
+
+func TestFault(t *testing.T) {
+	t.Run("Inject", testFaultInject)
+	t.Run("Errors", testFaultErrors)
+}
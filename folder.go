@@ -23,6 +23,13 @@ type DataFolderSpec struct {
 	Files []DataFolderFileSpec `yaml:"files,omitempty"`
 }
 
+func (s *DataFolderSpec) resolvePaths(dir string) {
+	s.Dir = resolvePath(dir, s.Dir)
+	for i := range s.Files {
+		s.Files[i].File = resolvePath(dir, s.Files[i].File)
+	}
+}
+
 // DataFolder represents a data folder configuration
 type DataFolder struct {
 	*DataFolderSpec
@@ -66,7 +73,11 @@ func (d *DataFolder) Path() string {
 }
 
 // Prepare copies or downloads necessary files to prepare folder contents.
-func (d *DataFolder) Prepare(ctx context.Context, baseDir string, c *cache) error {
+func (d *DataFolder) Prepare(ctx context.Context, r *Runtime, baseDir string, c *cache) error {
+	if r.dryRun {
+		return d.prepareDryRun(r, baseDir)
+	}
+
 	if len(d.Dir) != 0 {
 		st, err := os.Stat(d.Dir)
 		if err != nil {
@@ -116,3 +127,39 @@ func (d *DataFolder) Prepare(ctx context.Context, baseDir string, c *cache) erro
 	d.dirPath = p
 	return nil
 }
+
+// Destroy removes the folder contents prepared from files.
+// A folder of a host directory is left as is.
+func (d *DataFolder) Destroy(r *Runtime) error {
+	if len(d.Dir) != 0 || d.dirPath == "" {
+		return nil
+	}
+	if r.dryRun {
+		r.note("remove %s", d.dirPath)
+		return nil
+	}
+	return os.RemoveAll(d.dirPath)
+}
+
+func (d *DataFolder) prepareDryRun(r *Runtime, baseDir string) error {
+	if len(d.Dir) != 0 {
+		absPath, err := filepath.Abs(d.Dir)
+		if err != nil {
+			return err
+		}
+		d.dirPath = absPath
+		return nil
+	}
+
+	p := filepath.Join(baseDir, d.Name)
+	for _, file := range d.Files {
+		dstPath := filepath.Join(p, file.Name)
+		if file.File != "" {
+			r.note("copy %s to %s", file.File, dstPath)
+		} else {
+			r.note("download %s to %s", file.URL, dstPath)
+		}
+	}
+	d.dirPath = p
+	return nil
+}
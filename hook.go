@@ -0,0 +1,141 @@
+package placemat
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// HookEvent is a lifecycle point of a cluster to run hooks.
+type HookEvent string
+
+// Hook events.
+const (
+	HookNetworksCreated = HookEvent("networks-created")
+	HookNodeStarted     = HookEvent("node-started")
+	HookBMCRegistered   = HookEvent("bmc-registered")
+	HookBeforeShutdown  = HookEvent("before-shutdown")
+)
+
+func (e HookEvent) validate() error {
+	switch e {
+	case HookNetworksCreated, HookNodeStarted, HookBMCRegistered, HookBeforeShutdown:
+		return nil
+	case "":
+		return &fieldError{field: "on", err: errors.New("hook event is not specified")}
+	}
+	return &fieldError{field: "on", value: string(e), err: errors.New("unknown hook event: " + string(e))}
+}
+
+const defaultHookTimeout = time.Minute
+
+// HookSpec represents a Hook specification in YAML.
+type HookSpec struct {
+	Kind    string        `yaml:"kind"`
+	Name    string        `yaml:"name"`
+	On      HookEvent     `yaml:"on"`
+	Command []string      `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// resolvePaths resolves the command if it is a relative path
+// such as "./add-routes.sh".  Commands without "/" are looked up in PATH.
+func (s *HookSpec) resolvePaths(dir string) {
+	if len(s.Command) > 0 && strings.ContainsRune(s.Command[0], '/') {
+		s.Command[0] = resolvePath(dir, s.Command[0])
+	}
+}
+
+// Hook represents a command run on the host at a lifecycle point.
+type Hook struct {
+	*HookSpec
+}
+
+// NewHook creates a Hook from spec.
+func NewHook(spec *HookSpec) (*Hook, error) {
+	if spec.Name == "" {
+		return nil, errors.New("hook name is empty")
+	}
+
+	var errs ErrorList
+	errs.add(spec.On.validate())
+	if len(spec.Command) == 0 {
+		errs.add(&fieldError{field: "command", err: errors.New("command is empty")})
+	}
+	if spec.Timeout < 0 {
+		errs.add(&fieldError{field: "timeout", err: errors.New("negative timeout")})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return &Hook{HookSpec: spec}, nil
+}
+
+// env returns environment variables for the hook in a stable order.
+func (h *Hook) env(r *Runtime, vars map[string]string) []string {
+	all := map[string]string{
+		"PLACEMAT_HOOK":         h.Name,
+		"PLACEMAT_EVENT":        string(h.On),
+		"PLACEMAT_CLUSTER_NAME": r.clusterName,
+		"PLACEMAT_RUN_DIR":      r.runDir,
+	}
+	for k, v := range vars {
+		all[k] = v
+	}
+
+	env := make([]string, 0, len(all))
+	for k, v := range all {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// run runs the hook.  Failures are logged and do not stop the cluster.
+func (h *Hook) run(r *Runtime, vars map[string]string) {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c := newCommand(h.Command[0], h.Command[1:]...)
+	c.env = h.env(r, vars)
+	c.stdout = newColoredLogWriter("hook", h.Name, os.Stdout)
+	c.stderr = newColoredLogWriter("hook", h.Name, os.Stderr)
+	err := r.executor.Run(ctx, c)
+	if err != nil {
+		log.Error("hook failed", map[string]interface{}{
+			log.FnError: err,
+			"name":      h.Name,
+			"event":     h.On,
+		})
+	}
+}
+
+// setHooks replaces the hooks to be run.
+func (r *Runtime) setHooks(hooks []*Hook) {
+	r.hooksMu.Lock()
+	r.hooks = hooks
+	r.hooksMu.Unlock()
+}
+
+// runHooks runs the hooks for event one by one.  vars are passed to
+// the hooks as environment variables in addition to common ones.
+func (r *Runtime) runHooks(event HookEvent, vars map[string]string) {
+	r.hooksMu.Lock()
+	hooks := r.hooks
+	r.hooksMu.Unlock()
+
+	for _, h := range hooks {
+		if h.On == event {
+			h.run(r, vars)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package placemat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testHookErrors(t *testing.T) {
+	t.Parallel()
+
+	yaml := `kind: Hook
+name: hook1
+on: node-stopped
+command: [true]
+---
+kind: Hook
+name: hook2
+on: networks-created
+---
+kind: Hook
+name: hook3
+on: before-shutdown
+command: [true]
+timeout: 30s
+`
+	_, err := readYaml(bytes.NewReader([]byte(yaml)), "test.yml", nil)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+
+	expected := []string{
+		"test.yml:3: on: unknown hook event: node-stopped",
+		"test.yml:6: command: command is empty",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+}
+
+func testHookDryRun(t *testing.T) {
+	t.Parallel()
+
+	yaml := `
+kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+smbios:
+  serial: abc
+---
+kind: Hook
+name: routes
+on: networks-created
+command: [/usr/local/bin/add-routes, "10.0.0.0/8"]
+timeout: 30s
+---
+kind: Hook
+name: node
+on: node-started
+command: [logger, started]
+---
+kind: Hook
+name: teardown
+on: before-shutdown
+command: [logger, bye]
+`
+	cluster, err := ReadYaml(bufio.NewReader(strings.NewReader(yaml)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster.Hooks[0].Timeout != 30*time.Second {
+		t.Error("unexpected timeout:", cluster.Hooks[0].Timeout)
+	}
+
+	r, buf := newDryRunRuntime(t)
+	err = cluster.Start(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	common := "PLACEMAT_CLUSTER_NAME= "
+	expected := []string{
+		"PLACEMAT_BRIDGES=net0 " + common + "PLACEMAT_EVENT=networks-created PLACEMAT_HOOK=routes PLACEMAT_NETWORKS=net0 PLACEMAT_RUN_DIR=" + r.runDir + " /usr/local/bin/add-routes 10.0.0.0/8",
+		common + "PLACEMAT_EVENT=node-started PLACEMAT_HOOK=node PLACEMAT_INTERFACES=net0 PLACEMAT_MACS=" + r.nodeMAC("node1", 0) + " PLACEMAT_NODE=node1 PLACEMAT_RUN_DIR=" + r.runDir + " PLACEMAT_SERIAL=abc PLACEMAT_TAPS=pm0 logger started",
+		common + "PLACEMAT_EVENT=before-shutdown PLACEMAT_HOOK=teardown PLACEMAT_RUN_DIR=" + r.runDir + " logger bye",
+		"ip link delete net0 type bridge",
+	}
+	pos := 0
+	for _, e := range expected {
+		i := strings.Index(out[pos:], e+"\n")
+		if i == -1 {
+			t.Fatalf("%q is not printed in order:\n%s", e, out)
+		}
+		pos += i + len(e)
+	}
+}
+
+func TestHook(t *testing.T) {
+	t.Run("Errors", testHookErrors)
+	t.Run("DryRun", testHookDryRun)
+}
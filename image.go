@@ -15,6 +15,10 @@ type ImageSpec struct {
 	CompressionMethod string `yaml:"compression,omitempty"`
 }
 
+func (s *ImageSpec) resolvePaths(dir string) {
+	s.File = resolvePath(dir, s.File)
+}
+
 // Image represents an image configuration
 type Image struct {
 	*ImageSpec
@@ -56,10 +60,17 @@ func NewImage(spec *ImageSpec) (*Image, error) {
 }
 
 // Prepare downloads the image if it is not in the cache.
-func (i *Image) Prepare(ctx context.Context, c *cache) error {
+func (i *Image) Prepare(ctx context.Context, r *Runtime, c *cache) error {
 	if i.u == nil {
 		return nil
 	}
+	if r.dryRun {
+		if !c.Contains(i.u.String()) {
+			r.note("download %s", i.u.String())
+		}
+		i.p = c.Path(i.u.String())
+		return nil
+	}
 	err := downloadData(ctx, i.u, i.decomp, c)
 	if err != nil {
 		return err
@@ -0,0 +1,212 @@
+package placemat
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+const (
+	journalFileName    = "placemat.journal"
+	processStopTimeout = 10 * time.Second
+)
+
+// journalEntry records a host resource created by placemat
+// and how to remove it.
+type journalEntry struct {
+	Resource string     `json:"resource"`
+	Name     string     `json:"name"`
+	Undo     [][]string `json:"undo,omitempty"`
+	PID      int        `json:"pid,omitempty"`
+}
+
+// journal is a write-ahead log of host resources created by placemat.
+//
+// Entries are appended before the resources are created so that
+// "placemat cleanup" can remove them even if placemat crashes.
+// A nil *journal discards entries.
+type journal struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func journalPath(runDir string) string {
+	return filepath.Join(runDir, journalFileName)
+}
+
+// openJournal creates a new journal file at p.
+// It fails if the file already exists because that means the previous
+// run of placemat did not finish cleanly.
+func openJournal(p string) (*journal, error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, errors.New(p + " exists; run \"placemat cleanup\" to remove resources leaked by the previous run")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &journal{f: f}, nil
+}
+
+func (j *journal) record(e journalEntry) error {
+	if j == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.f.Write(data)
+	if err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) recordUndo(resource, name string, undo ...[]string) error {
+	return j.record(journalEntry{
+		Resource: resource,
+		Name:     name,
+		Undo:     undo,
+	})
+}
+
+func (j *journal) recordProcess(name string, pid int) error {
+	return j.record(journalEntry{
+		Resource: "process",
+		Name:     name,
+		PID:      pid,
+	})
+}
+
+// remove closes and removes the journal file.
+// This should be called after all the resources are destroyed.
+func (j *journal) remove() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.f.Close()
+	return os.Remove(j.f.Name())
+}
+
+func readJournal(p string) ([]journalEntry, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e journalEntry
+		err := json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			// the last line may be truncated by a crash.
+			log.Warn("ignored broken journal entry", map[string]interface{}{
+				log.FnError: err.Error(),
+				"entry":     s.Text(),
+			})
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// processMatches returns true if the process pid is still running the
+// named executable.  This prevents killing an unrelated process that
+// happens to reuse the pid.
+func processMatches(pid int, name string) bool {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(data), name)
+}
+
+func stopProcess(pid int, name string) {
+	if !processMatches(pid, name) {
+		return
+	}
+
+	log.Info("stopping leaked process", map[string]interface{}{
+		"name": name,
+		"pid":  pid,
+	})
+	syscall.Kill(pid, syscall.SIGTERM)
+
+	deadline := time.Now().Add(processStopTimeout)
+	for time.Now().Before(deadline) {
+		if !processMatches(pid, name) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// Cleanup removes host resources leaked by a crashed placemat
+// that ran with runDir as its run directory.
+//
+// It replays the journal written by the crashed placemat in reverse
+// order.  Errors are logged and ignored because some of the resources
+// may already be removed.
+func Cleanup(runDir string) error {
+	p := journalPath(runDir)
+	entries, err := readJournal(p)
+	if os.IsNotExist(err) {
+		log.Info("no journal; nothing to clean up", map[string]interface{}{
+			"journal": p,
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		log.Info("cleaning up", map[string]interface{}{
+			"resource": e.Resource,
+			"name":     e.Name,
+		})
+
+		if e.PID != 0 {
+			stopProcess(e.PID, e.Name)
+			continue
+		}
+
+		for _, undo := range e.Undo {
+			err := execCommandsForce(hostExecutor{}, [][]string{undo})
+			if err != nil {
+				log.Warn("failed to clean up", map[string]interface{}{
+					log.FnError: err.Error(),
+					"resource":  e.Resource,
+					"name":      e.Name,
+					"command":   undo,
+				})
+			}
+		}
+	}
+
+	return os.Remove(p)
+}
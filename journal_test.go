@@ -0,0 +1,62 @@
+package placemat
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	j, err := openJournal(journalPath(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []journalEntry{
+		{Resource: "bridge", Name: "net0", Undo: [][]string{{"ip", "link", "delete", "net0", "type", "bridge"}}},
+		{Resource: "process", Name: "qemu-system-x86_64", PID: 1234},
+	}
+	err = j.recordUndo(expected[0].Resource, expected[0].Name, expected[0].Undo...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = j.recordProcess(expected[1].Name, expected[1].PID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = openJournal(journalPath(d))
+	if err == nil {
+		t.Error("journal must not be opened twice")
+	}
+
+	entries, err := readJournal(journalPath(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Error("unexpected entries:", entries)
+	}
+
+	err = j.remove()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(journalPath(d))
+	if !os.IsNotExist(err) {
+		t.Error("journal must be removed")
+	}
+
+	var nilJournal *journal
+	err = nilJournal.recordProcess("rkt", 1)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,406 @@
+package placemat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// linkWatchInterval is the interval to check the carrier of link ends.
+const linkWatchInterval = time.Second
+
+// LinkSpec represents a Link specification in YAML.
+type LinkSpec struct {
+	Kind string `yaml:"kind"`
+	Name string `yaml:"name"`
+}
+
+// Link is a point-to-point connection between two interfaces of nodes
+// or pods, like a cable.
+//
+// Interfaces are connected to a Link by its name in place of a Network.
+// Two pods are connected by a veth pair whose ends are in their network
+// namespaces.  Otherwise, frames received by the host side device of an
+// interface, a tap or a veth, are redirected by tc to the device of the
+// other interface without a bridge.  Either way, link-local protocols
+// such as LLDP and LACP pass, and carrier loss of an end propagates to
+// the other.
+type Link struct {
+	*LinkSpec
+
+	// network holds the devices of the interfaces.  It has no bridge.
+	network *Network
+
+	// pair is true if both ends are pods.
+	pair bool
+
+	// carrier returns whether the carrier of a host side device is on.
+	carrier func(dev string) bool
+
+	mu     sync.Mutex
+	ends   []*linkEnd
+	paired bool // the veth pair exists
+}
+
+// linkEnd is an interface connected to a Link.
+type linkEnd struct {
+	owner     string   // node or pod name
+	index     int      // index of the interface
+	pod       bool     // true if owner is a pod
+	addresses []string // addresses of the pod interface
+	profile   *LinkProfile
+
+	// dev is the host side device, empty while not running.
+	// For a veth pair, it is the name of the end on the host.
+	dev string
+	// vm is the running QEMU of a node.
+	vm *NodeVM
+	// netns is the network namespace of a pod that has the end of
+	// the veth pair.
+	netns string
+	// down is true if the carrier is dropped as the other end is down.
+	down bool
+}
+
+// NewLink creates a Link from spec.
+func NewLink(spec *LinkSpec) (*Link, error) {
+	if spec.Name == "" {
+		return nil, errors.New("link name is empty")
+	}
+	l := &Link{LinkSpec: spec, carrier: deviceCarrier}
+	l.network = &Network{
+		NetworkSpec: &NetworkSpec{Name: spec.Name},
+		link:        l,
+	}
+	return l, nil
+}
+
+// Resolve finds the interfaces of nodes and pods connected to the Link.
+// A Link must connect exactly two interfaces.
+func (l *Link) Resolve(c *Cluster) error {
+	l.ends = nil
+	for _, n := range c.Nodes {
+		for i, iface := range n.Interfaces {
+			if iface.Network == l.Name {
+				l.ends = append(l.ends, &linkEnd{owner: n.Name, index: i, profile: iface.Link})
+			}
+		}
+	}
+	for _, p := range c.Pods {
+		for i, iface := range p.Interfaces {
+			if iface.Network == l.Name {
+				l.ends = append(l.ends, &linkEnd{owner: p.Name, index: i, pod: true, addresses: iface.Addresses, profile: iface.Link})
+			}
+		}
+	}
+	if len(l.ends) != 2 {
+		return &fieldError{field: "name", value: l.Name, err: errors.New("link must connect two interfaces, but connects " + strconv.Itoa(len(l.ends)))}
+	}
+	l.pair = l.ends[0].pod && l.ends[1].pod
+	return nil
+}
+
+// deviceCarrier returns whether the carrier of dev is on.  It is off if
+// dev does not exist or is down.
+func deviceCarrier(dev string) bool {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", dev, "carrier"))
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+}
+
+// end returns the end of owner's index-th interface and the other end.
+func (l *Link) end(owner string, index int) (e, peer *linkEnd, err error) {
+	for _, end := range l.ends {
+		if end.owner == owner && end.index == index {
+			e = end
+		} else {
+			peer = end
+		}
+	}
+	if e == nil || peer == nil {
+		return nil, nil, errors.New("not connected to link " + l.Name + ": " + owner)
+	}
+	return e, peer, nil
+}
+
+// redirectCommands returns tc commands to redirect frames received by
+// the device of e to the device to.  The frames are policed by the
+// profile of e before the redirection.
+func (e *linkEnd) redirectCommands(to string) [][]string {
+	filter := []string{"tc", "filter", "replace", "dev", e.dev, "parent", "ffff:", "prio", "1", "handle", "1", "matchall"}
+	if police := e.profile.policeArgs(); police != nil {
+		filter = append(filter, "action")
+		filter = append(filter, police...)
+		filter = append(filter, "conform-exceed", "drop/pipe")
+	}
+	filter = append(filter, "action", "mirred", "egress", "redirect", "dev", to)
+	return [][]string{
+		{"tc", "qdisc", "replace", "dev", e.dev, "handle", "ffff:", "ingress"},
+		filter,
+	}
+}
+
+// attach shapes dev, the host side device of the index-th interface of
+// owner, and connects it to the device of the other end if it is running.
+// The other end is connected when its device is attached.
+func (l *Link) attach(ctx context.Context, r *Runtime, owner string, index int, dev string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, peer, err := l.end(owner, index)
+	if err != nil {
+		return err
+	}
+	e.dev = dev
+
+	var cmds [][]string
+	if e.profile != nil {
+		root, _, err := e.profile.commands(dev)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, root...)
+	}
+	if peer.dev != "" {
+		cmds = append(cmds, e.redirectCommands(peer.dev)...)
+		cmds = append(cmds, peer.redirectCommands(dev)...)
+	}
+	if e.down && e.pod {
+		cmds = append(cmds, []string{"ip", "link", "set", dev, "down"})
+	}
+	return execCommands(ctx, r.executor, cmds)
+}
+
+// detach forgets dev deleted with its node or pod.  Frames redirected to
+// it are dropped until a new device is attached.
+func (l *Link) detach(dev string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.ends {
+		if e.dev == dev {
+			e.dev = ""
+			e.vm = nil
+		}
+	}
+}
+
+// setVM lets the Link drop the carrier of the index-th NIC of owner
+// running in vm.
+func (l *Link) setVM(owner string, index int, vm *NodeVM) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, _, err := l.end(owner, index)
+	if err != nil {
+		return
+	}
+	e.vm = vm
+	if e.down {
+		vm.setLink(fmt.Sprintf("nic%d", index), false)
+	}
+}
+
+// place moves the end of the veth pair for the index-th interface of
+// owner into the network namespace ns as "ethN", where N is the index.
+// The pair is created if it does not exist.
+func (l *Link) place(ctx context.Context, r *Runtime, owner string, index int, ns string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, peer, err := l.end(owner, index)
+	if err != nil {
+		return err
+	}
+
+	var cmds [][]string
+	if !l.paired {
+		ng := r.nameGenerator()
+		e.dev, peer.dev = ng.New(), ng.New()
+		err := r.journal.recordUndo("veth", e.dev, []string{"ip", "link", "delete", e.dev})
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, []string{"ip", "link", "add", e.dev, "type", "veth", "peer", "name", peer.dev})
+		if peer.netns != "" {
+			// the end of the peer was lost with the old pair.
+			c, err := peer.placeCommands(e)
+			if err != nil {
+				return err
+			}
+			cmds = append(cmds, c...)
+		}
+		l.paired = true
+	}
+	e.netns = ns
+	c, err := e.placeCommands(peer)
+	if err != nil {
+		return err
+	}
+	cmds = append(cmds, c...)
+	return execCommands(ctx, r.executor, cmds)
+}
+
+// placeCommands returns commands to move the end of the veth pair into
+// e.netns and configure it.  Packets sent to the peer are shaped by the
+// profile of the peer on this end.
+func (e *linkEnd) placeCommands(peer *linkEnd) ([][]string, error) {
+	eth := fmt.Sprintf("eth%d", e.index)
+	cmds := [][]string{
+		{"ip", "link", "set", e.dev, "netns", e.netns, "name", eth, "up"},
+	}
+	for _, addr := range e.addresses {
+		cmds = append(cmds, []string{"ip", "netns", "exec", e.netns, "ip", "a", "add", addr, "dev", eth})
+	}
+	if peer.profile != nil {
+		root, ingress, err := peer.profile.commands(eth)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range append(root, ingress...) {
+			cmds = append(cmds, append([]string{"ip", "netns", "exec", e.netns}, c...))
+		}
+	}
+	return cmds, nil
+}
+
+// release moves the end of the veth pair for the index-th interface of
+// owner back to the host before the network namespace is deleted, and
+// sets it down so that the carrier of the other end is dropped.
+func (l *Link) release(r *Runtime, owner string, index int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, _, err := l.end(owner, index)
+	if err != nil || e.netns == "" {
+		return
+	}
+	ns := e.netns
+	e.netns = ""
+	eth := fmt.Sprintf("eth%d", index)
+	err = execCommands(context.Background(), r.executor, [][]string{
+		{"ip", "netns", "exec", ns, "ip", "link", "set", eth, "down", "netns", strconv.Itoa(os.Getpid()), "name", e.dev},
+	})
+	if err != nil {
+		// the pair is deleted along with the network namespace.
+		l.paired = false
+	}
+}
+
+// device returns a running device of the Link.  Both directions of the
+// Link pass through it.
+func (l *Link) device() (string, error) {
+	if l.pair {
+		return "", errors.New("cannot capture link between pods: " + l.Name)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.ends {
+		if e.dev != "" {
+			return e.dev, nil
+		}
+	}
+	return "", errors.New("link is not running: " + l.Name)
+}
+
+// isUp returns whether e is running and its carrier is on.
+func (l *Link) isUp(e *linkEnd) bool {
+	if e.dev == "" || !l.carrier(e.dev) {
+		return false
+	}
+	// QEMU keeps the tap device while the VM is powered off.
+	return e.vm == nil || e.vm.IsRunning()
+}
+
+// setCarrier turns on or off the carrier that e sees.
+func (e *linkEnd) setCarrier(ctx context.Context, r *Runtime, up bool) error {
+	if !e.pod {
+		if e.vm != nil {
+			e.vm.setLink(fmt.Sprintf("nic%d", e.index), up)
+		}
+		return nil
+	}
+	if e.dev == "" {
+		return nil
+	}
+	state := "down"
+	if up {
+		state = "up"
+	}
+	return execCommands(ctx, r.executor, [][]string{{"ip", "link", "set", e.dev, state}})
+}
+
+// propagate drops the carrier of an end if the other end is down, and
+// turns it on again when the other end gets up.  The state of an end
+// whose carrier is dropped is not checked.
+func (l *Link) propagate(ctx context.Context, r *Runtime) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, e := range l.ends {
+		if e.down {
+			continue
+		}
+		peer := l.ends[1-i]
+		up := l.isUp(e)
+		if up != peer.down {
+			continue
+		}
+		peer.down = !up
+		log.Info("link carrier changed", map[string]interface{}{
+			"link":  l.Name,
+			"owner": peer.owner,
+			"up":    up,
+		})
+		err := peer.setCarrier(ctx, r, up)
+		if err != nil {
+			log.Error("failed to change link carrier", map[string]interface{}{
+				log.FnError: err,
+				"link":      l.Name,
+				"owner":     peer.owner,
+			})
+		}
+	}
+}
+
+// watch propagates carrier loss between the ends until ctx is done.
+// Carrier of a veth pair is propagated by the kernel.
+func (l *Link) watch(ctx context.Context, r *Runtime) {
+	if l.pair {
+		return
+	}
+	ticker := time.NewTicker(linkWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.propagate(ctx, r)
+		}
+	}
+}
+
+// Destroy deletes the devices left by nodes and pods.
+func (l *Link) Destroy(r *Runtime) error {
+	taps, veths := l.network.devices()
+	devices := append(taps, veths...)
+	l.mu.Lock()
+	if l.paired {
+		devices = append(devices, l.ends[0].dev)
+		l.paired = false
+	}
+	l.mu.Unlock()
+
+	var cmds [][]string
+	for _, name := range devices {
+		cmds = append(cmds, []string{"ip", "link", "delete", name})
+	}
+	return execCommandsForce(r.executor, cmds)
+}
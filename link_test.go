@@ -0,0 +1,311 @@
+package placemat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLinkResolve(t *testing.T) {
+	t.Parallel()
+	yaml := `kind: Network
+name: net0
+type: internal
+---
+kind: Link
+name: net0
+---
+kind: Link
+name: cable1
+---
+kind: Link
+name: cable2
+---
+kind: Node
+name: node1
+interfaces:
+  - cable1
+  - cable2
+---
+kind: Node
+name: node2
+interfaces:
+  - cable2
+  - cable2
+`
+
+	cluster, err := readYaml(bytes.NewReader([]byte(yaml)), "test.yml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	expected := []string{
+		"test.yml:6: name: duplicate network or link: net0",
+		"test.yml:6: name: link must connect two interfaces, but connects 0",
+		"test.yml:9: name: link must connect two interfaces, but connects 1",
+		"test.yml:12: name: link must connect two interfaces, but connects 3",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+}
+
+func testLinkAttach(t *testing.T) {
+	t.Parallel()
+
+	c := new(Cluster).
+		AddLink(&LinkSpec{Name: "cable"}).
+		AddNode(&NodeSpec{Name: "node1", Interfaces: []NodeInterfaceSpec{{Network: "cable", Link: &LinkProfile{Bandwidth: "1mbit"}}}}).
+		AddPod(&PodSpec{
+			Name:       "pod1",
+			Interfaces: []PodInterfaceSpec{{Network: "cable"}},
+			Apps:       []*PodAppSpec{{Name: "bird", Image: "docker://quay.io/cybozu/bird:2.0"}},
+		})
+	err := c.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := c.Links[0]
+
+	r, buf := newDryRunRuntime(t)
+
+	ctx := context.Background()
+	err = l.attach(ctx, r, "node1", 0, "pm0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.attach(ctx, r, "pod1", 0, "pm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"tc qdisc add dev pm0 root handle 1: tbf rate 1000000bit burst 65536b latency 50ms",
+		"tc qdisc replace dev pm1 handle ffff: ingress",
+		"tc filter replace dev pm1 parent ffff: prio 1 handle 1 matchall action mirred egress redirect dev pm0",
+		"tc qdisc replace dev pm0 handle ffff: ingress",
+		"tc filter replace dev pm0 parent ffff: prio 1 handle 1 matchall action police rate 1000000bit burst 65536b conform-exceed drop/pipe action mirred egress redirect dev pm1",
+	}
+	if out := strings.TrimSpace(buf.String()); out != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commands:\n%s", out)
+	}
+
+	dev, err := c.captureDevice("cable")
+	if err != nil || dev != "pm0" {
+		t.Error("unexpected device to capture:", dev, err)
+	}
+	_, err = r.injectFault(c, &FaultSpec{Kind: FaultPartition, Network: "cable", Groups: [][]string{{"node1"}, {"pod1"}}})
+	if err == nil || err.Error() != "cannot partition link: cable" {
+		t.Error("link is partitioned:", err)
+	}
+
+	// a restarted pod gets a new device.
+	l.detach("pm1")
+	buf.Reset()
+	err = l.attach(ctx, r, "pod1", 0, "pm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "tc filter replace dev pm0 parent ffff: prio 1 handle 1 matchall action police rate 1000000bit burst 65536b conform-exceed drop/pipe action mirred egress redirect dev pm2\n") {
+		t.Errorf("peer is not redirected to the new device:\n%s", buf.String())
+	}
+
+	err = l.attach(ctx, r, "node2", 0, "pm3")
+	if err == nil {
+		t.Error("unknown interface is attached")
+	}
+}
+
+func testLinkPair(t *testing.T) {
+	t.Parallel()
+
+	app := []*PodAppSpec{{Name: "bird", Image: "docker://quay.io/cybozu/bird:2.0"}}
+	c := new(Cluster).
+		AddLink(&LinkSpec{Name: "cable"}).
+		AddPod(&PodSpec{Name: "pod1", Interfaces: []PodInterfaceSpec{{Network: "cable", Addresses: []string{"10.0.0.1/31"}}}, Apps: app}).
+		AddPod(&PodSpec{Name: "pod2", Interfaces: []PodInterfaceSpec{{Network: "cable", Link: &LinkProfile{Latency: "10ms"}}}, Apps: app})
+	err := c.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Links[0].pair {
+		t.Fatal("pods are not connected by a veth pair")
+	}
+
+	r, buf := newDryRunRuntime(t)
+
+	ctx := context.Background()
+	pod1, pod2 := c.Pods[0], c.Pods[1]
+	for _, p := range c.Pods {
+		err = p.setupNetwork(ctx, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{
+		"ip link add pm0 type veth peer name pm1\n",
+		"ip link set pm0 netns pm_pod1 name eth0 up\n",
+		"ip netns exec pm_pod1 ip a add 10.0.0.1/31 dev eth0\n",
+		"ip netns exec pm_pod1 tc qdisc add dev eth0 root handle 1: netem delay 10000us\n",
+		"ip link set pm1 netns pm_pod2 name eth0 up\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(buf.String(), e) {
+			t.Errorf("%q is not printed:\n%s", e, buf.String())
+		}
+	}
+	if len(pod1.veths) != 1 || pod1.veths[0] != "" {
+		t.Error("pod has host side device:", pod1.veths)
+	}
+
+	_, err = c.captureDevice("cable")
+	if err == nil || err.Error() != "cannot capture link between pods: cable" {
+		t.Error("link between pods is captured:", err)
+	}
+	_, err = r.injectFault(c, &FaultSpec{Kind: FaultLinkDown, Target: "pod1", Network: "cable"})
+	if err == nil || err.Error() != "cannot inject fault into link between pods: cable" {
+		t.Error("fault is injected into link between pods:", err)
+	}
+
+	// a restarted pod gets the end back from the host.
+	buf.Reset()
+	pod2.releaseLinks(r)
+	err = pod2.setupNetwork(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "ip netns exec pm_pod2 ip link set eth0 down netns ") || !strings.Contains(out, " name pm1\n") {
+		t.Errorf("end is not taken out of pod:\n%s", out)
+	}
+	if strings.Contains(out, "type veth") || !strings.Contains(out, "ip link set pm1 netns pm_pod2 name eth0 up\n") {
+		t.Errorf("end is not placed again:\n%s", out)
+	}
+}
+
+// testMonitor returns a NodeVM whose monitor commands are sent to the
+// returned channel.
+func testMonitor() (*NodeVM, <-chan string) {
+	monitor, qemu := net.Pipe()
+	ch := make(chan string, 10)
+	go func() {
+		s := bufio.NewScanner(qemu)
+		for s.Scan() {
+			ch <- s.Text()
+		}
+	}()
+	return &NodeVM{monitor: monitor, running: true}, ch
+}
+
+func testLinkCarrier(t *testing.T) {
+	t.Parallel()
+
+	c := new(Cluster).
+		AddLink(&LinkSpec{Name: "cable"}).
+		AddNode(&NodeSpec{Name: "node1", Interfaces: []NodeInterfaceSpec{{Network: "cable"}}}).
+		AddPod(&PodSpec{
+			Name:       "pod1",
+			Interfaces: []PodInterfaceSpec{{Network: "cable"}},
+			Apps:       []*PodAppSpec{{Name: "bird", Image: "docker://quay.io/cybozu/bird:2.0"}},
+		})
+	err := c.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := c.Links[0]
+	carrier := map[string]bool{"pm0": true, "pm1": true}
+	l.carrier = func(dev string) bool {
+		return carrier[dev]
+	}
+
+	r, buf := newDryRunRuntime(t)
+	ctx := context.Background()
+	err = l.attach(ctx, r, "node1", 0, "pm0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.attach(ctx, r, "pod1", 0, "pm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, monitor := testMonitor()
+	c.Nodes[0].setLinkVM(vm)
+
+	expectMonitor := func(expected string) {
+		t.Helper()
+		select {
+		case cmd := <-monitor:
+			if cmd != expected {
+				t.Errorf("expected %q, actual %q", expected, cmd)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q is not sent to monitor", expected)
+		}
+	}
+	expectCommand := func(expected string) {
+		t.Helper()
+		if out := buf.String(); out != expected+"\n" {
+			t.Errorf("expected %q, actual %q", expected, out)
+		}
+		buf.Reset()
+	}
+
+	buf.Reset()
+	l.propagate(ctx, r)
+	if buf.Len() != 0 || len(monitor) != 0 {
+		t.Error("carrier is changed while both ends are up")
+	}
+
+	// pod stops
+	carrier["pm1"] = false
+	l.propagate(ctx, r)
+	expectMonitor("set_link nic0 off")
+	carrier["pm1"] = true
+	l.propagate(ctx, r)
+	expectMonitor("set_link nic0 on")
+
+	// QEMU exits
+	carrier["pm0"] = false
+	l.propagate(ctx, r)
+	expectCommand("ip link set pm1 down")
+	l.propagate(ctx, r)
+	buf.Reset()
+	carrier["pm0"] = true
+	l.propagate(ctx, r)
+	expectCommand("ip link set pm1 up")
+
+	// VM is powered off
+	vm.PowerOff()
+	<-monitor
+	l.propagate(ctx, r)
+	expectCommand("ip link set pm1 down")
+
+	// a restarted pod gets the carrier dropped
+	l.detach("pm1")
+	err = l.attach(ctx, r, "pod1", 0, "pm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "ip link set pm2 down\n") {
+		t.Errorf("carrier of new device is not dropped:\n%s", buf.String())
+	}
+}
+
+func TestLink(t *testing.T) {
+	t.Run("Resolve", testLinkResolve)
+	t.Run("Attach", testLinkAttach)
+	t.Run("Pair", testLinkPair)
+	t.Run("Carrier", testLinkCarrier)
+}
@@ -0,0 +1,199 @@
+package placemat
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LinkProfile represents a static shaping profile of an interface.
+//
+// Latency and Loss apply to packets sent to the node or the pod.
+// Bandwidth limits packets in both directions.  Bandwidth is a rate like
+// "1gbit" or "100mbit", Burst is a size like "64kb", Latency is a
+// duration like "10ms", and Loss is a percentage.
+type LinkProfile struct {
+	Bandwidth string  `yaml:"bandwidth,omitempty" json:"bandwidth,omitempty"`
+	Burst     string  `yaml:"burst,omitempty" json:"burst,omitempty"`
+	Latency   string  `yaml:"latency,omitempty" json:"latency,omitempty"`
+	Loss      float64 `yaml:"loss,omitempty" json:"loss,omitempty"`
+}
+
+// rateUnits are units of Bandwidth in bits per second, the same as tc(8).
+var rateUnits = map[string]uint64{
+	"bit":  1,
+	"kbit": 1000,
+	"mbit": 1000 * 1000,
+	"gbit": 1000 * 1000 * 1000,
+	"tbit": 1000 * 1000 * 1000 * 1000,
+}
+
+// sizeUnits are units of Burst in bytes, the same as tc(8).
+var sizeUnits = map[string]uint64{
+	"":   1,
+	"b":  1,
+	"kb": 1 << 10,
+	"mb": 1 << 20,
+	"gb": 1 << 30,
+}
+
+const (
+	// tbfLatency is the maximum time a packet waits in the tbf queue.
+	tbfLatency = "50ms"
+
+	// minBurst is large enough for jumbo frames and GSO packets.
+	minBurst = 64 << 10
+
+	// burstHZ is the timer frequency to compute the default burst size.
+	burstHZ = 250
+)
+
+// parseUnit parses a number followed by one of units.
+func parseUnit(s string, units map[string]uint64) (uint64, bool) {
+	s = strings.ToLower(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+	unit, ok := units[s[i:]]
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return uint64(v * float64(unit)), true
+}
+
+// commands returns tc commands to shape dev.  root shapes packets sent
+// to dev by netem for latency and loss with tbf as its child for
+// bandwidth, or just by tbf.  ingress polices packets from dev.
+func (s *LinkProfile) commands(dev string) (root, ingress [][]string, err error) {
+	var netem []string
+	if s.Latency != "" {
+		latency, err := time.ParseDuration(s.Latency)
+		if err != nil || latency < 0 {
+			return nil, nil, errors.New("invalid latency: " + s.Latency)
+		}
+		netem = append(netem, "delay", tcTime(latency))
+	}
+	if s.Loss < 0 || s.Loss > 100 {
+		return nil, nil, errors.New("loss must be between 0 and 100")
+	}
+	if s.Loss > 0 {
+		netem = append(netem, "loss", tcPercent(s.Loss))
+	}
+
+	rate, burst, err := s.rate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if netem == nil && rate == 0 {
+		return nil, nil, errors.New("empty link profile")
+	}
+
+	tbfParent := []string{"root", "handle", "1:"}
+	if netem != nil {
+		root = append(root, append([]string{"tc", "qdisc", "add", "dev", dev, "root", "handle", "1:", "netem"}, netem...))
+		tbfParent = []string{"parent", "1:1", "handle", "10:"}
+	}
+	if rate != 0 {
+		r, b := tcRate(rate), tcSize(burst)
+		tbf := append([]string{"tc", "qdisc", "add", "dev", dev}, tbfParent...)
+		root = append(root, append(tbf, "tbf", "rate", r, "burst", b, "latency", tbfLatency))
+		ingress = [][]string{
+			{"tc", "qdisc", "add", "dev", dev, "handle", "ffff:", "ingress"},
+			{"tc", "filter", "add", "dev", dev, "parent", "ffff:", "protocol", "all",
+				"u32", "match", "u32", "0", "0", "police", "rate", r, "burst", b, "drop", "flowid", ":1"},
+		}
+	}
+	return root, ingress, nil
+}
+
+// rate returns the bandwidth in bits per second and the burst size in
+// bytes.  rate is 0 if Bandwidth is not specified.
+func (s *LinkProfile) rate() (rate, burst uint64, err error) {
+	if s.Bandwidth != "" {
+		var ok bool
+		rate, ok = parseUnit(s.Bandwidth, rateUnits)
+		if !ok {
+			return 0, 0, errors.New("invalid bandwidth: " + s.Bandwidth)
+		}
+		burst = rate / 8 / burstHZ
+		if burst < minBurst {
+			burst = minBurst
+		}
+	}
+	if s.Burst != "" {
+		if s.Bandwidth == "" {
+			return 0, 0, errors.New("burst requires bandwidth")
+		}
+		var ok bool
+		burst, ok = parseUnit(s.Burst, sizeUnits)
+		if !ok {
+			return 0, 0, errors.New("invalid burst: " + s.Burst)
+		}
+	}
+	return rate, burst, nil
+}
+
+// policeArgs returns the arguments of the police action to limit
+// packets from the interface, or nil if s is nil or has no bandwidth.
+func (s *LinkProfile) policeArgs() []string {
+	if s == nil {
+		return nil
+	}
+	rate, burst, err := s.rate()
+	if err != nil || rate == 0 {
+		return nil
+	}
+	return []string{"police", "rate", tcRate(rate), "burst", tcSize(burst)}
+}
+
+func tcRate(bps uint64) string {
+	return strconv.FormatUint(bps, 10) + "bit"
+}
+
+func tcSize(bytes uint64) string {
+	return strconv.FormatUint(bytes, 10) + "b"
+}
+
+func (s *LinkProfile) validate() error {
+	_, _, err := s.commands("")
+	return err
+}
+
+// shapeLink applies link to the host side device dev of an interface.
+func (r *Runtime) shapeLink(ctx context.Context, dev string, link *LinkProfile) error {
+	root, ingress, err := link.commands(dev)
+	if err != nil {
+		return err
+	}
+	return execCommands(ctx, r.executor, append(root, ingress...))
+}
+
+// deviceLink returns the link profile of the interface whose host side
+// device is dev, or nil.
+func (c *Cluster) deviceLink(dev string) *LinkProfile {
+	for _, n := range c.Nodes {
+		for i, tap := range n.taps {
+			if tap == dev && i < len(n.Interfaces) {
+				return n.Interfaces[i].Link
+			}
+		}
+	}
+	for _, p := range c.Pods {
+		for i, veth := range p.veths {
+			if veth == dev && i < len(p.Interfaces) {
+				return p.Interfaces[i].Link
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package placemat
+
+import (
+	"strings"
+	"testing"
+)
+
+func testLinkProfileCommands(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		spec     LinkProfile
+		expected []string
+	}{
+		{
+			LinkProfile{Latency: "10ms", Loss: 0.1},
+			[]string{"tc qdisc add dev pm0 root handle 1: netem delay 10000us loss 0.1%"},
+		},
+		{
+			LinkProfile{Bandwidth: "1Gbit"},
+			[]string{
+				"tc qdisc add dev pm0 root handle 1: tbf rate 1000000000bit burst 500000b latency 50ms",
+				"tc qdisc add dev pm0 handle ffff: ingress",
+				"tc filter add dev pm0 parent ffff: protocol all u32 match u32 0 0 police rate 1000000000bit burst 500000b drop flowid :1",
+			},
+		},
+		{
+			LinkProfile{Bandwidth: "2.5mbit", Burst: "32kb", Latency: "50ms"},
+			[]string{
+				"tc qdisc add dev pm0 root handle 1: netem delay 50000us",
+				"tc qdisc add dev pm0 parent 1:1 handle 10: tbf rate 2500000bit burst 32768b latency 50ms",
+				"tc qdisc add dev pm0 handle ffff: ingress",
+				"tc filter add dev pm0 parent ffff: protocol all u32 match u32 0 0 police rate 2500000bit burst 32768b drop flowid :1",
+			},
+		},
+	}
+	for _, c := range cases {
+		root, ingress, err := c.spec.commands("pm0")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		var actual []string
+		for _, cmd := range append(root, ingress...) {
+			actual = append(actual, strings.Join(cmd, " "))
+		}
+		if strings.Join(actual, "\n") != strings.Join(c.expected, "\n") {
+			t.Errorf("%+v: unexpected commands:\n%s", c.spec, strings.Join(actual, "\n"))
+		}
+	}
+
+	errCases := []struct {
+		spec     LinkProfile
+		expected string
+	}{
+		{LinkProfile{}, "empty link profile"},
+		{LinkProfile{Bandwidth: "1gbps"}, "invalid bandwidth: 1gbps"},
+		{LinkProfile{Bandwidth: "-1mbit"}, "invalid bandwidth: -1mbit"},
+		{LinkProfile{Latency: "10ms", Burst: "1mb"}, "burst requires bandwidth"},
+		{LinkProfile{Bandwidth: "1mbit", Burst: "1kib"}, "invalid burst: 1kib"},
+		{LinkProfile{Latency: "10"}, "invalid latency: 10"},
+		{LinkProfile{Loss: 200}, "loss must be between 0 and 100"},
+	}
+	for _, c := range errCases {
+		err := c.spec.validate()
+		if err == nil || err.Error() != c.expected {
+			t.Errorf("%+v: expected %q, actual %v", c.spec, c.expected, err)
+		}
+	}
+}
+
+func testLinkProfileFault(t *testing.T) {
+	t.Parallel()
+
+	c, r, buf := testFaultCluster(t)
+	c.Nodes[0].Interfaces[0].Link = &LinkProfile{Latency: "5ms"}
+
+	f, err := r.injectFault(c, &FaultSpec{Kind: FaultNetem, Target: "node1", Network: "net0", Loss: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.removeFault(f.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"tc qdisc replace dev pm0 root netem loss 1%",
+		"tc qdisc del dev pm0 root",
+		"tc qdisc add dev pm0 root handle 1: netem delay 5000us",
+	}
+	if out := strings.TrimSpace(buf.String()); out != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commands:\n%s", out)
+	}
+}
+
+func TestLinkProfile(t *testing.T) {
+	t.Run("Commands", testLinkProfileCommands)
+	t.Run("Fault", testLinkProfileFault)
+}
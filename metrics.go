@@ -0,0 +1,212 @@
+package placemat
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/procfs"
+)
+
+const metricsNamespace = "placemat"
+
+var (
+	ipmiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ipmi_requests_total",
+		Help:      "The number of IPMI requests handled by the virtual BMC.",
+	}, []string{"command", "result"})
+
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_hits_total",
+		Help:      "The number of downloads skipped because the data are cached.",
+	})
+
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_misses_total",
+		Help:      "The number of downloads because the data are not cached.",
+	})
+
+	downloadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_bytes_total",
+		Help:      "The number of bytes downloaded for images and data folders.",
+	})
+
+	startupPhaseDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "startup_phase_duration_seconds",
+		Help:      "Time taken by each phase to start the cluster.",
+	}, []string{"phase"})
+)
+
+// Startup phases of a cluster.
+const (
+	phaseNetworks    = "networks"
+	phaseDataFolders = "data-folders"
+	phaseImages      = "images"
+	phasePods        = "pods"
+	phaseNodes       = "nodes"
+	phaseTotal       = "total"
+)
+
+func observePhase(phase string, started time.Time) {
+	startupPhaseDuration.WithLabelValues(phase).Set(time.Since(started).Seconds())
+}
+
+// countingReader counts bytes read through it in downloadBytes.
+type countingReader struct {
+	io.Reader
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	downloadBytes.Add(float64(n))
+	return n, err
+}
+
+var (
+	qemuCPUDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "node", "cpu_seconds_total"),
+		"Total user and system CPU time spent by QEMU of the node.",
+		[]string{"node"}, nil)
+	qemuRSSDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "node", "resident_memory_bytes"),
+		"Resident memory size of QEMU of the node.",
+		[]string{"node"}, nil)
+
+	netdevLabels = []string{"network", "device", "type"}
+	netdevDescs  = map[string]*prometheus.Desc{
+		"rx_bytes": prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "netdev", "receive_bytes_total"),
+			"Bytes received by the network device.", netdevLabels, nil),
+		"tx_bytes": prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "netdev", "transmit_bytes_total"),
+			"Bytes transmitted by the network device.", netdevLabels, nil),
+		"rx_packets": prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "netdev", "receive_packets_total"),
+			"Packets received by the network device.", netdevLabels, nil),
+		"tx_packets": prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "netdev", "transmit_packets_total"),
+			"Packets transmitted by the network device.", netdevLabels, nil),
+	}
+)
+
+// sysClassNet is a variable for testing.
+var sysClassNet = "/sys/class/net"
+
+// clusterCollector collects metrics of QEMU processes and network devices
+// of a running cluster when scraped.
+type clusterCollector struct {
+	cluster *Cluster
+}
+
+func (c clusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- qemuCPUDesc
+	ch <- qemuRSSDesc
+	for _, d := range netdevDescs {
+		ch <- d
+	}
+}
+
+func (c clusterCollector) Collect(ch chan<- prometheus.Metric) {
+	c.cluster.mu.RLock()
+	defer c.cluster.mu.RUnlock()
+
+	if s := c.cluster.supervisor; s != nil {
+		for _, n := range c.cluster.Nodes {
+			vm := s.bmc.nodeVM(n.SMBIOS.Serial)
+			if vm == nil {
+				continue
+			}
+			pid := vm.pid()
+			if pid == 0 {
+				continue
+			}
+			collectProcess(ch, n.Name, pid)
+		}
+	}
+
+	for _, n := range c.cluster.Networks {
+		collectNetdev(ch, n.Name, n.bridge, "bridge")
+		taps, veths := n.devices()
+		for _, tap := range taps {
+			collectNetdev(ch, n.Name, tap, "tap")
+		}
+		for _, veth := range veths {
+			collectNetdev(ch, n.Name, veth, "veth")
+		}
+	}
+}
+
+func collectProcess(ch chan<- prometheus.Metric, node string, pid int) {
+	p, err := procfs.NewProc(pid)
+	if err != nil {
+		return
+	}
+	stat, err := p.Stat()
+	if err != nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(qemuCPUDesc, prometheus.CounterValue, stat.CPUTime(), node)
+	ch <- prometheus.MustNewConstMetric(qemuRSSDesc, prometheus.GaugeValue, float64(stat.ResidentMemory()), node)
+}
+
+func collectNetdev(ch chan<- prometheus.Metric, network, device, typ string) {
+	for name, desc := range netdevDescs {
+		data, err := ioutil.ReadFile(filepath.Join(sysClassNet, device, "statistics", name))
+		if err != nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, v, network, device, typ)
+	}
+}
+
+// serveMetrics serves Prometheus metrics of c over HTTP on l
+// until ctx is cancelled.
+func serveMetrics(ctx context.Context, l net.Listener, c *Cluster) error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		ipmiRequests,
+		cacheHits,
+		cacheMisses,
+		downloadBytes,
+		startupPhaseDuration,
+		clusterCollector{cluster: c},
+		collectors.NewGoCollector(),
+	)
+
+	log.Info("serving metrics", map[string]interface{}{
+		"address": l.Addr().String(),
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	err := server.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package placemat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func testCollectNetdev(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	stats := filepath.Join(d, "pm0", "statistics")
+	err = os.MkdirAll(stats, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]string{"rx_bytes": "1234\n", "tx_packets": "5\n"} {
+		err = ioutil.WriteFile(filepath.Join(stats, name), []byte(v), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := sysClassNet
+	sysClassNet = d
+	defer func() {
+		sysClassNet = saved
+	}()
+
+	ch := make(chan prometheus.Metric, 10)
+	collectNetdev(ch, "net0", "pm0", "tap")
+	collectNetdev(ch, "net0", "pm1", "tap")
+	close(ch)
+
+	values := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		err = m.Write(&pb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range pb.Label {
+			if l.GetName() == "device" && l.GetValue() != "pm0" {
+				t.Error("unexpected device:", l.GetValue())
+			}
+		}
+		values[m.Desc().String()] = pb.GetCounter().GetValue()
+	}
+	if len(values) != 2 {
+		t.Fatal("unexpected metrics:", values)
+	}
+	for desc, v := range values {
+		switch {
+		case strings.Contains(desc, "receive_bytes_total"):
+			if v != 1234 {
+				t.Error("unexpected rx_bytes:", v)
+			}
+		case strings.Contains(desc, "transmit_packets_total"):
+			if v != 5 {
+				t.Error("unexpected tx_packets:", v)
+			}
+		default:
+			t.Error("unexpected metric:", desc)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Run("CollectNetdev", testCollectNetdev)
+}
@@ -2,35 +2,44 @@ package placemat
 
 import "context"
 
-func createNatRules() error {
+func natChainDestroyCommands(iptables, chain string) [][]string {
+	return [][]string{
+		{iptables, "-t", "filter", "-D", "FORWARD", "-j", chain},
+		{iptables, "-t", "nat", "-D", "POSTROUTING", "-j", chain},
+
+		{iptables, "-F", chain, "-t", "filter"},
+		{iptables, "-X", chain, "-t", "filter"},
+
+		{iptables, "-F", chain, "-t", "nat"},
+		{iptables, "-X", chain, "-t", "nat"},
+	}
+}
+
+func createNatRules(r *Runtime) error {
+	chain := r.natChain()
 	cmds := [][]string{}
 	for _, iptables := range []string{"iptables", "ip6tables"} {
+		err := r.journal.recordUndo("chain", iptables+" "+chain, natChainDestroyCommands(iptables, chain)...)
+		if err != nil {
+			return err
+		}
 		cmds = append(cmds,
-			[]string{iptables, "-N", "PLACEMAT", "-t", "filter"},
-			[]string{iptables, "-N", "PLACEMAT", "-t", "nat"},
+			[]string{iptables, "-N", chain, "-t", "filter"},
+			[]string{iptables, "-N", chain, "-t", "nat"},
 
-			[]string{iptables, "-t", "nat", "-A", "POSTROUTING", "-j", "PLACEMAT"},
-			[]string{iptables, "-t", "filter", "-A", "FORWARD", "-j", "PLACEMAT"},
+			[]string{iptables, "-t", "nat", "-A", "POSTROUTING", "-j", chain},
+			[]string{iptables, "-t", "filter", "-A", "FORWARD", "-j", chain},
 		)
 	}
 
-	return execCommands(context.Background(), cmds)
+	return execCommands(context.Background(), r.executor, cmds)
 }
 
 // destroyNetwork destroys a bridge and iptables rules by the name
-func destroyNatRules() error {
+func destroyNatRules(r *Runtime) error {
 	cmds := [][]string{}
 	for _, iptables := range []string{"iptables", "ip6tables"} {
-		cmds = append(cmds,
-			[]string{iptables, "-t", "filter", "-D", "FORWARD", "-j", "PLACEMAT"},
-			[]string{iptables, "-t", "nat", "-D", "POSTROUTING", "-j", "PLACEMAT"},
-
-			[]string{iptables, "-F", "PLACEMAT", "-t", "filter"},
-			[]string{iptables, "-X", "PLACEMAT", "-t", "filter"},
-
-			[]string{iptables, "-F", "PLACEMAT", "-t", "nat"},
-			[]string{iptables, "-X", "PLACEMAT", "-t", "nat"},
-		)
+		cmds = append(cmds, natChainDestroyCommands(iptables, r.natChain())...)
 	}
-	return execCommandsForce(cmds)
+	return execCommandsForce(r.executor, cmds)
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"net"
+	"strconv"
+	"sync"
 )
 
 const (
@@ -29,20 +31,29 @@ type NetworkSpec struct {
 	Type    string `yaml:"type"`
 	UseNAT  bool   `yaml:"use-nat"`
 	Address string `yaml:"address,omitempty"`
+	Capture bool   `yaml:"capture,omitempty"`
 }
 
 // Network represents a network configuration
 type Network struct {
 	*NetworkSpec
 
-	typ         NetworkType
-	ip          net.IP
-	ipNet       *net.IPNet
-	tapNames    []string
-	vethNames   []string
-	ng          *nameGenerator
+	typ    NetworkType
+	ip     net.IP
+	ipNet  *net.IPNet
+	bridge string
+
+	mu        sync.Mutex
+	tapNames  []string
+	vethNames []string
+
 	v4forwarded bool
 	v6forwarded bool
+
+	stopCapture func()
+
+	// link is the Link if n holds the devices of a Link.
+	link *Link
 }
 
 // NewNetwork creates *Network from spec.
@@ -109,118 +120,248 @@ func isForwarding(name string) bool {
 	return len(val) > 0 && val[0] != '0'
 }
 
-func setForwarding(name string, flag bool) error {
-	val := "1\n"
+// enableForwarding turns on IP forwarding.  If restore is true, the
+// journal records to turn it off.
+func enableForwarding(r *Runtime, name string, restore bool) error {
+	if restore {
+		err := r.journal.recordUndo("sysctl", name, []string{"sysctl", "-w", name + "=0"})
+		if err != nil {
+			return err
+		}
+	}
+	return setForwarding(r, name, true)
+}
+
+func setForwarding(r *Runtime, name string, flag bool) error {
+	val := "1"
 	if !flag {
-		val = "0\n"
+		val = "0"
+	}
+	if r.dryRun {
+		return r.executor.Run(context.Background(), newCommand("sysctl", "-w", name+"="+val))
 	}
-	return sysctlSet(name, val)
+	return sysctlSet(name, val+"\n")
 }
 
 // Create creates a virtual L2 switch using Linux bridge.
-func (n *Network) Create(ng *nameGenerator) error {
-	n.ng = ng
+func (n *Network) Create(r *Runtime) error {
+	n.bridge = r.bridgeName(n.Name)
+	err := r.journal.recordUndo("bridge", n.bridge, []string{"ip", "link", "delete", n.bridge, "type", "bridge"})
+	if err != nil {
+		return err
+	}
 
 	cmds := [][]string{
-		{"ip", "link", "add", n.Name, "type", "bridge"},
-		{"ip", "link", "set", n.Name, "up"},
+		{"ip", "link", "add", n.bridge, "type", "bridge"},
+		{"ip", "link", "set", n.bridge, "up"},
 	}
 	if len(n.Address) > 0 {
 		cmds = append(cmds,
-			[]string{"ip", "addr", "add", n.Address, "dev", n.Name},
+			[]string{"ip", "addr", "add", n.Address, "dev", n.bridge},
 		)
 	}
 
-	err := execCommands(context.Background(), cmds)
+	err = execCommands(context.Background(), r.executor, cmds)
 	if err != nil {
 		return err
 	}
 
-	if !n.UseNAT {
-		return nil
+	if n.UseNAT {
+		err = n.enableNAT(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n.Capture {
+		err = n.startCapture(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.emit(EventNetworkCreated, n.Name, map[string]interface{}{
+		"type": n.Type,
+	})
+	if r.onNetworkCreated != nil {
+		r.onNetworkCreated(n)
 	}
+	return nil
+}
+
+func (n *Network) enableNAT(r *Runtime) error {
+	// IP forwarding is host-global.  A named cluster may share the host
+	// with other clusters, so it leaves forwarding on for their NAT.
+	restore := r.clusterName == ""
 
 	if !isForwarding(v4ForwardKey) {
-		err = setForwarding(v4ForwardKey, true)
+		err := enableForwarding(r, v4ForwardKey, restore)
 		if err != nil {
 			return err
 		}
-		n.v4forwarded = true
+		n.v4forwarded = restore
 	}
 
 	if !isForwarding(v6ForwardKey) {
-		err = setForwarding(v6ForwardKey, true)
+		err := enableForwarding(r, v6ForwardKey, restore)
 		if err != nil {
 			return err
 		}
-		n.v6forwarded = true
+		n.v6forwarded = restore
 	}
 
-	cmds = [][]string{
-		[]string{"iptables", "-t", "filter", "-A", "PLACEMAT", "-i", n.Name, "-j", "ACCEPT"},
-		[]string{"iptables", "-t", "filter", "-A", "PLACEMAT", "-o", n.Name, "-j", "ACCEPT"},
-		[]string{"ip6tables", "-t", "filter", "-A", "PLACEMAT", "-i", n.Name, "-j", "ACCEPT"},
-		[]string{"ip6tables", "-t", "filter", "-A", "PLACEMAT", "-o", n.Name, "-j", "ACCEPT"},
-		[]string{iptables(n.ip), "-t", "nat", "-A", "PLACEMAT", "-j", "MASQUERADE",
+	return execCommands(context.Background(), r.executor, n.natRules(r.natChain(), "-A"))
+}
+
+// natRules returns commands to append ("-A") or delete ("-D") the rules
+// for NAT in chain.
+func (n *Network) natRules(chain, op string) [][]string {
+	return [][]string{
+		{"iptables", "-t", "filter", op, chain, "-i", n.bridge, "-j", "ACCEPT"},
+		{"iptables", "-t", "filter", op, chain, "-o", n.bridge, "-j", "ACCEPT"},
+		{"ip6tables", "-t", "filter", op, chain, "-i", n.bridge, "-j", "ACCEPT"},
+		{"ip6tables", "-t", "filter", op, chain, "-o", n.bridge, "-j", "ACCEPT"},
+		{iptables(n.ip), "-t", "nat", op, chain, "-j", "MASQUERADE",
 			"--source", n.ipNet.String(), "!", "--destination", n.ipNet.String()},
 	}
-	return execCommands(context.Background(), cmds)
 }
 
 // CreateTap add a tap device to the bridge and return the tap device name.
-func (n *Network) CreateTap() (string, error) {
-	name := n.ng.New()
+// If mtu is not 0, it is set to the tap device.  If multiQueue is true,
+// the tap device is created with multiple queues.
+func (n *Network) CreateTap(r *Runtime, mtu int, multiQueue bool) (string, error) {
+	name := r.nameGenerator().New()
 
-	cmds := [][]string{
-		{"ip", "tuntap", "add", name, "mode", "tap"},
-		{"ip", "link", "set", name, "master", n.Name},
-		{"ip", "link", "set", name, "up"},
+	err := r.journal.recordUndo("tap", name, []string{"ip", "link", "delete", name})
+	if err != nil {
+		return "", err
+	}
+
+	add := []string{"ip", "tuntap", "add", name, "mode", "tap"}
+	if multiQueue {
+		add = append(add, "multi_queue")
+	}
+	cmds := [][]string{add}
+	if n.link == nil {
+		cmds = append(cmds, []string{"ip", "link", "set", name, "master", n.bridge})
+	}
+	if mtu != 0 {
+		cmds = append(cmds, []string{"ip", "link", "set", name, "mtu", strconv.Itoa(mtu)})
 	}
-	err := execCommands(context.Background(), cmds)
+	cmds = append(cmds, []string{"ip", "link", "set", name, "up"})
+	err = execCommands(context.Background(), r.executor, cmds)
 	if err != nil {
 		return "", err
 	}
 
+	n.mu.Lock()
 	n.tapNames = append(n.tapNames, name)
+	n.mu.Unlock()
 	return name, nil
 }
 
 // CreateVeth creates a veth pair and add one of the pair to the bridge.
 // It returns the name of the other side of the pair.
-func (n *Network) CreateVeth() (string, error) {
-	name := n.ng.New()
+func (n *Network) CreateVeth(r *Runtime) (string, error) {
+	name := r.nameGenerator().New()
 	nameInNS := name + "_"
 
+	err := r.journal.recordUndo("veth", name, []string{"ip", "link", "delete", name})
+	if err != nil {
+		return "", err
+	}
+
+	up := []string{"ip", "link", "set", name, "master", n.bridge, "up"}
+	if n.link != nil {
+		up = []string{"ip", "link", "set", name, "up"}
+	}
 	cmds := [][]string{
 		{"ip", "link", "add", name, "type", "veth", "peer", "name", nameInNS},
-		{"ip", "link", "set", name, "master", n.Name, "up"},
+		up,
 	}
-	err := execCommands(context.Background(), cmds)
+	err = execCommands(context.Background(), r.executor, cmds)
 	if err != nil {
 		return "", err
 	}
 
+	n.mu.Lock()
 	n.vethNames = append(n.vethNames, name)
+	n.mu.Unlock()
 	return nameInNS, nil
 }
 
+// DeleteTap deletes a tap device created by CreateTap.
+func (n *Network) DeleteTap(r *Runtime, name string) error {
+	n.mu.Lock()
+	for i, tap := range n.tapNames {
+		if tap == name {
+			n.tapNames = append(n.tapNames[:i], n.tapNames[i+1:]...)
+			break
+		}
+	}
+	n.mu.Unlock()
+	if n.link != nil {
+		n.link.detach(name)
+	}
+
+	return execCommandsForce(r.executor, [][]string{
+		{"ip", "link", "delete", name},
+	})
+}
+
+// forgetVeth removes a veth device from the list of devices to be deleted.
+// This is used when the device is deleted along with the network namespace.
+func (n *Network) forgetVeth(name string) {
+	if n.link != nil {
+		n.link.detach(name)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, veth := range n.vethNames {
+		if veth == name {
+			n.vethNames = append(n.vethNames[:i], n.vethNames[i+1:]...)
+			return
+		}
+	}
+}
+
+// devices returns copies of the names of tap and veth devices
+// attached to the bridge.
+func (n *Network) devices() (taps, veths []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	taps = append([]string{}, n.tapNames...)
+	veths = append([]string{}, n.vethNames...)
+	return taps, veths
+}
+
 // Destroy deletes all created tap and veth devices, then the bridge.
-func (n *Network) Destroy() error {
+func (n *Network) Destroy(r *Runtime) error {
+	if n.stopCapture != nil {
+		n.stopCapture()
+		n.stopCapture = nil
+	}
 	if n.v4forwarded {
-		setForwarding(v4ForwardKey, false)
+		setForwarding(r, v4ForwardKey, false)
 	}
 	if n.v6forwarded {
-		setForwarding(v6ForwardKey, false)
+		setForwarding(r, v6ForwardKey, false)
 	}
 
+	taps, veths := n.devices()
 	cmds := [][]string{}
-	for _, name := range n.tapNames {
-		cmds = append(cmds, []string{"ip", "tuntap", "delete", name, "mode", "tap"})
+	for _, name := range taps {
+		cmds = append(cmds, []string{"ip", "link", "delete", name})
 	}
-	for _, name := range n.vethNames {
+	for _, name := range veths {
 		cmds = append(cmds, []string{"ip", "link", "delete", name})
 	}
-	cmds = append(cmds, []string{"ip", "link", "delete", n.Name, "type", "bridge"})
+	cmds = append(cmds, []string{"ip", "link", "delete", n.bridge, "type", "bridge"})
+	if n.UseNAT {
+		cmds = append(cmds, n.natRules(r.natChain(), "-D")...)
+	}
 
-	return execCommandsForce(cmds)
+	err := execCommandsForce(r.executor, cmds)
+	r.emit(EventNetworkDestroyed, n.Name, nil)
+	return err
 }
@@ -10,14 +10,11 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"path/filepath"
-
 	"crypto/sha1"
-	"math/rand"
 
-	"github.com/cybozu-go/cmd"
 	"github.com/cybozu-go/log"
 )
 
@@ -34,17 +31,128 @@ type SMBIOSConfig struct {
 	Serial       string `yaml:"serial,omitempty"`
 }
 
+// NodeInterfaceSpec represents a Node's interface definition in YAML.
+//
+// It is written as a network name, or a mapping with network and other
+// properties.  If MAC is empty, the MAC address is derived from the node
+// name and the index of the interface.
+type NodeInterfaceSpec struct {
+	Network   string       `yaml:"network"`
+	MAC       string       `yaml:"mac,omitempty"`
+	Model     string       `yaml:"model,omitempty"`
+	MTU       int          `yaml:"mtu,omitempty"`
+	Queues    int          `yaml:"queues,omitempty"`
+	BootIndex *int         `yaml:"boot-index,omitempty"`
+	Link      *LinkProfile `yaml:"link,omitempty"`
+}
+
+// nicModels maps NIC models to QEMU device names.
+var nicModels = map[string]string{
+	"virtio":  "virtio-net-pci",
+	"e1000":   "e1000",
+	"e1000e":  "e1000e",
+	"rtl8139": "rtl8139",
+	"igb":     "igb",
+}
+
+const (
+	minMTU = 68
+	maxMTU = 65535
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (s *NodeInterfaceSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var network string
+	if unmarshal(&network) == nil {
+		*s = NodeInterfaceSpec{Network: network}
+		return nil
+	}
+	type plain NodeInterfaceSpec
+	return unmarshal((*plain)(s))
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (s NodeInterfaceSpec) MarshalYAML() (interface{}, error) {
+	if s == (NodeInterfaceSpec{Network: s.Network}) {
+		return s.Network, nil
+	}
+	type plain NodeInterfaceSpec
+	return plain(s), nil
+}
+
+// device returns the QEMU device name for the interface.
+func (s *NodeInterfaceSpec) device() string {
+	if s.Model == "" {
+		return nicModels["virtio"]
+	}
+	return nicModels[s.Model]
+}
+
+func (s *NodeInterfaceSpec) validate() error {
+	var errs ErrorList
+	if s.MAC != "" {
+		err := validateMAC(s.MAC)
+		if err != nil {
+			errs.add(&fieldError{field: "interfaces", value: s.MAC, err: err})
+		}
+	}
+	if _, ok := nicModels[s.Model]; s.Model != "" && !ok {
+		errs.add(&fieldError{field: "interfaces", value: "model: " + s.Model, err: errors.New("unknown NIC model: " + s.Model)})
+	}
+	if s.MTU != 0 && (s.MTU < minMTU || s.MTU > maxMTU) {
+		errs.add(&fieldError{field: "interfaces", value: fmt.Sprintf("mtu: %d", s.MTU), err: fmt.Errorf("MTU must be between %d and %d", minMTU, maxMTU)})
+	}
+	if s.Queues < 0 {
+		errs.add(&fieldError{field: "interfaces", value: fmt.Sprintf("queues: %d", s.Queues), err: errors.New("negative queues")})
+	}
+	if s.Queues > 1 && s.device() != nicModels["virtio"] {
+		errs.add(&fieldError{field: "interfaces", value: fmt.Sprintf("queues: %d", s.Queues), err: errors.New("multiqueue requires virtio model")})
+	}
+	if s.BootIndex != nil && *s.BootIndex < 0 {
+		errs.add(&fieldError{field: "interfaces", value: fmt.Sprintf("boot-index: %d", *s.BootIndex), err: errors.New("negative boot index")})
+	}
+	if s.Link != nil {
+		err := s.Link.validate()
+		if err != nil {
+			errs.add(&fieldError{field: "interfaces", value: "link:", err: err})
+		}
+	}
+	return errs.errorOrNil()
+}
+
+func validateMAC(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if len(hw) != 6 {
+		return errors.New("not an EUI-48 address: " + mac)
+	}
+	if hw[0]&1 != 0 {
+		return errors.New("multicast MAC address: " + mac)
+	}
+	return nil
+}
+
 // NodeSpec represents a Node specification in YAML
 type NodeSpec struct {
-	Kind         string           `yaml:"kind"`
-	Name         string           `yaml:"name"`
-	Interfaces   []string         `yaml:"interfaces,omitempty"`
-	Volumes      []NodeVolumeSpec `yaml:"volumes,omitempty"`
-	IgnitionFile string           `yaml:"ignition,omitempty"`
-	CPU          int              `yaml:"cpu,omitempty"`
-	Memory       string           `yaml:"memory,omitempty"`
-	UEFI         bool             `yaml:"uefi,omitempty"`
-	SMBIOS       SMBIOSConfig     `yaml:"smbios,omitempty"`
+	Kind          string              `yaml:"kind"`
+	Name          string              `yaml:"name"`
+	Interfaces    []NodeInterfaceSpec `yaml:"interfaces,omitempty"`
+	Volumes       []NodeVolumeSpec    `yaml:"volumes,omitempty"`
+	IgnitionFile  string              `yaml:"ignition,omitempty"`
+	CPU           int                 `yaml:"cpu,omitempty"`
+	Memory        string              `yaml:"memory,omitempty"`
+	UEFI          bool                `yaml:"uefi,omitempty"`
+	SMBIOS        SMBIOSConfig        `yaml:"smbios,omitempty"`
+	RestartPolicy RestartPolicy       `yaml:"restart-policy,omitempty"`
+}
+
+func (s *NodeSpec) resolvePaths(dir string) {
+	s.IgnitionFile = resolvePath(dir, s.IgnitionFile)
+	for i := range s.Volumes {
+		s.Volumes[i].resolvePaths(dir)
+	}
 }
 
 // Node represents a virtual machine.
@@ -52,6 +160,10 @@ type Node struct {
 	*NodeSpec
 	networks []*Network
 	volumes  []NodeVolume
+	taps     []string // tap device names for networks
+
+	mu       sync.Mutex
+	restarts int
 }
 
 func createNodeVolume(spec NodeVolumeSpec) (NodeVolume, error) {
@@ -90,22 +202,35 @@ func NewNode(spec *NodeSpec) (*Node, error) {
 		return nil, errors.New("node name is empty")
 	}
 
+	var errs ErrorList
+	errs.add(spec.RestartPolicy.validate())
+	for _, iface := range spec.Interfaces {
+		errs.add(iface.validate())
+	}
 	for _, v := range spec.Volumes {
 		vol, err := createNodeVolume(v)
 		if err != nil {
-			return nil, err
+			errs.add(&fieldError{field: "volumes", value: v.Name, err: err})
+			continue
 		}
 		n.volumes = append(n.volumes, vol)
 	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
 	return n, nil
 }
 
 // Resolve resolves references to other resources in the cluster.
+// It returns ErrorList if there are errors.
 func (n *Node) Resolve(c *Cluster) error {
+	var errs ErrorList
+	n.networks = nil
 	for _, iface := range n.Interfaces {
-		network, err := c.GetNetwork(iface)
+		network, err := c.GetNetwork(iface.Network)
 		if err != nil {
-			return err
+			errs.add(&fieldError{field: "interfaces", value: iface.Network, err: err})
+			continue
 		}
 		n.networks = append(n.networks, network)
 	}
@@ -113,17 +238,41 @@ func (n *Node) Resolve(c *Cluster) error {
 	for _, vol := range n.volumes {
 		err := vol.Resolve(c)
 		if err != nil {
-			return err
+			errs.add(&fieldError{field: "volumes", value: vol.Name(), err: err})
 		}
 	}
 
-	return nil
+	return errs.errorOrNil()
 }
 
 func nodeSerial(name string) string {
 	return fmt.Sprintf("%x", sha1.Sum([]byte(name)))
 }
 
+// macAddress returns the MAC address of the i-th interface.
+func (n *Node) macAddress(r *Runtime, i int) string {
+	if mac := n.Interfaces[i].MAC; mac != "" {
+		return mac
+	}
+	return r.nodeMAC(n.Name, i)
+}
+
+func (n *Node) macAddresses(r *Runtime) []string {
+	macs := make([]string, len(n.Interfaces))
+	for i := range n.Interfaces {
+		macs[i] = n.macAddress(r, i)
+	}
+	return macs
+}
+
+func (n *Node) networkNames() []string {
+	names := make([]string, len(n.Interfaces))
+	for i, iface := range n.Interfaces {
+		names[i] = iface.Network
+	}
+	return names
+}
+
 func (n *Node) qemuParams(r *Runtime) []string {
 	params := []string{"-enable-kvm"}
 
@@ -139,9 +288,10 @@ func (n *Node) qemuParams(r *Runtime) []string {
 		params = append(params, "-m", n.Memory)
 	}
 	if !r.graphic {
-		p := r.socketPath(n.Name)
+		// placemat relays the serial console to socketPath; see console.
+		p := r.serialSocketPath(n.Name)
 		params = append(params, "-nographic")
-		params = append(params, "-serial", "unix:"+p+",server,nowait")
+		params = append(params, "-serial", "unix:"+p)
 	}
 	if n.UEFI {
 		p := r.nvramPath(n.Name)
@@ -166,42 +316,86 @@ func (n *Node) qemuParams(r *Runtime) []string {
 
 // Start starts the Node as a QEMU process.
 // This will not wait the process termination; instead, it returns the process information.
+// The process keeps running after ctx is cancelled so that the guest can be shut down gracefully.
 func (n *Node) Start(ctx context.Context, r *Runtime, nodeCh chan<- bmcInfo) (*NodeVM, error) {
+	params, err := n.prepare(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return n.launch(ctx, r, params, nodeCh)
+}
+
+// prepare creates volumes, tap devices, and NVRAM for the Node, then
+// returns parameters for QEMU.  QEMU restarted with the same parameters
+// uses the same devices, volumes, and sockets.
+func (n *Node) prepare(ctx context.Context, r *Runtime) ([]string, error) {
 	params := n.qemuParams(r)
 
 	for _, vol := range n.volumes {
 		vname := vol.Name()
 		log.Info("Creating volume", map[string]interface{}{"node": n.Name, "volume": vname})
-		p := filepath.Join(r.dataDir, "volumes", n.Name)
-		err := os.MkdirAll(p, 0755)
-		if err != nil {
-			return nil, err
+		p := r.volumeDir(n.Name)
+		if r.dryRun {
+			r.note("mkdir -p %s", p)
+		} else {
+			err := os.MkdirAll(p, 0755)
+			if err != nil {
+				return nil, err
+			}
 		}
-		args, err := vol.Create(ctx, p)
+		args, err := vol.Create(ctx, r, p)
 		if err != nil {
 			return nil, err
 		}
+		r.emit(EventVolumeCreated, n.Name, map[string]interface{}{
+			"volume": vname,
+		})
 
 		params = append(params, args...)
 	}
 
-	for _, br := range n.networks {
-		tap, err := br.CreateTap()
+	n.taps = nil
+	for i, br := range n.networks {
+		iface := n.Interfaces[i]
+		tap, err := br.CreateTap(r, iface.MTU, iface.Queues > 1)
+		if err != nil {
+			return nil, err
+		}
+		n.taps = append(n.taps, tap)
+		if br.link != nil {
+			err = br.link.attach(ctx, r, n.Name, i, tap)
+		} else if iface.Link != nil {
+			err = r.shapeLink(ctx, tap, iface.Link)
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		netdev := "tap,id=" + br.Name + ",ifname=" + tap + ",script=no,downscript=no"
+		id := fmt.Sprintf("nic%d", i)
+		netdev := "tap,id=" + id + ",ifname=" + tap + ",script=no,downscript=no"
 		if vhostNetSupported {
 			netdev += ",vhost=on"
 		}
+		if iface.Queues > 1 {
+			netdev += fmt.Sprintf(",queues=%d", iface.Queues)
+		}
 
 		params = append(params, "-netdev", netdev)
 
 		devParams := []string{
-			"virtio-net-pci",
-			fmt.Sprintf("netdev=%s", br.Name),
-			fmt.Sprintf("mac=%s", generateRandomMACForKVM()),
+			iface.device(),
+			fmt.Sprintf("netdev=%s", id),
+			fmt.Sprintf("mac=%s", n.macAddress(r, i)),
+		}
+		if iface.Queues > 1 {
+			// a pair of vectors for each queue, plus config and control
+			devParams = append(devParams, "mq=on", fmt.Sprintf("vectors=%d", 2*iface.Queues+2))
+		}
+		if iface.MTU != 0 && iface.device() == nicModels["virtio"] {
+			devParams = append(devParams, fmt.Sprintf("host_mtu=%d", iface.MTU))
+		}
+		if iface.BootIndex != nil {
+			devParams = append(devParams, fmt.Sprintf("bootindex=%d", *iface.BootIndex))
 		}
 		if n.UEFI {
 			// disable iPXE boot
@@ -212,7 +406,7 @@ func (n *Node) Start(ctx context.Context, r *Runtime, nodeCh chan<- bmcInfo) (*N
 
 	if n.UEFI {
 		p := r.nvramPath(n.Name)
-		err := createNVRAM(ctx, p)
+		err := createNVRAM(ctx, r, p)
 		if err != nil {
 			log.Error("Failed to create nvram", map[string]interface{}{
 				"error": err,
@@ -229,16 +423,105 @@ func (n *Node) Start(ctx context.Context, r *Runtime, nodeCh chan<- bmcInfo) (*N
 
 	monitor := r.monitorSocketPath(n.Name)
 	params = append(params, "-monitor", "unix:"+monitor+",server,nowait")
+	return params, nil
+}
 
+// launch starts QEMU with params and connects to its sockets.
+// It returns nil if ctx is cancelled before QEMU gets ready.
+func (n *Node) launch(ctx context.Context, r *Runtime, params []string, nodeCh chan<- bmcInfo) (*NodeVM, error) {
 	log.Info("Starting VM", map[string]interface{}{"name": n.Name})
-	qemuCommand := cmd.CommandContext(ctx, "qemu-system-x86_64", params...)
-	qemuCommand.Stdout = newColoredLogWriter("qemu", n.Name, os.Stdout)
-	qemuCommand.Stderr = newColoredLogWriter("qemu", n.Name, os.Stderr)
+	qemuCommand := newCommand("qemu-system-x86_64", params...)
+	qemuCommand.stdout = newColoredLogWriter("qemu", n.Name, os.Stdout)
+	qemuCommand.stderr = newColoredLogWriter("qemu", n.Name, os.Stderr)
+
+	var con *console
+	if !r.dryRun && !r.graphic {
+		var err error
+		con, err = n.openConsole(r)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	err := qemuCommand.Start()
+	// QEMU is not bound to ctx so that the guest can be shut down gracefully.
+	qemu, err := r.executor.Start(context.Background(), qemuCommand)
 	if err != nil {
+		if con != nil {
+			con.Close()
+		}
 		return nil, err
 	}
+	if r.dryRun {
+		r.emit(EventVMStarted, n.Name, map[string]interface{}{
+			"serial": n.SMBIOS.Serial,
+		})
+		vm := &NodeVM{
+			name:    n.Name,
+			proc:    qemu,
+			events:  r.events,
+			running: true,
+			cleanup: func() {},
+		}
+		if r.onNodeStarted != nil {
+			r.onNodeStarted(vm)
+		}
+		r.runHooks(HookNodeStarted, n.hookEnv(r))
+		return vm, nil
+	}
+
+	err = r.journal.recordProcess("qemu-system-x86_64", qemu.Pid())
+	if err == nil {
+		var vm *NodeVM
+		vm, err = n.connect(ctx, r, qemu, con, nodeCh)
+		if vm != nil {
+			r.emit(EventVMStarted, n.Name, map[string]interface{}{
+				"serial": n.SMBIOS.Serial,
+				"pid":    qemu.Pid(),
+			})
+			if r.onNodeStarted != nil {
+				r.onNodeStarted(vm)
+			}
+			r.runHooks(HookNodeStarted, n.hookEnv(r))
+			return vm, nil
+		}
+	}
+	qemu.Kill()
+	qemu.Wait()
+	if con != nil {
+		con.Close()
+	}
+	return nil, err
+}
+
+// openConsole opens the log file and the sockets of the serial console.
+func (n *Node) openConsole(r *Runtime) (*console, error) {
+	l, err := openRotatingLog(r.consoleLogPath(n.Name), r.consoleLogSize, r.consoleLogBackups)
+	if err != nil {
+		return nil, err
+	}
+	con, err := newConsole(r.serialSocketPath(n.Name), r.socketPath(n.Name), l)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return con, nil
+}
+
+func (n *Node) hookEnv(r *Runtime) map[string]string {
+	return map[string]string{
+		"PLACEMAT_NODE":       n.Name,
+		"PLACEMAT_SERIAL":     n.SMBIOS.Serial,
+		"PLACEMAT_INTERFACES": strings.Join(n.networkNames(), " "),
+		"PLACEMAT_TAPS":       strings.Join(n.taps, " "),
+		"PLACEMAT_MACS":       strings.Join(n.macAddresses(r), " "),
+	}
+}
+
+// connect waits for QEMU to create sockets then connects to them.
+// con is closed by the cleanup function of the returned NodeVM.
+func (n *Node) connect(ctx context.Context, r *Runtime, qemu process, con *console, nodeCh chan<- bmcInfo) (*NodeVM, error) {
+	guest := r.guestSocketPath(n.Name)
+	monitor := r.monitorSocketPath(n.Name)
 
 	for {
 		_, err := os.Stat(monitor)
@@ -272,6 +555,7 @@ func (n *Node) Start(ctx context.Context, r *Runtime, nodeCh chan<- bmcInfo) (*N
 
 	connGuest, err := net.Dial("unix", guest)
 	if err != nil {
+		connMonitor.Close()
 		return nil, err
 	}
 	gc := &guestConnection{
@@ -286,30 +570,58 @@ func (n *Node) Start(ctx context.Context, r *Runtime, nodeCh chan<- bmcInfo) (*N
 		os.Remove(guest)
 		connMonitor.Close()
 		os.Remove(monitor)
-		os.Remove(r.socketPath(n.Name))
+		if con != nil {
+			con.Close()
+		}
 	}
 
 	vm := &NodeVM{
-		cmd:     qemuCommand,
+		name:    n.Name,
+		proc:    qemu,
 		monitor: connMonitor,
+		events:  r.events,
 		running: true,
 		cleanup: cleanup,
 	}
 
-	return vm, err
+	return vm, nil
 }
 
-func generateRandomMACForKVM() string {
-	vendorPrefix := "52:54:00" // QEMU's vendor prefix
-	bytes := make([]byte, 3)
-	rand.Read(bytes)
-	return fmt.Sprintf("%s:%02x:%02x:%02x", vendorPrefix, bytes[0], bytes[1], bytes[2])
+func (n *Node) incRestarts() {
+	n.mu.Lock()
+	n.restarts++
+	n.mu.Unlock()
+}
+
+// Restarts returns the number of times QEMU has been restarted.
+func (n *Node) Restarts() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.restarts
+}
+
+// setLinkVM lets the links connected to the node drop the carrier of
+// its NICs in vm.
+func (n *Node) setLinkVM(vm *NodeVM) {
+	for i, nw := range n.networks {
+		if nw.link != nil {
+			nw.link.setVM(n.Name, i, vm)
+		}
+	}
+}
+
+// deleteTaps deletes tap devices created by Start.
+func (n *Node) deleteTaps(r *Runtime) {
+	for i, tap := range n.taps {
+		n.networks[i].DeleteTap(r, tap)
+	}
+	n.taps = nil
 }
 
-func createNVRAM(ctx context.Context, p string) error {
+func createNVRAM(ctx context.Context, r *Runtime, p string) error {
 	_, err := os.Stat(p)
 	if !os.IsNotExist(err) {
 		return nil
 	}
-	return cmd.CommandContext(ctx, "cp", defaultOVMFVarsPath, p).Run()
+	return r.executor.Run(ctx, newCommand("cp", defaultOVMFVarsPath, p))
 }
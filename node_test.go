@@ -1,21 +1,188 @@
 package placemat
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"net"
+	"strings"
 	"testing"
 )
 
-func TestGenerateRandomMacForKVM(t *testing.T) {
-	sut := generateRandomMACForKVM()
+func testNodeMAC(t *testing.T) {
+	t.Parallel()
+
+	r := &Runtime{}
+	sut := r.nodeMAC("node1", 0)
 	if len(sut) != 17 {
 		t.Fatal("length of MAC address string is not 17")
 	}
-	if sut == generateRandomMACForKVM() {
-		t.Fatal("it should generate unique address")
-	}
-	_, err := net.ParseMAC(sut)
+	hw, err := net.ParseMAC(sut)
 	if err != nil {
 		t.Fatal("invalid MAC address", err)
 	}
+	if hw[0]&1 != 0 || hw[0]&2 == 0 {
+		t.Error("MAC address should be locally administered unicast:", sut)
+	}
+
+	if sut != r.nodeMAC("node1", 0) {
+		t.Error("MAC address should be deterministic")
+	}
+	others := []string{
+		r.nodeMAC("node1", 1),
+		r.nodeMAC("node2", 0),
+		(&Runtime{seed: "foo"}).nodeMAC("node1", 0),
+		(&Runtime{clusterName: "ci1"}).nodeMAC("node1", 0),
+	}
+	for _, o := range others {
+		if o == sut {
+			t.Error("MAC address should differ:", o)
+		}
+	}
+}
+
+func testNodeInterfaces(t *testing.T) {
+	t.Parallel()
+
+	yaml := `kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+  - network: net0
+    mac: 02:00:00:00:00:01
+---
+kind: Node
+name: node2
+interfaces:
+  - network: net0
+    mac: 02:00:00:00:00:01
+  - network: net0
+    mac: 01:00:5e:00:00:01
+`
+	_, err := readYaml(bytes.NewReader([]byte(yaml)), "test.yml", nil)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	expected := []string{
+		"test.yml:18: interfaces: multicast MAC address: 01:00:5e:00:00:01",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+
+	cluster, err := readYaml(bytes.NewReader([]byte(yaml[:bytes.LastIndex([]byte(yaml), []byte("  - network: net0\n    mac: 01"))])), "test.yml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := cluster.Nodes[0]
+	if n.Interfaces[0] != (NodeInterfaceSpec{Network: "net0"}) {
+		t.Error("unexpected interface:", n.Interfaces[0])
+	}
+	r := &Runtime{}
+	if mac := n.macAddress(r, 1); mac != "02:00:00:00:00:01" {
+		t.Error("explicit MAC address is not used:", mac)
+	}
+
+	err = cluster.Resolve()
+	errs, ok = err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	e := "test.yml:16: interfaces: duplicate MAC address: 02:00:00:00:00:01"
+	if len(errs) != 1 || errs[0].Error() != e {
+		t.Errorf("expected %q, actual %v", e, errs)
+	}
+}
+
+func testNodeNICs(t *testing.T) {
+	t.Parallel()
+
+	negative := -1
+	_, err := NewNode(&NodeSpec{
+		Name: "node1",
+		Interfaces: []NodeInterfaceSpec{
+			{Network: "net0", Model: "ne2k"},
+			{Network: "net0", Model: "e1000", Queues: 2},
+			{Network: "net0", MTU: 10, BootIndex: &negative},
+		},
+	})
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	expected := []string{
+		"interfaces: unknown NIC model: ne2k",
+		"interfaces: multiqueue requires virtio model",
+		"interfaces: MTU must be between 68 and 65535",
+		"interfaces: negative boot index",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+
+	yaml := `
+kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - network: net0
+    model: e1000
+    boot-index: 0
+  - network: net0
+    mtu: 9000
+    queues: 4
+`
+	cluster, err := ReadYaml(bufio.NewReader(strings.NewReader(yaml)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, buf := newDryRunRuntime(t)
+	err = cluster.Start(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	expected = []string{
+		"ip tuntap add pm0 mode tap\n",
+		"ip tuntap add pm1 mode tap multi_queue\n",
+		"ip link set pm1 mtu 9000\n",
+		"-device e1000,netdev=nic0,mac=" + r.nodeMAC("node1", 0) + ",bootindex=0 ",
+		",queues=4 ",
+		"-device virtio-net-pci,netdev=nic1,mac=" + r.nodeMAC("node1", 1) + ",mq=on,vectors=10,host_mtu=9000 ",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("%q is not printed:\n%s", e, out)
+		}
+	}
+}
 
+func TestNode(t *testing.T) {
+	t.Run("MAC", testNodeMAC)
+	t.Run("Interfaces", testNodeInterfaces)
+	t.Run("NICs", testNodeNICs)
 }
@@ -1,41 +1,135 @@
 package placemat
 
 import (
+	"errors"
 	"io"
 	"net"
-
-	"github.com/cybozu-go/cmd"
+	"sync"
+	"time"
 )
 
 // NodeVM holds resources to manage and monitor a QEMU process.
 type NodeVM struct {
-	cmd     *cmd.LogCmd
+	name    string
+	proc    process
 	monitor net.Conn
-	running bool
+	events  *eventWriter
 	cleanup func()
+
+	mu       sync.Mutex
+	running  bool
+	released bool
+
+	releaseOnce sync.Once
+}
+
+// Name returns the name of the node.
+func (n *NodeVM) Name() string {
+	return n.name
 }
 
 // IsRunning returns true if the VM is running.
 func (n *NodeVM) IsRunning() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	return n.running
 }
 
 // PowerOn turns on the power of the VM.
-func (n *NodeVM) PowerOn() {
+func (n *NodeVM) PowerOn() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.released {
+		return errors.New("QEMU has exited: " + n.name)
+	}
 	if n.running {
-		return
+		return nil
 	}
 
-	io.WriteString(n.monitor, "system_reset\ncont\n")
+	_, err := io.WriteString(n.monitor, "system_reset\ncont\n")
+	if err != nil {
+		return err
+	}
 	n.running = true
+	n.events.emit(EventPowerOn, n.name, nil)
+	return nil
 }
 
 // PowerOff turns off the power of the VM.
-func (n *NodeVM) PowerOff() {
+func (n *NodeVM) PowerOff() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	if !n.running {
-		return
+		return nil
 	}
 
-	io.WriteString(n.monitor, "stop\n")
+	_, err := io.WriteString(n.monitor, "stop\n")
+	if err != nil {
+		return err
+	}
 	n.running = false
+	n.events.emit(EventPowerOff, n.name, nil)
+	return nil
+}
+
+// pid returns the PID of the QEMU process, or 0 if it has exited.
+func (n *NodeVM) pid() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.released {
+		return 0
+	}
+	return n.proc.Pid()
+}
+
+// release marks the VM as stopped after QEMU has exited, and closes
+// the resources for it.  It is safe to call release more than once.
+func (n *NodeVM) release() {
+	n.mu.Lock()
+	n.running = false
+	n.released = true
+	n.mu.Unlock()
+
+	n.releaseOnce.Do(func() {
+		if n.cleanup != nil {
+			n.cleanup()
+		}
+	})
+}
+
+// setLink turns on or off the link of the NIC connected to the netdev id
+// as the guest sees it.
+func (n *NodeVM) setLink(id string, up bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.monitor == nil || n.released {
+		return
+	}
+
+	state := "off"
+	if up {
+		state = "on"
+	}
+	io.WriteString(n.monitor, "set_link "+id+" "+state+"\n")
+}
+
+// shutdown requests the guest OS to shut down by ACPI power button event,
+// then waits for QEMU to exit.  QEMU is killed if it does not exit within
+// timeout, or immediately if the VM is powered off.  exited must be the
+// channel returned by waitProcess for the QEMU process.  It returns true
+// if QEMU was killed.
+func (n *NodeVM) shutdown(timeout time.Duration, exited <-chan error) bool {
+	n.mu.Lock()
+	if n.running && n.monitor != nil {
+		_, err := io.WriteString(n.monitor, "system_powerdown\n")
+		if err != nil {
+			timeout = 0
+		}
+	} else {
+		timeout = 0
+	}
+	n.mu.Unlock()
+
+	killed, _ := killAfter(n.proc, exited, timeout)
+	return killed
 }
@@ -5,8 +5,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-
-	"github.com/cybozu-go/cmd"
 )
 
 // NodeVolumeSpec represents a Node's Volume specification in YAML
@@ -21,12 +19,17 @@ type NodeVolumeSpec struct {
 	CopyOnWrite   bool   `yaml:"copy-on-write,omitempty"`
 }
 
+func (s *NodeVolumeSpec) resolvePaths(dir string) {
+	s.UserData = resolvePath(dir, s.UserData)
+	s.NetworkConfig = resolvePath(dir, s.NetworkConfig)
+}
+
 // NodeVolume defines the interface for Node volumes.
 type NodeVolume interface {
 	Kind() string
 	Name() string
 	Resolve(*Cluster) error
-	Create(context.Context, string) ([]string, error)
+	Create(context.Context, *Runtime, string) ([]string, error)
 }
 
 type baseVolume struct {
@@ -77,7 +80,7 @@ func (v *imageVolume) Resolve(c *Cluster) error {
 	return nil
 }
 
-func (v *imageVolume) Create(ctx context.Context, dataDir string) ([]string, error) {
+func (v *imageVolume) Create(ctx context.Context, r *Runtime, dataDir string) ([]string, error) {
 	p := volumePath(dataDir, v.name)
 	args := v.qemuArgs(p)
 
@@ -96,10 +99,12 @@ func (v *imageVolume) Create(ctx context.Context, dataDir string) ([]string, err
 			return nil, err
 		}
 		if v.copyOnWrite {
-			err = createCoWImageFromBase(ctx, fp, p)
+			err = createCoWImageFromBase(ctx, r, fp, p)
 			if err != nil {
 				return nil, err
 			}
+		} else if r.dryRun {
+			r.note("copy %s to %s", fp, p)
 		} else {
 			err = writeToFile(fp, p, v.image.decomp)
 			if err != nil {
@@ -111,13 +116,18 @@ func (v *imageVolume) Create(ctx context.Context, dataDir string) ([]string, err
 
 	baseImage := v.image.Path()
 	if v.copyOnWrite {
-		err = createCoWImageFromBase(ctx, baseImage, p)
+		err = createCoWImageFromBase(ctx, r, baseImage, p)
 		if err != nil {
 			return nil, err
 		}
 		return args, nil
 	}
 
+	if r.dryRun {
+		r.note("copy %s to %s", baseImage, p)
+		return args, nil
+	}
+
 	f, err := os.Open(baseImage)
 	if err != nil {
 		return nil, err
@@ -137,9 +147,9 @@ func (v *imageVolume) Create(ctx context.Context, dataDir string) ([]string, err
 	return args, nil
 }
 
-func createCoWImageFromBase(ctx context.Context, base, dest string) error {
-	c := cmd.CommandContext(ctx, "qemu-img", "create", "-f", "qcow2", "-o", "backing_file="+base, dest)
-	return c.Run()
+func createCoWImageFromBase(ctx context.Context, r *Runtime, base, dest string) error {
+	c := newCommand("qemu-img", "create", "-f", "qcow2", "-o", "backing_file="+base, dest)
+	return r.executor.Run(ctx, c)
 }
 
 type localDSVolume struct {
@@ -165,19 +175,19 @@ func (v *localDSVolume) Resolve(c *Cluster) error {
 	return nil
 }
 
-func (v *localDSVolume) Create(ctx context.Context, dataDir string) ([]string, error) {
+func (v *localDSVolume) Create(ctx context.Context, r *Runtime, dataDir string) ([]string, error) {
 	p := volumePath(dataDir, v.name)
 
 	_, err := os.Stat(p)
 	switch {
 	case os.IsNotExist(err):
 		if v.networkConfig == "" {
-			err := cmd.CommandContext(ctx, "cloud-localds", p, v.userData).Run()
+			err := r.executor.Run(ctx, newCommand("cloud-localds", p, v.userData))
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			err := cmd.CommandContext(ctx, "cloud-localds", p, v.userData, "--network-config", v.networkConfig).Run()
+			err := r.executor.Run(ctx, newCommand("cloud-localds", p, v.userData, "--network-config", v.networkConfig))
 			if err != nil {
 				return nil, err
 			}
@@ -211,12 +221,12 @@ func (v *rawVolume) Resolve(c *Cluster) error {
 	return nil
 }
 
-func (v *rawVolume) Create(ctx context.Context, dataDir string) ([]string, error) {
+func (v *rawVolume) Create(ctx context.Context, r *Runtime, dataDir string) ([]string, error) {
 	p := volumePath(dataDir, v.name)
 	_, err := os.Stat(p)
 	switch {
 	case os.IsNotExist(err):
-		err = cmd.CommandContext(ctx, "qemu-img", "create", "-f", "qcow2", p, v.size).Run()
+		err = r.executor.Run(ctx, newCommand("qemu-img", "create", "-f", "qcow2", p, v.size))
 		if err != nil {
 			return nil, err
 		}
@@ -254,7 +264,7 @@ func (v *vvfatVolume) Resolve(c *Cluster) error {
 	return nil
 }
 
-func (v *vvfatVolume) Create(ctx context.Context, _ string) ([]string, error) {
+func (v *vvfatVolume) Create(ctx context.Context, _ *Runtime, _ string) ([]string, error) {
 	return v.qemuArgs(v.folder.Path()), nil
 }
 
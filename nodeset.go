@@ -0,0 +1,189 @@
+package placemat
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// NodeSetSpec represents a NodeSet specification in YAML.
+//
+// A NodeSet is expanded into Replicas nodes created from Template.
+// Strings in Template and NodeName may contain placeholders:
+// "{index}" is replaced with the index of the node, "{index:N}" with
+// the index padded with zeros to N digits, and "{name}" with the name
+// of the node.  Overrides replace top-level properties of Template
+// for the node of the index.
+type NodeSetSpec struct {
+	Kind      string                `yaml:"kind"`
+	Name      string                `yaml:"name"`
+	Replicas  int                   `yaml:"replicas"`
+	Start     int                   `yaml:"start,omitempty"`
+	NodeName  string                `yaml:"node-name,omitempty"`
+	Template  yaml.MapSlice         `yaml:"template"`
+	Overrides map[int]yaml.MapSlice `yaml:"overrides,omitempty"`
+}
+
+var nodeSetPlaceholder = regexp.MustCompile(`\{(index|name)(?::(\d+))?\}`)
+
+// substitute replaces placeholders in s.
+func substitute(s string, index int, name string) string {
+	return nodeSetPlaceholder.ReplaceAllStringFunc(s, func(p string) string {
+		m := nodeSetPlaceholder.FindStringSubmatch(p)
+		if m[1] == "name" {
+			return name
+		}
+		if m[2] == "" {
+			return strconv.Itoa(index)
+		}
+		width, _ := strconv.Atoi(m[2])
+		return fmt.Sprintf("%0*d", width, index)
+	})
+}
+
+// substituteValue replaces placeholders in strings in a decoded YAML value.
+func substituteValue(v interface{}, index int, name string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return substitute(v, index, name)
+	case yaml.MapSlice:
+		ret := make(yaml.MapSlice, len(v))
+		for i, item := range v {
+			ret[i] = yaml.MapItem{Key: item.Key, Value: substituteValue(item.Value, index, name)}
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, item := range v {
+			ret[i] = substituteValue(item, index, name)
+		}
+		return ret
+	}
+	return v
+}
+
+// override returns a copy of template whose top-level properties are
+// replaced with those in o.
+func override(template, o yaml.MapSlice) yaml.MapSlice {
+	ret := append(yaml.MapSlice{}, template...)
+OUTER:
+	for _, item := range o {
+		for i := range ret {
+			if ret[i].Key == item.Key {
+				ret[i].Value = item.Value
+				continue OUTER
+			}
+		}
+		ret = append(ret, item)
+	}
+	return ret
+}
+
+// nodeError prefixes messages in err with the node name so that errors
+// of nodes in a NodeSet can be told apart.
+func nodeError(name string, err error) error {
+	switch e := err.(type) {
+	case ErrorList:
+		var errs ErrorList
+		for _, err := range e {
+			errs.add(nodeError(name, err))
+		}
+		return errs
+	case *fieldError:
+		return &fieldError{field: e.field, value: e.value, err: nodeError(name, e.err)}
+	}
+	return errors.New(name + ": " + err.Error())
+}
+
+// templateError converts errors in decoding an expanded node into
+// errors of the fields of the NodeSet, as the line numbers in e are
+// meaningless.
+func templateError(e *yaml.TypeError) error {
+	var errs ErrorList
+	for _, msg := range e.Errors {
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			msg = m[2]
+		}
+		if f := yamlUnknownField.FindStringSubmatch(msg); f != nil {
+			errs.add(&fieldError{field: f[1], err: errors.New("unknown field")})
+			continue
+		}
+		errs.add(&fieldError{field: "template", err: errors.New(msg)})
+	}
+	return errs
+}
+
+// Expand creates nodes from the NodeSet.
+func (s *NodeSetSpec) Expand() ([]*Node, error) {
+	return s.expand("")
+}
+
+// expand creates nodes from the NodeSet.  Relative paths in the nodes
+// are resolved against dir.
+func (s *NodeSetSpec) expand(dir string) ([]*Node, error) {
+	if s.Name == "" {
+		return nil, &fieldError{field: "name", err: errors.New("node set name is empty")}
+	}
+	if s.Replicas <= 0 {
+		return nil, &fieldError{field: "replicas", err: errors.New("replicas must be positive")}
+	}
+	for _, item := range s.Template {
+		if item.Key == "kind" || item.Key == "name" {
+			return nil, &fieldError{field: "template", err: fmt.Errorf("%v cannot be specified in template", item.Key)}
+		}
+	}
+	for i, o := range s.Overrides {
+		if i < s.Start || i >= s.Start+s.Replicas {
+			return nil, &fieldError{field: "overrides", err: fmt.Errorf("index out of range: %d", i)}
+		}
+		for _, item := range o {
+			if item.Key == "kind" || item.Key == "name" {
+				return nil, &fieldError{field: "overrides", err: fmt.Errorf("%v cannot be overridden", item.Key)}
+			}
+		}
+	}
+
+	pattern := s.NodeName
+	if pattern == "" {
+		pattern = s.Name + "-{index}"
+	}
+
+	nodes := make([]*Node, 0, s.Replicas)
+	names := make(map[string]bool)
+	for i := s.Start; i < s.Start+s.Replicas; i++ {
+		name := substitute(pattern, i, "")
+		if names[name] {
+			return nil, &fieldError{field: "node-name", err: errors.New("node names are not unique: " + name)}
+		}
+		names[name] = true
+
+		m := yaml.MapSlice{
+			{Key: "kind", Value: "Node"},
+			{Key: "name", Value: name},
+		}
+		m = append(m, override(s.Template, s.Overrides[i])...)
+		data, err := yaml.Marshal(substituteValue(m, i, name))
+		if err != nil {
+			return nil, err
+		}
+
+		spec := new(NodeSpec)
+		err = yaml.UnmarshalStrict(data, spec)
+		if e, ok := err.(*yaml.TypeError); ok {
+			return nil, nodeError(name, templateError(e))
+		}
+		if err != nil {
+			return nil, nodeError(name, err)
+		}
+		spec.resolvePaths(dir)
+		node, err := NewNode(spec)
+		if err != nil {
+			return nil, nodeError(name, err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,136 @@
+package placemat
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func testNodeSetExpand(t *testing.T) {
+	t.Parallel()
+
+	c := testReadCluster(t, `
+kind: Network
+name: rack0-node
+type: internal
+---
+kind: Network
+name: rack1-node
+type: internal
+---
+kind: NodeSet
+name: worker
+replicas: 2
+start: 1
+node-name: worker-{index:2}
+template:
+  interfaces:
+    - rack{index}-node
+  volumes:
+    - kind: localds
+      name: seed
+      user-data: seed_{name}.yml
+  smbios:
+    serial: serial-{index}
+  cpu: 2
+overrides:
+  2:
+    cpu: 4
+    interfaces:
+      - rack0-node
+`)
+	if len(c.Nodes) != 2 {
+		t.Fatal("unexpected nodes:", c.Nodes)
+	}
+
+	expected := []struct {
+		name     string
+		iface    string
+		userData string
+		serial   string
+		cpu      int
+	}{
+		{"worker-01", "rack1-node", "seed_worker-01.yml", "serial-1", 2},
+		{"worker-02", "rack0-node", "seed_worker-02.yml", "serial-2", 4},
+	}
+	for i, e := range expected {
+		n := c.Nodes[i]
+		if n.Name != e.name {
+			t.Errorf("expected %s, actual %s", e.name, n.Name)
+		}
+		if len(n.Interfaces) != 1 || n.Interfaces[0].Network != e.iface {
+			t.Errorf("%s: unexpected interfaces: %v", e.name, n.Interfaces)
+		}
+		if len(n.Volumes) != 1 || n.Volumes[0].UserData != e.userData {
+			t.Errorf("%s: unexpected volumes: %v", e.name, n.Volumes)
+		}
+		if n.SMBIOS.Serial != e.serial {
+			t.Errorf("%s: unexpected serial: %s", e.name, n.SMBIOS.Serial)
+		}
+		if n.CPU != e.cpu {
+			t.Errorf("%s: unexpected cpu: %d", e.name, n.CPU)
+		}
+	}
+}
+
+func testNodeSetErrors(t *testing.T) {
+	t.Parallel()
+
+	yaml := `kind: Network
+name: net0
+type: internal
+---
+kind: NodeSet
+name: worker
+replicas: 2
+template:
+  interfaces:
+    - net{index}
+  cpus: 2
+---
+kind: NodeSet
+name: boot
+replicas: 2
+template:
+  interfaces:
+    - net{index}
+overrides:
+  5:
+    cpu: 4
+`
+	_, err := readYaml(strings.NewReader(yaml), "test.yml", nil)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	expected := []string{
+		"test.yml:11: cpus: worker-0: unknown field",
+		"test.yml:19: overrides: index out of range: 5",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+
+	c, err := ReadYaml(bufio.NewReader(strings.NewReader(yaml[:strings.Index(yaml, "  cpus")])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Resolve()
+	errs, ok = err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	if len(errs) != 1 || errs[0].Error() != "line 9: interfaces: no such network: net1" {
+		t.Error("unexpected errors:", errs)
+	}
+}
+
+func TestNodeSet(t *testing.T) {
+	t.Run("Expand", testNodeSetExpand)
+	t.Run("Errors", testNodeSetErrors)
+}
@@ -0,0 +1,102 @@
+package placemat
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types and options.
+// See https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-00.html
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterfaceDesc    = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngOptEndOfOpt      = 0
+	pcapngOptIfName        = 2
+	pcapngLinkTypeEthernet = 1
+)
+
+// pcapngWriter writes packets captured on an Ethernet interface in
+// pcapng format.  Timestamps are in microseconds, the default of pcapng.
+type pcapngWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// newPcapngWriter writes the section header and the description of the
+// interface named ifName to w.
+func newPcapngWriter(w io.Writer, ifName string) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor version
+	// section length is unknown
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	err := pw.writeBlock(pcapngSectionHeader, shb)
+	if err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeEthernet)
+	// snap length 0 means no limit
+	idb = appendOption(idb, pcapngOptIfName, []byte(ifName))
+	idb = appendOption(idb, pcapngOptEndOfOpt, nil)
+	err = pw.writeBlock(pcapngInterfaceDesc, idb)
+	if err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// appendOption appends an option padded to 32 bits.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:], code)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(value)))
+	b = append(b, hdr[:]...)
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// writeBlock writes a block of typ with body.  Each block is written by
+// a single Write so that a stream can be flushed per packet.
+func (pw *pcapngWriter) writeBlock(typ uint32, body []byte) error {
+	total := 12 + len(body) + pad4(len(body))
+	b := pw.buf[:0]
+	if cap(b) < total {
+		b = make([]byte, 0, total)
+	}
+	b = b[:8]
+	binary.LittleEndian.PutUint32(b[0:], typ)
+	binary.LittleEndian.PutUint32(b[4:], uint32(total))
+	b = append(b, body...)
+	b = append(b, make([]byte, pad4(len(body)))...)
+	b = b[:total]
+	binary.LittleEndian.PutUint32(b[total-4:], uint32(total))
+	pw.buf = b
+
+	_, err := pw.w.Write(b)
+	return err
+}
+
+// writePacket writes an Ethernet frame captured at ts.
+func (pw *pcapngWriter) writePacket(ts time.Time, data []byte) error {
+	body := make([]byte, 20, 20+len(data))
+	usec := uint64(ts.UnixNano() / int64(time.Microsecond))
+	// interface ID is 0
+	binary.LittleEndian.PutUint32(body[4:], uint32(usec>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(usec))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(data)))
+	body = append(body, data...)
+	return pw.writeBlock(pcapngEnhancedPacket, body)
+}
@@ -0,0 +1,387 @@
+// Package placemattest starts placemat clusters in Go tests.
+//
+// Start and StartYaml start a cluster, wait for all the resources to get
+// ready, and stop the cluster when the test finishes.  If the test fails,
+// the serial console logs of the nodes are written to the test log.
+//
+//	func TestBoot(t *testing.T) {
+//		c := placemattest.StartYaml(t, nil, "cluster.yml")
+//		c.WaitSerial("node1", regexp.MustCompile("login: "), 5*time.Minute)
+//		out, err := c.RunSerial("node1", "uname -r", time.Minute)
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		...
+//	}
+//
+// Like placemat, tests using this package need root privileges.
+// This package requires Go 1.14 or later for testing.TB.Cleanup.
+package placemattest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/placemat"
+)
+
+const (
+	// DefaultReadyTimeout is the default time to wait for a cluster to
+	// get ready.
+	DefaultReadyTimeout = 10 * time.Minute
+
+	pollInterval = 100 * time.Millisecond
+
+	// consoleLogLines is the number of the last lines of each serial
+	// console written to the test log on failure.
+	consoleLogLines = 200
+)
+
+// Options are options to start a cluster.
+type Options struct {
+	// RuntimeOptions are passed to placemat.  If RunDir or DataDir is
+	// empty, a temporary directory removed after the test is used.
+	// If CacheDir is empty, DataDir is used.  Hooks and Ready are called
+	// in addition to those of this package.
+	placemat.RuntimeOptions
+
+	// Vars are template variables for StartYaml.
+	Vars map[string]string
+
+	// ReadyTimeout is the time to wait for the cluster to get ready.
+	// If zero, DefaultReadyTimeout is used.
+	ReadyTimeout time.Duration
+
+	// DryRun, if not nil, prints commands to it instead of running them.
+	// Start returns after all the commands are printed.
+	DryRun io.Writer
+
+	// SSHArgs are additional arguments of ssh(1) for RunSSH, such as
+	// "-i" and a private key file, or "-l" and a user name.
+	SSHArgs []string
+}
+
+// Cluster is a placemat cluster running for a test.
+type Cluster struct {
+	*placemat.Cluster
+	Runtime *placemat.Runtime
+
+	t       testing.TB
+	sshArgs []string
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+
+	mu   sync.Mutex
+	bmcs map[string]string
+}
+
+// Start starts c and waits for it to get ready.  The cluster is stopped
+// by t.Cleanup.  opts may be nil.
+func Start(t testing.TB, c *placemat.Cluster, opts *Options) *Cluster {
+	t.Helper()
+	return start(t, c, prepare(t, opts))
+}
+
+// StartYaml reads the YAML files and starts the cluster like Start.
+func StartYaml(t testing.TB, opts *Options, paths ...string) *Cluster {
+	t.Helper()
+	opts = prepare(t, opts)
+	c, err := placemat.ReadYamlFiles(paths, opts.Vars, opts.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return start(t, c, opts)
+}
+
+// prepare returns a copy of opts with directories filled.
+func prepare(t testing.TB, opts *Options) *Options {
+	t.Helper()
+	o := new(Options)
+	if opts != nil {
+		*o = *opts
+	}
+	if o.RunDir == "" {
+		o.RunDir = tempDir(t)
+	}
+	if o.DataDir == "" {
+		o.DataDir = tempDir(t)
+	}
+	if o.CacheDir == "" {
+		o.CacheDir = o.DataDir
+	}
+	if o.ReadyTimeout == 0 {
+		o.ReadyTimeout = DefaultReadyTimeout
+	}
+	return o
+}
+
+// tempDir creates a temporary directory removed after the test.
+// t.TempDir is not used as paths of UNIX domain sockets must be short.
+func tempDir(t testing.TB) string {
+	t.Helper()
+	d, err := ioutil.TempDir("", "placemattest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(d)
+	})
+	return d
+}
+
+func start(t testing.TB, c *placemat.Cluster, opts *Options) *Cluster {
+	t.Helper()
+	err := c.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &Cluster{
+		Cluster: c,
+		t:       t,
+		sshArgs: opts.SSHArgs,
+		done:    make(chan struct{}),
+		bmcs:    make(map[string]string),
+	}
+
+	ropts := opts.RuntimeOptions
+	onBMCRegistered := ropts.OnBMCRegistered
+	ropts.OnBMCRegistered = func(serial, addr string) {
+		tc.mu.Lock()
+		tc.bmcs[serial] = addr
+		tc.mu.Unlock()
+		if onBMCRegistered != nil {
+			onBMCRegistered(serial, addr)
+		}
+	}
+	ready := make(chan struct{})
+	userReady := ropts.Ready
+	ropts.Ready = ready
+
+	var r *placemat.Runtime
+	if opts.DryRun != nil {
+		r, err = placemat.NewDryRunRuntime(opts.DryRun, &ropts)
+	} else {
+		r, err = placemat.NewRuntime(&ropts)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Runtime = r
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tc.cancel = cancel
+	go func() {
+		tc.err = c.Start(ctx, r)
+		close(tc.done)
+	}()
+	t.Cleanup(tc.stop)
+
+	select {
+	case <-ready:
+	case <-tc.done:
+		select {
+		case <-ready:
+		default:
+			t.Fatal("cluster stopped before getting ready:", tc.err)
+		}
+	case <-time.After(opts.ReadyTimeout):
+		t.Fatal("cluster did not get ready in", opts.ReadyTimeout)
+	}
+	if userReady != nil {
+		close(userReady)
+	}
+	if opts.DryRun != nil {
+		// a dry-run cluster stops by itself after getting ready.
+		// Wait for it so that DryRun is no longer written.
+		<-tc.done
+	}
+	return tc
+}
+
+// stop stops the cluster, and writes the serial console logs to the test
+// log if the test has failed.
+func (c *Cluster) stop() {
+	c.cancel()
+	<-c.done
+	if c.err != nil {
+		c.t.Error("cluster stopped with error:", c.err)
+	}
+	if c.t.Failed() {
+		c.logConsoles()
+	}
+}
+
+func (c *Cluster) logConsoles() {
+	for _, n := range c.Nodes {
+		data, err := ioutil.ReadFile(c.Runtime.ConsoleLogPath(n.Name))
+		if err != nil {
+			continue
+		}
+		c.t.Logf("serial console of %s:\n%s", n.Name, tail(data, consoleLogLines))
+	}
+}
+
+// tail returns the last n lines of data.
+func tail(data []byte, n int) []byte {
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+func (c *Cluster) node(name string) *placemat.Node {
+	c.t.Helper()
+	n, err := c.GetNode(name)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return n
+}
+
+// poll calls f until it returns true.  It fails the test if f does not
+// return true within timeout.
+func (c *Cluster) poll(what string, timeout time.Duration, f func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !f() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s in %s", what, timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// WaitSerial waits until the serial console log of the node matches re,
+// and returns the first match.  Output before this call is also matched,
+// except for rotated logs.
+func (c *Cluster) WaitSerial(node string, re *regexp.Regexp, timeout time.Duration) string {
+	c.t.Helper()
+	c.node(node)
+
+	var match []byte
+	c.poll(fmt.Sprintf("serial console of %s to match %q", node, re), timeout, func() bool {
+		data, err := ioutil.ReadFile(c.Runtime.ConsoleLogPath(node))
+		if err != nil {
+			return false
+		}
+		match = re.Find(data)
+		return match != nil
+	})
+	return string(match)
+}
+
+// WaitPort waits until a TCP connection to addr is established.
+func (c *Cluster) WaitPort(addr string, timeout time.Duration) {
+	c.t.Helper()
+	c.poll("TCP port "+addr, timeout, func() bool {
+		conn, err := net.DialTimeout("tcp", addr, pollInterval)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+}
+
+// WaitGuest waits until the guest of the node sends its BMC address
+// through the guest channel, and returns the address.
+func (c *Cluster) WaitGuest(node string, timeout time.Duration) string {
+	c.t.Helper()
+	n := c.node(node)
+
+	var addr string
+	c.poll("guest of "+node, timeout, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		addr = c.bmcs[n.SMBIOS.Serial]
+		return addr != ""
+	})
+	return addr
+}
+
+var serialCommandID int64
+
+// RunSerial runs command on the shell of the serial console of the node,
+// and returns its output.  The shell must be logged in.  It returns an
+// error if the command exits with non-zero status.
+//
+// RunSerial disconnects placemat-connect connected to the node.
+func (c *Cluster) RunSerial(node, command string, timeout time.Duration) (string, error) {
+	c.t.Helper()
+	c.node(node)
+
+	conn, err := net.Dial("unix", c.Runtime.ConsoleSocketPath(node))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// markers are quoted so that the echoed command line does not match.
+	id := atomic.AddInt64(&serialCommandID, 1)
+	begin := fmt.Sprintf("PLACEMATTEST_BEGIN_%d", id)
+	end := fmt.Sprintf("PLACEMATTEST_END_%d ", id)
+	_, err = fmt.Fprintf(conn, "echo PLACEMATTEST_'BEGIN'_%d; %s; echo PLACEMATTEST_'END'_%d $?\n", id, command, id)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	started := false
+	br := bufio.NewReader(conn)
+	for {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			return strings.Join(lines, "\n"), err
+		}
+		l = strings.TrimRight(l, "\r\n")
+		switch {
+		case !started:
+			started = l == begin
+		case strings.HasPrefix(l, end):
+			out := strings.Join(lines, "\n")
+			status := strings.TrimPrefix(l, end)
+			if status != "0" {
+				return out, errors.New(command + ": exit status " + status)
+			}
+			return out, nil
+		default:
+			lines = append(lines, l)
+		}
+	}
+}
+
+// RunSSH runs command on addr by ssh(1) and returns its combined output.
+// Host keys are not checked as guests are recreated for each test.
+func (c *Cluster) RunSSH(addr, command string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := []string{
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "BatchMode=yes",
+		"-o", "LogLevel=ERROR",
+	}
+	args = append(args, c.sshArgs...)
+	args = append(args, addr, command)
+	out, err := exec.CommandContext(ctx, "ssh", args...).CombinedOutput()
+	return string(out), err
+}
@@ -0,0 +1,67 @@
+package placemattest
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/placemat"
+)
+
+func testStart(t *testing.T) {
+	t.Parallel()
+
+	c := new(placemat.Cluster).
+		AddNetwork(&placemat.NetworkSpec{Name: "net0", Type: "internal"}).
+		AddNode(&placemat.NodeSpec{Name: "node1", Interfaces: []placemat.NodeInterfaceSpec{{Network: "net0"}}})
+
+	buf := new(bytes.Buffer)
+	ready := make(chan struct{})
+	opts := &Options{DryRun: buf}
+	opts.Ready = ready
+	tc := Start(t, c, opts)
+
+	select {
+	case <-ready:
+	default:
+		t.Error("Ready is not closed")
+	}
+	if !strings.Contains(buf.String(), "qemu-system-x86_64") {
+		t.Error("QEMU is not started:", buf.String())
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tc.WaitPort(l.Addr().String(), time.Second)
+}
+
+func testTail(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		data     string
+		n        int
+		expected string
+	}{
+		{"a\nb\nc\n", 2, "b\nc"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\nc\n", 5, "a\nb\nc"},
+		{"", 1, ""},
+	}
+	for _, c := range cases {
+		actual := string(tail([]byte(c.data), c.n))
+		if actual != c.expected {
+			t.Errorf("tail(%q, %d): expected %q, actual %q", c.data, c.n, c.expected, actual)
+		}
+	}
+}
+
+func TestPlacemattest(t *testing.T) {
+	t.Run("Start", testStart)
+	t.Run("Tail", testTail)
+}
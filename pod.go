@@ -5,19 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 
-	"github.com/cybozu-go/cmd"
 	"github.com/cybozu-go/log"
 )
 
 // PodInterfaceSpec represents a Pod's Interface definition in YAML
 type PodInterfaceSpec struct {
-	Network   string   `yaml:"network"`
-	Addresses []string `yaml:"addresses,omitempty"`
+	Network   string       `yaml:"network" json:"network"`
+	Addresses []string     `yaml:"addresses,omitempty" json:"addresses,omitempty"`
+	Link      *LinkProfile `yaml:"link,omitempty" json:"link,omitempty"`
 }
 
 // PodVolumeSpec represents a Pod's Volume definition in YAML
@@ -53,12 +53,19 @@ type PodAppSpec struct {
 
 // PodSpec represents a Pod specification in YAML
 type PodSpec struct {
-	Kind        string             `yaml:"kind"`
-	Name        string             `yaml:"name"`
-	InitScripts []string           `yaml:"init-scripts,omitempty"`
-	Interfaces  []PodInterfaceSpec `yaml:"interfaces,omitempty"`
-	Volumes     []*PodVolumeSpec   `yaml:"volumes,omitempty"`
-	Apps        []*PodAppSpec      `yaml:"apps"`
+	Kind          string             `yaml:"kind"`
+	Name          string             `yaml:"name"`
+	InitScripts   []string           `yaml:"init-scripts,omitempty"`
+	Interfaces    []PodInterfaceSpec `yaml:"interfaces,omitempty"`
+	Volumes       []*PodVolumeSpec   `yaml:"volumes,omitempty"`
+	Apps          []*PodAppSpec      `yaml:"apps"`
+	RestartPolicy RestartPolicy      `yaml:"restart-policy,omitempty"`
+}
+
+func (s *PodSpec) resolvePaths(dir string) {
+	for i, script := range s.InitScripts {
+		s.InitScripts[i] = resolvePath(dir, script)
+	}
 }
 
 // PodVolume is an interface of a volume for Pod.
@@ -194,6 +201,12 @@ type Pod struct {
 	initScripts []string
 	volumes     []PodVolume
 	networks    []*Network
+	veths       []string // host side veth names for networks
+
+	mu       sync.Mutex
+	running  bool
+	pid      int
+	restarts int
 }
 
 // NewPod creates a Pod from spec.
@@ -206,39 +219,59 @@ func NewPod(spec *PodSpec) (*Pod, error) {
 		return nil, errors.New("pod name is empty")
 	}
 
+	var errs ErrorList
+	errs.add(spec.RestartPolicy.validate())
 	for _, script := range spec.InitScripts {
-		script, err := filepath.Abs(script)
+		abs, err := filepath.Abs(script)
+		if err == nil {
+			_, err = os.Stat(abs)
+		}
 		if err != nil {
-			return nil, err
+			errs.add(&fieldError{field: "init-scripts", value: script, err: err})
+			continue
 		}
-		_, err = os.Stat(script)
+		p.initScripts = append(p.initScripts, abs)
+	}
+
+	for _, iface := range spec.Interfaces {
+		if iface.Link == nil {
+			continue
+		}
+		err := iface.Link.validate()
 		if err != nil {
-			return nil, err
+			errs.add(&fieldError{field: "interfaces", value: "link:", err: err})
 		}
-		p.initScripts = append(p.initScripts, script)
 	}
 
 	for _, vs := range spec.Volumes {
 		vol, err := NewPodVolume(vs)
 		if err != nil {
-			return nil, err
+			errs.add(&fieldError{field: "volumes", value: vs.Name, err: err})
+			continue
 		}
 		p.volumes = append(p.volumes, vol)
 	}
 
 	if len(spec.Apps) == 0 {
-		return nil, errors.New("no app for pod " + spec.Name)
+		errs.add(&fieldError{field: "apps", err: errors.New("no app for pod " + spec.Name)})
 	}
 
+	if len(errs) > 0 {
+		return nil, errs
+	}
 	return p, nil
 }
 
 // Resolve resolves references to other resources in the cluster.
+// It returns ErrorList if there are errors.
 func (p *Pod) Resolve(c *Cluster) error {
+	var errs ErrorList
+	p.networks = nil
 	for _, iface := range p.Interfaces {
 		network, err := c.GetNetwork(iface.Network)
 		if err != nil {
-			return err
+			errs.add(&fieldError{field: "network", value: iface.Network, err: err})
+			continue
 		}
 		p.networks = append(p.networks, network)
 	}
@@ -246,11 +279,11 @@ func (p *Pod) Resolve(c *Cluster) error {
 	for _, v := range p.volumes {
 		err := v.Resolve(c)
 		if err != nil {
-			return err
+			errs.add(&fieldError{field: "volumes", value: v.Name(), err: err})
 		}
 	}
 
-	return nil
+	return errs.errorOrNil()
 }
 
 func (p *Pod) appendParams(params []string) []string {
@@ -270,7 +303,7 @@ func (p *Pod) appendParams(params []string) []string {
 	return params
 }
 
-func fetchImage(ctx context.Context, image string) error {
+func fetchImage(ctx context.Context, r *Runtime, image string) error {
 	log.Info("fetching image", map[string]interface{}{
 		"image": image,
 	})
@@ -280,13 +313,13 @@ func fetchImage(ctx context.Context, image string) error {
 		"fetch",
 		image,
 	}
-	return cmd.CommandContext(ctx, "rkt", args...).Run()
+	return r.executor.Run(ctx, newCommand("rkt", args...))
 }
 
 // Prepare fetches container images to run Pod.
-func (p *Pod) Prepare(ctx context.Context) error {
+func (p *Pod) Prepare(ctx context.Context, r *Runtime) error {
 	for _, a := range p.Apps {
-		err := fetchImage(ctx, a.Image)
+		err := fetchImage(ctx, r, a.Image)
 		if err != nil {
 			return err
 		}
@@ -294,9 +327,14 @@ func (p *Pod) Prepare(ctx context.Context) error {
 	return nil
 }
 
-func makePodNS(ctx context.Context, pod string, veths []string, ips map[string][]string) error {
+func makePodNS(ctx context.Context, r *Runtime, pod string, veths []string, ips map[string][]string) error {
 	log.Info("Creating Pod network namespace", map[string]interface{}{"pod": pod})
-	ns := "pm_" + pod
+	ns := r.netnsName(pod)
+	err := r.journal.recordUndo("netns", ns, []string{"ip", "netns", "del", ns})
+	if err != nil {
+		return err
+	}
+
 	cmds := [][]string{
 		{"ip", "netns", "add", ns},
 		{"ip", "netns", "exec", ns, "ip", "link", "set", "lo", "up"},
@@ -307,6 +345,10 @@ func makePodNS(ctx context.Context, pod string, veths []string, ips map[string][
 		//{"ip", "netns", "exec", ns, "ip", "a", "add", "127.0.0.1/8", "dev", "lo"},
 	}
 	for i, veth := range veths {
+		if veth == "" {
+			// an end of a veth pair of a link is placed separately.
+			continue
+		}
 		eth := fmt.Sprintf("eth%d", i)
 		cmds = append(cmds, []string{
 			"ip", "link", "set", veth, "netns", ns, "name", eth, "up",
@@ -317,44 +359,88 @@ func makePodNS(ctx context.Context, pod string, veths []string, ips map[string][
 			})
 		}
 	}
-	return execCommands(ctx, cmds)
+	return execCommands(ctx, r.executor, cmds)
 }
 
-func runInPodNS(ctx context.Context, pod string, script string) error {
-	return cmd.CommandContext(ctx, "ip", "netns", "exec", "pm_"+pod, script).Run()
+func runInPodNS(ctx context.Context, r *Runtime, pod string, script string) error {
+	return r.executor.Run(ctx, newCommand("ip", "netns", "exec", r.netnsName(pod), script))
 }
 
-func deletePodNS(ctx context.Context, pod string) error {
-	return cmd.CommandContext(ctx, "ip", "netns", "del", "pm_"+pod).Run()
+func deletePodNS(ctx context.Context, r *Runtime, pod string) error {
+	return r.executor.Run(ctx, newCommand("ip", "netns", "del", r.netnsName(pod)))
 }
 
-// Start starts the Pod using rkt.  It does not return until
-// the process finishes or ctx is cancelled.
-func (p *Pod) Start(ctx context.Context, r *Runtime, root string) error {
+// setupNetwork creates the network namespace of the Pod with its interfaces.
+func (p *Pod) setupNetwork(ctx context.Context, r *Runtime) error {
 	veths := make([]string, len(p.networks))
 	ips := make(map[string][]string)
+	p.veths = nil
 	for i, n := range p.networks {
-		veth, err := n.CreateVeth()
+		if n.link != nil && n.link.pair {
+			// no host side device.
+			p.veths = append(p.veths, "")
+			continue
+		}
+		veth, err := n.CreateVeth(r)
 		if err != nil {
 			return err
 		}
+		host := strings.TrimSuffix(veth, "_")
+		p.veths = append(p.veths, host)
 		veths[i] = veth
 		ips[veth] = p.Interfaces[i].Addresses
+		if n.link != nil {
+			err = n.link.attach(ctx, r, p.Name, i, host)
+		} else if profile := p.Interfaces[i].Link; profile != nil {
+			err = r.shapeLink(ctx, host, profile)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	err := makePodNS(ctx, p.Name, veths, ips)
+	// the namespace must not be left behind, or the Pod cannot be
+	// restarted.
+	err := makePodNS(ctx, r, p.Name, veths, ips)
 	if err != nil {
+		deletePodNS(context.Background(), r, p.Name)
 		return err
 	}
-	defer deletePodNS(context.Background(), p.Name)
+	for i, n := range p.networks {
+		if n.link != nil && n.link.pair {
+			err := n.link.place(ctx, r, p.Name, i, r.netnsName(p.Name))
+			if err != nil {
+				p.releaseLinks(r)
+				deletePodNS(context.Background(), r, p.Name)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releaseLinks takes the ends of veth pairs of links out of the network
+// namespace of the Pod before it is deleted.
+func (p *Pod) releaseLinks(r *Runtime) {
+	for i, n := range p.networks {
+		if n.link != nil && n.link.pair {
+			n.link.release(r, p.Name, i)
+		}
+	}
+}
 
+func (p *Pod) runInitScripts(ctx context.Context, r *Runtime) error {
 	for _, script := range p.initScripts {
-		err := runInPodNS(ctx, p.Name, script)
+		err := runInPodNS(ctx, r, p.Name, script)
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
+// startRkt starts rkt in the network namespace of the Pod.
+func (p *Pod) startRkt(r *Runtime, root string) (process, error) {
 	params := []string{
 		"--insecure-options=all-run",
 		"run",
@@ -365,23 +451,129 @@ func (p *Pod) Start(ctx context.Context, r *Runtime, root string) error {
 
 	log.Info("rkt run", map[string]interface{}{"name": p.Name, "params": params})
 	args := []string{
-		"netns", "exec", "pm_" + p.Name, "chroot", root, "rkt",
+		"netns", "exec", r.netnsName(p.Name), "chroot", root, "rkt",
 	}
 	args = append(args, params...)
-	rkt := exec.Command("ip", args...)
-	rkt.Stdout = newColoredLogWriter("rkt", p.Name, os.Stdout)
-	rkt.Stderr = newColoredLogWriter("rkt", p.Name, os.Stderr)
-	err = rkt.Start()
+	c := newCommand("ip", args...)
+	c.stdout = newColoredLogWriter("rkt", p.Name, os.Stdout)
+	c.stderr = newColoredLogWriter("rkt", p.Name, os.Stderr)
+
+	// rkt is not bound to a context; it is stopped by SIGTERM.
+	rkt, err := r.executor.Start(context.Background(), c)
 	if err != nil {
 		log.Error("failed to start rkt", map[string]interface{}{
 			log.FnError: err,
 		})
+		return nil, err
+	}
+	if r.dryRun {
+		return rkt, nil
+	}
+
+	err = r.journal.recordProcess("rkt", rkt.Pid())
+	if err != nil {
+		rkt.Kill()
+		rkt.Wait()
+		return nil, err
+	}
+	return rkt, nil
+}
+
+func (p *Pod) setRunning(running bool, pid int) {
+	p.mu.Lock()
+	p.running = running
+	p.pid = pid
+	p.mu.Unlock()
+}
+
+// status returns whether the rkt process is running and its PID.
+func (p *Pod) status() (bool, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running, p.pid
+}
+
+func (p *Pod) incRestarts() {
+	p.mu.Lock()
+	p.restarts++
+	p.mu.Unlock()
+}
+
+// Restarts returns the number of times the Pod has been restarted.
+func (p *Pod) Restarts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.restarts
+}
+
+// IsRunning returns true if the rkt process of the Pod is running.
+func (p *Pod) IsRunning() bool {
+	running, _ := p.status()
+	return running
+}
+
+// forgetVeths removes veths of the Pod from the networks.
+// The veths are deleted along with the network namespace.
+func (p *Pod) forgetVeths() {
+	for i, veth := range p.veths {
+		if veth != "" {
+			p.networks[i].forgetVeth(veth)
+		}
+	}
+	p.veths = nil
+}
+
+// Start starts the Pod using rkt.  It does not return until
+// the process finishes or ctx is cancelled.
+func (p *Pod) Start(ctx context.Context, r *Runtime, root string) error {
+	err := p.setupNetwork(ctx, r)
+	if err != nil {
+		return err
+	}
+	defer deletePodNS(context.Background(), r, p.Name)
+	defer p.releaseLinks(r)
+
+	err = p.runInitScripts(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	rkt, err := p.startRkt(r, root)
+	if err != nil {
 		return err
 	}
+	p.setRunning(true, rkt.Pid())
+	defer p.setRunning(false, 0)
+	r.emit(EventPodStarted, p.Name, map[string]interface{}{
+		"pid": rkt.Pid(),
+	})
+	if r.onPodStarted != nil {
+		r.onPodStarted(p)
+	}
+
+	err = p.wait(ctx, r, rkt)
+	r.emit(EventPodExited, p.Name, map[string]interface{}{
+		"error": errorString(err),
+	})
+	return err
+}
 
-	go func() {
-		<-ctx.Done()
-		rkt.Process.Signal(syscall.SIGTERM)
-	}()
-	return rkt.Wait()
+// wait waits for rkt to exit.  When ctx is cancelled, rkt is sent
+// SIGTERM and killed if it does not stop in time.
+func (p *Pod) wait(ctx context.Context, r *Runtime, rkt process) error {
+	exited := waitProcess(rkt)
+	select {
+	case err := <-exited:
+		return err
+	case <-ctx.Done():
+	}
+
+	rkt.Signal(syscall.SIGTERM)
+	killed, err := killAfter(rkt, exited, r.shutdownTimeout)
+	if killed {
+		log.Warn("pod did not stop in time; killed", map[string]interface{}{
+			"name": p.Name,
+		})
+	}
+	return err
 }
@@ -0,0 +1,422 @@
+package placemat
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/cybozu-go/log"
+)
+
+// clusterDiff is the difference between a running cluster and a new
+// definition of the cluster.  keep* hold the running resources.
+type clusterDiff struct {
+	keepNetworks []*Network
+	addNetworks  []*Network
+	delNetworks  []*Network
+
+	keepImages []*Image
+	addImages  []*Image
+
+	keepFolders []*DataFolder
+	addFolders  []*DataFolder
+	delFolders  []*DataFolder
+
+	keepNodes []*Node
+	addNodes  []*Node
+	delNodes  []*Node
+
+	keepPods []*Pod
+	addPods  []*Pod
+	delPods  []*Pod
+}
+
+func (d *clusterDiff) empty() bool {
+	return len(d.addNetworks) == 0 && len(d.delNetworks) == 0 &&
+		len(d.addImages) == 0 &&
+		len(d.addFolders) == 0 && len(d.delFolders) == 0 &&
+		len(d.addNodes) == 0 && len(d.delNodes) == 0 &&
+		len(d.addPods) == 0 && len(d.delPods) == 0
+}
+
+func changedError(kind, name string) error {
+	return &fieldError{field: "name", value: name, err: errors.New("cannot change " + kind + " live: " + name)}
+}
+
+// nodeSpecEqual compares node specs.  The serial defaults to the one
+// generated from the name as Node.Start does.
+func nodeSpecEqual(a, b *NodeSpec) bool {
+	x, y := *a, *b
+	if x.SMBIOS.Serial == "" {
+		x.SMBIOS.Serial = nodeSerial(x.Name)
+	}
+	if y.SMBIOS.Serial == "" {
+		y.SMBIOS.Serial = nodeSerial(y.Name)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// diffClusters computes changes from cur to next.
+// It returns ErrorList if next contains changes that cannot be applied live.
+func diffClusters(cur, next *Cluster) (*clusterDiff, error) {
+	var errs ErrorList
+	d := new(clusterDiff)
+
+	networks := make(map[string]*Network)
+	for _, n := range next.Networks {
+		networks[n.Name] = n
+	}
+	for _, n := range cur.Networks {
+		nn, ok := networks[n.Name]
+		switch {
+		case !ok && n.typ == NetworkBMC:
+			errs.add(errors.New("cannot remove BMC network live: " + n.Name))
+		case !ok:
+			d.delNetworks = append(d.delNetworks, n)
+		case !reflect.DeepEqual(n.NetworkSpec, nn.NetworkSpec):
+			errs.add(next.wrapError(nn, changedError("network", n.Name)))
+		default:
+			d.keepNetworks = append(d.keepNetworks, n)
+		}
+		delete(networks, n.Name)
+	}
+	for _, n := range next.Networks {
+		if _, ok := networks[n.Name]; !ok {
+			continue
+		}
+		if n.typ == NetworkBMC {
+			errs.add(next.wrapError(n, &fieldError{field: "type", err: errors.New("cannot add BMC network live: " + n.Name)}))
+			continue
+		}
+		d.addNetworks = append(d.addNetworks, n)
+	}
+
+	images := make(map[string]*Image)
+	for _, i := range next.Images {
+		images[i.Name] = i
+	}
+	for _, i := range cur.Images {
+		ni, ok := images[i.Name]
+		switch {
+		case !ok:
+		case !reflect.DeepEqual(i.ImageSpec, ni.ImageSpec):
+			errs.add(next.wrapError(ni, changedError("image", i.Name)))
+		default:
+			d.keepImages = append(d.keepImages, i)
+		}
+		delete(images, i.Name)
+	}
+	for _, i := range next.Images {
+		if _, ok := images[i.Name]; ok {
+			d.addImages = append(d.addImages, i)
+		}
+	}
+
+	folders := make(map[string]*DataFolder)
+	for _, f := range next.DataFolders {
+		folders[f.Name] = f
+	}
+	for _, f := range cur.DataFolders {
+		nf, ok := folders[f.Name]
+		switch {
+		case !ok:
+			d.delFolders = append(d.delFolders, f)
+		case !reflect.DeepEqual(f.DataFolderSpec, nf.DataFolderSpec):
+			errs.add(next.wrapError(nf, changedError("data folder", f.Name)))
+		default:
+			d.keepFolders = append(d.keepFolders, f)
+		}
+		delete(folders, f.Name)
+	}
+	for _, f := range next.DataFolders {
+		if _, ok := folders[f.Name]; ok {
+			d.addFolders = append(d.addFolders, f)
+		}
+	}
+
+	nodes := make(map[string]*Node)
+	for _, n := range next.Nodes {
+		nodes[n.Name] = n
+	}
+	for _, n := range cur.Nodes {
+		nn, ok := nodes[n.Name]
+		switch {
+		case !ok:
+			d.delNodes = append(d.delNodes, n)
+		case !nodeSpecEqual(n.NodeSpec, nn.NodeSpec):
+			errs.add(next.wrapError(nn, changedError("node", n.Name)))
+		default:
+			d.keepNodes = append(d.keepNodes, n)
+		}
+		delete(nodes, n.Name)
+	}
+	for _, n := range next.Nodes {
+		if _, ok := nodes[n.Name]; ok {
+			d.addNodes = append(d.addNodes, n)
+		}
+	}
+
+	pods := make(map[string]*Pod)
+	for _, p := range next.Pods {
+		pods[p.Name] = p
+	}
+	for _, p := range cur.Pods {
+		np, ok := pods[p.Name]
+		switch {
+		case !ok:
+			d.delPods = append(d.delPods, p)
+		case !reflect.DeepEqual(p.PodSpec, np.PodSpec):
+			errs.add(next.wrapError(np, changedError("pod", p.Name)))
+		default:
+			d.keepPods = append(d.keepPods, p)
+		}
+		delete(pods, p.Name)
+	}
+	for _, p := range next.Pods {
+		if _, ok := pods[p.Name]; ok {
+			d.addPods = append(d.addPods, p)
+		}
+	}
+
+	errs.add(diffLinks(cur, next, d))
+
+	if !chaosSchedulesEqual(cur.ChaosSchedules, next.ChaosSchedules) {
+		errs.add(errors.New("cannot change chaos schedules live"))
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return d, nil
+}
+
+// diffLinks checks that links and the nodes and pods connected to them
+// are not changed.  Devices of links are wired when nodes and pods start.
+func diffLinks(cur, next *Cluster, d *clusterDiff) error {
+	var errs ErrorList
+	if len(cur.Links) != len(next.Links) {
+		errs.add(errors.New("cannot change links live"))
+	} else {
+		for i := range cur.Links {
+			if !reflect.DeepEqual(cur.Links[i].LinkSpec, next.Links[i].LinkSpec) {
+				errs.add(next.wrapError(next.Links[i], changedError("link", next.Links[i].Name)))
+			}
+		}
+	}
+
+	links := make(map[string]bool)
+	for _, l := range cur.Links {
+		links[l.Name] = true
+	}
+	for _, n := range append(d.addNodes, d.delNodes...) {
+		for _, iface := range n.Interfaces {
+			if links[iface.Network] {
+				errs.add(errors.New("cannot add or remove node connected to link live: " + n.Name))
+				break
+			}
+		}
+	}
+	for _, p := range append(d.addPods, d.delPods...) {
+		for _, iface := range p.Interfaces {
+			if links[iface.Network] {
+				errs.add(errors.New("cannot add or remove pod connected to link live: " + p.Name))
+				break
+			}
+		}
+	}
+	return errs.errorOrNil()
+}
+
+func chaosSchedulesEqual(a, b []*ChaosSchedule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !reflect.DeepEqual(a[i].ChaosScheduleSpec, b[i].ChaosScheduleSpec) {
+			return false
+		}
+	}
+	return true
+}
+
+// handOverForwarding passes the duty to restore IP forwarding from n
+// to another network using NAT so that removing n does not disable
+// IP forwarding for the others.
+func handOverForwarding(n *Network, networks []*Network) {
+	if !n.v4forwarded && !n.v6forwarded {
+		return
+	}
+	for _, o := range networks {
+		if o == n || !o.UseNAT {
+			continue
+		}
+		o.v4forwarded = o.v4forwarded || n.v4forwarded
+		o.v6forwarded = o.v6forwarded || n.v6forwarded
+		n.v4forwarded = false
+		n.v6forwarded = false
+		return
+	}
+}
+
+// publish replaces the resources of the running cluster with those in state.
+func (s *supervisor) publish(state, next *Cluster) {
+	c := s.cluster
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Networks = state.Networks
+	c.Images = state.Images
+	c.DataFolders = state.DataFolders
+	c.Nodes = state.Nodes
+	c.Pods = state.Pods
+	c.index()
+
+	if c.sources == nil {
+		c.sources = make(map[interface{}]*document)
+	}
+	for res, d := range next.sources {
+		c.sources[res] = d
+	}
+}
+
+// reload applies changes from the running cluster to next.
+func (s *supervisor) reload(next *Cluster) error {
+	c := s.cluster
+	r := s.runtime
+
+	c.mu.RLock()
+	d, err := diffClusters(c, next)
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	// hooks have no state on the host; just replace them.
+	r.setHooks(next.Hooks)
+	c.mu.Lock()
+	c.Hooks = next.Hooks
+	c.mu.Unlock()
+	if d.empty() {
+		log.Info("reload: no changes", nil)
+		return nil
+	}
+	err = next.checkBridgeNames(r, d.addNetworks)
+	if err != nil {
+		return err
+	}
+
+	// resolve new resources with running ones.
+	merged := &Cluster{
+		Networks:    append(append([]*Network{}, d.keepNetworks...), d.addNetworks...),
+		Links:       c.Links,
+		Images:      append(append([]*Image{}, d.keepImages...), d.addImages...),
+		DataFolders: append(append([]*DataFolder{}, d.keepFolders...), d.addFolders...),
+	}
+	err = merged.index()
+	if err != nil {
+		return err
+	}
+	var errs ErrorList
+	for _, n := range d.addNodes {
+		errs.add(next.wrapError(n, n.Resolve(merged)))
+	}
+	errs = errs.unique()
+	for _, p := range d.addPods {
+		errs.add(next.wrapError(p, p.Resolve(merged)))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	state := &Cluster{
+		Networks:    d.keepNetworks,
+		Images:      d.keepImages,
+		DataFolders: d.keepFolders,
+		Nodes:       d.keepNodes,
+		Pods:        d.keepPods,
+	}
+	defer s.publish(state, next)
+
+	for _, p := range d.delPods {
+		s.stopPod(p)
+	}
+	for _, n := range d.delNodes {
+		s.stopNode(n)
+	}
+	for _, n := range d.delNetworks {
+		log.Info("Destroying network", map[string]interface{}{"name": n.Name})
+		handOverForwarding(n, merged.Networks)
+		n.Destroy(r)
+	}
+	for _, df := range d.delFolders {
+		log.Info("removing data folder", map[string]interface{}{
+			"name": df.Name,
+		})
+		err := df.Destroy(r)
+		if err != nil {
+			log.Error("failed to remove data folder", map[string]interface{}{
+				log.FnError: err,
+				"name":      df.Name,
+			})
+		}
+	}
+
+	for _, n := range d.addNetworks {
+		log.Info("Creating network", map[string]interface{}{"name": n.Name})
+		err := n.Create(r)
+		if err != nil {
+			return err
+		}
+		state.Networks = append(state.Networks, n)
+	}
+
+	for _, df := range d.addFolders {
+		log.Info("initializing data folder", map[string]interface{}{
+			"name": df.Name,
+		})
+		err := df.Prepare(s.ctx, r, r.tempDir, r.dataCache)
+		if err != nil {
+			return err
+		}
+		state.DataFolders = append(state.DataFolders, df)
+	}
+
+	for _, img := range d.addImages {
+		log.Info("initializing image resource", map[string]interface{}{
+			"name": img.Name,
+		})
+		err := img.Prepare(s.ctx, r, r.imageCache)
+		if err != nil {
+			return err
+		}
+		state.Images = append(state.Images, img)
+	}
+
+	for _, p := range d.addPods {
+		err := p.Prepare(s.ctx, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, n := range d.addNodes {
+		err := s.startNode(n)
+		if err != nil {
+			return err
+		}
+		state.Nodes = append(state.Nodes, n)
+	}
+
+	for _, p := range d.addPods {
+		s.startPod(p)
+		state.Pods = append(state.Pods, p)
+	}
+
+	log.Info("reloaded cluster", map[string]interface{}{
+		"added_networks":   len(d.addNetworks),
+		"removed_networks": len(d.delNetworks),
+		"added_nodes":      len(d.addNodes),
+		"removed_nodes":    len(d.delNodes),
+		"added_pods":       len(d.addPods),
+		"removed_pods":     len(d.delPods),
+	})
+	return nil
+}
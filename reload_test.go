@@ -0,0 +1,229 @@
+package placemat
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testReadCluster(t *testing.T, yaml string) *Cluster {
+	c, err := ReadYaml(bufio.NewReader(strings.NewReader(yaml)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testDiffClusters(t *testing.T) {
+	t.Parallel()
+
+	cur := testReadCluster(t, `
+kind: Network
+name: net0
+type: internal
+---
+kind: Network
+name: net1
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+---
+kind: Node
+name: node2
+interfaces:
+  - net1
+`)
+	// Node.Start fills the serial.
+	cur.Nodes[0].SMBIOS.Serial = nodeSerial("node1")
+
+	next := testReadCluster(t, `
+kind: Network
+name: net0
+type: internal
+---
+kind: Network
+name: net2
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+---
+kind: Node
+name: node3
+interfaces:
+  - net2
+`)
+
+	d, err := diffClusters(cur, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.keepNetworks) != 1 || d.keepNetworks[0] != cur.Networks[0] {
+		t.Error("net0 should be kept:", d.keepNetworks)
+	}
+	if len(d.delNetworks) != 1 || d.delNetworks[0].Name != "net1" {
+		t.Error("net1 should be removed:", d.delNetworks)
+	}
+	if len(d.addNetworks) != 1 || d.addNetworks[0].Name != "net2" {
+		t.Error("net2 should be added:", d.addNetworks)
+	}
+	if len(d.keepNodes) != 1 || d.keepNodes[0] != cur.Nodes[0] {
+		t.Error("node1 should be kept:", d.keepNodes)
+	}
+	if len(d.delNodes) != 1 || d.delNodes[0].Name != "node2" {
+		t.Error("node2 should be removed:", d.delNodes)
+	}
+	if len(d.addNodes) != 1 || d.addNodes[0].Name != "node3" {
+		t.Error("node3 should be added:", d.addNodes)
+	}
+
+	d, err = diffClusters(cur, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.empty() {
+		t.Error("diff should be empty")
+	}
+}
+
+func testDiffClustersRefused(t *testing.T) {
+	t.Parallel()
+
+	cur := testReadCluster(t, `
+kind: Network
+name: net0
+type: internal
+---
+kind: Network
+name: bmc
+type: bmc
+address: 10.0.0.1/24
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+`)
+
+	next := testReadCluster(t, `
+kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+cpu: 2
+`)
+
+	_, err := diffClusters(cur, next)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	expected := []string{
+		"cannot remove BMC network live: bmc",
+		"line 7: name: cannot change node live: node1",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+}
+
+func testDestroyFolder(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	r := &Runtime{}
+	p := filepath.Join(d, "folder1")
+	err = os.Mkdir(p, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := &DataFolder{
+		DataFolderSpec: &DataFolderSpec{Name: "folder1", Files: []DataFolderFileSpec{{Name: "a", File: "/etc/hostname"}}},
+		dirPath:        p,
+	}
+	err = files.Destroy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Error("prepared folder is not removed:", err)
+	}
+
+	dir := &DataFolder{
+		DataFolderSpec: &DataFolderSpec{Name: "folder2", Dir: d},
+		dirPath:        d,
+	}
+	err = dir.Destroy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(d); err != nil {
+		t.Error("host directory is removed:", err)
+	}
+}
+
+func testDestroyNetworks(t *testing.T) {
+	t.Parallel()
+
+	c := testReadCluster(t, `
+kind: Network
+name: net0
+type: internal
+`)
+	next := testReadCluster(t, `
+kind: Network
+name: net1
+type: internal
+`)
+	r, buf := newDryRunRuntime(t)
+	for _, n := range append(c.Networks, next.Networks...) {
+		err := n.Create(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// net1 is added by reload.
+	s := &supervisor{cluster: c}
+	s.publish(&Cluster{Networks: append(c.Networks, next.Networks...)}, next)
+
+	buf.Reset()
+	c.destroyNetworks(r)
+	expected := "ip link delete net1 type bridge\nip link delete net0 type bridge\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected commands:\n%s", buf.String())
+	}
+}
+
+func TestReload(t *testing.T) {
+	t.Run("Diff", testDiffClusters)
+	t.Run("Refused", testDiffClustersRefused)
+	t.Run("DestroyFolder", testDestroyFolder)
+	t.Run("DestroyNetworks", testDestroyNetworks)
+}
@@ -0,0 +1,83 @@
+package placemat
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	restartBackoffMin   = 1 * time.Second
+	restartBackoffMax   = 1 * time.Minute
+	restartBackoffReset = 1 * time.Minute
+)
+
+// RestartPolicy specifies when a node or a pod is restarted after it exits.
+type RestartPolicy string
+
+// Restart policies.
+const (
+	RestartNever     = RestartPolicy("never")
+	RestartOnFailure = RestartPolicy("on-failure")
+	RestartAlways    = RestartPolicy("always")
+)
+
+func (p RestartPolicy) validate() error {
+	switch p {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+		return nil
+	}
+	return &fieldError{
+		field: "restart-policy",
+		value: string(p),
+		err:   errors.New("invalid restart policy: " + string(p)),
+	}
+}
+
+// shouldRestart returns true if the process that exited with err
+// should be restarted.  The empty policy is the same as "never".
+func (p RestartPolicy) shouldRestart(err error) bool {
+	switch p {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+// backoff computes exponentially increasing delays between restarts.
+//
+// The delay is reset if the process has been running long enough.
+type backoff struct {
+	delay   time.Duration
+	started time.Time
+}
+
+// start records the time when the process has started.
+func (b *backoff) start() {
+	b.started = time.Now()
+}
+
+// wait waits before restarting the process.
+// It returns false if ctx is cancelled while waiting.
+func (b *backoff) wait(ctx context.Context) bool {
+	if time.Since(b.started) >= restartBackoffReset {
+		b.delay = 0
+	}
+	if b.delay == 0 {
+		b.delay = restartBackoffMin
+	} else {
+		b.delay *= 2
+		if b.delay > restartBackoffMax {
+			b.delay = restartBackoffMax
+		}
+	}
+
+	select {
+	case <-time.After(b.delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
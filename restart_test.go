@@ -0,0 +1,187 @@
+package placemat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/cmd"
+)
+
+func testRestartPolicy(t *testing.T) {
+	t.Parallel()
+
+	failure := errors.New("exit status 1")
+	cases := []struct {
+		policy  RestartPolicy
+		err     error
+		restart bool
+	}{
+		{"", nil, false},
+		{"", failure, false},
+		{RestartNever, failure, false},
+		{RestartOnFailure, nil, false},
+		{RestartOnFailure, failure, true},
+		{RestartAlways, nil, true},
+		{RestartAlways, failure, true},
+	}
+	for _, c := range cases {
+		if c.policy.shouldRestart(c.err) != c.restart {
+			t.Errorf("policy %q, err %v: expected %v", c.policy, c.err, c.restart)
+		}
+	}
+
+	if RestartPolicy("sometimes").validate() == nil {
+		t.Error("invalid policy should be rejected")
+	}
+}
+
+func testBackoff(t *testing.T) {
+	t.Parallel()
+
+	var b backoff
+	b.start()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expected := []time.Duration{
+		restartBackoffMin,
+		restartBackoffMin * 2,
+		restartBackoffMin * 4,
+	}
+	for _, d := range expected {
+		if b.wait(ctx) {
+			t.Error("wait should return false for cancelled context")
+		}
+		if b.delay != d {
+			t.Errorf("expected %v, actual %v", d, b.delay)
+		}
+	}
+
+	b.delay = restartBackoffMax
+	b.wait(ctx)
+	if b.delay != restartBackoffMax {
+		t.Error("delay should not exceed the maximum:", b.delay)
+	}
+
+	b.started = time.Now().Add(-restartBackoffReset)
+	b.wait(ctx)
+	if b.delay != restartBackoffMin {
+		t.Error("delay should be reset:", b.delay)
+	}
+}
+
+func testNodeExited(t *testing.T) {
+	t.Parallel()
+
+	yaml := `
+kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+smbios:
+  serial: abc
+restart-policy: never
+`
+	cluster, err := ReadYaml(bufio.NewReader(strings.NewReader(yaml)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := newDryRunRuntime(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env := cmd.NewEnvironment(ctx)
+	bmc := newBMCServer(r, cluster.Networks, nil)
+	s := newSupervisor(ctx, env, cluster, r, r.runDir, bmc, nil)
+
+	// QEMU in dry-run exits immediately with success.
+	n := cluster.Nodes[0]
+	err = s.startNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt := s.nodes[n.Name]
+	<-nt.done
+
+	vm := nt.getVM()
+	if vm.IsRunning() {
+		t.Error("VM should not be running after QEMU exited")
+	}
+	if vm.PowerOn() == nil || vm.IsRunning() {
+		t.Error("exited VM should not be powered on")
+	}
+	st := newAPIServer(cluster, r, bmc).nodeStatus(n)
+	if st.Running || st.PID != 0 {
+		t.Errorf("exited VM should be reported as stopped: %+v", st)
+	}
+
+	// cleanup runs once even if the node is stopped afterwards.
+	var count int
+	vm.cleanup = func() { count++ }
+	s.stopNode(n)
+	if count != 0 {
+		t.Error("cleanup should not run again:", count)
+	}
+}
+
+// failingExecutor fails commands that contain arg.
+type failingExecutor struct {
+	executor
+	arg string
+}
+
+func (e failingExecutor) Run(ctx context.Context, c command) error {
+	for _, a := range c.args {
+		if a == e.arg {
+			return errors.New("failed: " + c.name)
+		}
+	}
+	return e.executor.Run(ctx, c)
+}
+
+func testPodNetnsCleanup(t *testing.T) {
+	t.Parallel()
+
+	c := testReadCluster(t, `
+kind: Network
+name: net0
+type: internal
+---
+kind: Pod
+name: pod1
+interfaces:
+  - network: net0
+apps:
+  - name: bird
+    image: docker://quay.io/cybozu/bird:2.0
+`)
+	r, buf := newDryRunRuntime(t)
+	r.executor = failingExecutor{executor: r.executor, arg: "sysctl"}
+
+	err := c.Pods[0].setupNetwork(context.Background(), r)
+	if err == nil {
+		t.Fatal("setupNetwork should fail")
+	}
+	if !strings.HasSuffix(buf.String(), "ip netns del pm_pod1\n") {
+		t.Errorf("network namespace is not deleted:\n%s", buf.String())
+	}
+}
+
+func TestRestart(t *testing.T) {
+	t.Run("Policy", testRestartPolicy)
+	t.Run("Backoff", testBackoff)
+	t.Run("NodeExited", testNodeExited)
+	t.Run("PodNetnsCleanup", testPodNetnsCleanup)
+}
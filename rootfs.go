@@ -1,9 +1,9 @@
 package placemat
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -29,12 +29,22 @@ var (
 	}
 )
 
-func umount(mp string) error {
-	return exec.Command("umount", mp).Run()
+func umount(r *Runtime, mp string) error {
+	c := newCommand("umount", mp)
+	c.severity = log.LvDebug
+	return r.executor.Run(context.Background(), c)
 }
 
-func bindMount(src, dest string) error {
-	err := os.MkdirAll(dest, 0755)
+func mkdirMountPoint(r *Runtime, dest string) error {
+	if r.dryRun {
+		r.note("mkdir -p %s", dest)
+		return nil
+	}
+	return os.MkdirAll(dest, 0755)
+}
+
+func bindMount(r *Runtime, src, dest string) error {
+	err := mkdirMountPoint(r, dest)
 	if err != nil {
 		return err
 	}
@@ -42,14 +52,15 @@ func bindMount(src, dest string) error {
 		"src":  src,
 		"dest": dest,
 	})
-	c := exec.Command("mount", "--bind", src, dest)
-	c.Stderr = os.Stderr
-	c.Stdout = os.Stdout
-	return c.Run()
+	c := newCommand("mount", "--bind", src, dest)
+	c.severity = log.LvDebug
+	c.stderr = os.Stderr
+	c.stdout = os.Stdout
+	return r.executor.Run(context.Background(), c)
 }
 
-func mount(fs, dest, options string) error {
-	err := os.MkdirAll(dest, 0755)
+func mount(r *Runtime, fs, dest, options string) error {
+	err := mkdirMountPoint(r, dest)
 	if err != nil {
 		return err
 	}
@@ -57,13 +68,14 @@ func mount(fs, dest, options string) error {
 		"fs":   fs,
 		"dest": dest,
 	})
-	c := exec.Command("mount", "-t", fs, "-o", options, fs, dest)
-	c.Stderr = os.Stderr
-	c.Stdout = os.Stdout
-	return c.Run()
+	c := newCommand("mount", "-t", fs, "-o", options, fs, dest)
+	c.severity = log.LvDebug
+	c.stderr = os.Stderr
+	c.stdout = os.Stdout
+	return r.executor.Run(context.Background(), c)
 }
 
-func makeCgroupSymlinks(dest string, opts []string) error {
+func makeCgroupSymlinks(r *Runtime, dest string, opts []string) error {
 	ctrls := make([]string, 0, 3)
 	for _, opt := range opts {
 		if cgroupV1ctrls[opt] {
@@ -85,6 +97,10 @@ func makeCgroupSymlinks(dest string, opts []string) error {
 			continue
 		}
 
+		if r.dryRun {
+			r.note("ln -s %s %s", base, sym)
+			continue
+		}
 		err = os.Symlink(base, sym)
 		if err != nil {
 			return err
@@ -100,6 +116,7 @@ func makeCgroupSymlinks(dest string, opts []string) error {
 type Rootfs struct {
 	root        string
 	mountPoints []string
+	runtime     *Runtime
 }
 
 // Path returns the absolute filesystem path to the fake rootfs.
@@ -113,7 +130,7 @@ func (r *Rootfs) Destroy() error {
 
 	l := len(r.mountPoints)
 	for i := 0; i < l; i++ {
-		e := umount(r.mountPoints[l-i-1])
+		e := umount(r.runtime, r.mountPoints[l-i-1])
 		if e != nil {
 			err = e
 		}
@@ -127,11 +144,19 @@ func (r *Rootfs) Destroy() error {
 		return err
 	}
 
+	if r.runtime.dryRun {
+		r.runtime.note("rmdir %s", r.root)
+		return nil
+	}
 	return os.RemoveAll(r.root)
 }
 
 // NewRootfs creates a new root filesystem.
 func NewRootfs() (*Rootfs, error) {
+	return newRootfs(&Runtime{executor: hostExecutor{}})
+}
+
+func newRootfs(r *Runtime) (*Rootfs, error) {
 	f, err := os.Open("/proc/mounts")
 	if err != nil {
 		return nil, err
@@ -142,12 +167,25 @@ func NewRootfs() (*Rootfs, error) {
 		return nil, err
 	}
 
-	root, err := ioutil.TempDir("/", "placemat-root")
+	var root string
+	if r.dryRun {
+		root = "/placemat-root"
+	} else {
+		root, err = ioutil.TempDir("/", "placemat-root")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = r.journal.recordUndo("directory", root, []string{"rmdir", root})
 	if err != nil {
 		return nil, err
 	}
 
-	err = bindMount("/", root)
+	err = r.journal.recordUndo("mount", root, []string{"umount", root})
+	if err != nil {
+		return nil, err
+	}
+	err = bindMount(r, "/", root)
 	if err != nil {
 		return nil, err
 	}
@@ -156,7 +194,7 @@ func NewRootfs() (*Rootfs, error) {
 	defer func() {
 		l := len(mountPoints)
 		for i := 0; i < l; i++ {
-			umount(mountPoints[l-i-1])
+			umount(r, mountPoints[l-i-1])
 		}
 	}()
 
@@ -197,9 +235,18 @@ func NewRootfs() (*Rootfs, error) {
 			options = strings.Join(opts, ",")
 		}
 
+		switch fs {
+		case "autofs", "pstore", "efivarfs", "fuse.lxcfs":
+		default:
+			err = r.journal.recordUndo("mount", dest, []string{"umount", dest})
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		switch fs {
 		case "tmpfs", "proc", "sysfs", "securityfs", "cgroup", "cgroup2", "debugfs", "fusectl", "configfs":
-			err = mount(fs, dest, options)
+			err = mount(r, fs, dest, options)
 			if err != nil {
 				return nil, err
 			}
@@ -209,7 +256,7 @@ func NewRootfs() (*Rootfs, error) {
 			// ignore
 
 		default:
-			err = bindMount(mp, dest)
+			err = bindMount(r, mp, dest)
 			if err != nil {
 				return nil, err
 			}
@@ -217,14 +264,14 @@ func NewRootfs() (*Rootfs, error) {
 		}
 
 		if fs == "cgroup" {
-			err = makeCgroupSymlinks(dest, opts)
+			err = makeCgroupSymlinks(r, dest, opts)
 			if err != nil {
 				return nil, err
 			}
 		}
 	}
 
-	ret := &Rootfs{root, mountPoints}
+	ret := &Rootfs{root, mountPoints, r}
 	mountPoints = nil
 	return ret, nil
 }
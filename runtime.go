@@ -2,11 +2,17 @@ package placemat
 
 import (
 	"bufio"
+	"crypto/sha1"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cybozu-go/log"
 )
@@ -40,18 +46,167 @@ type Runtime struct {
 	imageCache *cache
 	dataCache  *cache
 	tempDir    string
+	journal    *journal
+	executor   executor
+	dryRun     bool
+	loader     func() (*Cluster, error)
+	events     *eventWriter
+
+	metricsAddr     string
+	shutdownTimeout time.Duration
+	clusterName     string
+	seed            string
+
+	consoleLogSize    int64
+	consoleLogBackups int
+
+	onNetworkCreated func(*Network)
+	onNodeStarted    func(*NodeVM)
+	onBMCRegistered  func(serial, addr string)
+	onPodStarted     func(*Pod)
+	ready            chan<- struct{}
+	readyOnce        sync.Once
+
+	hooksMu sync.Mutex
+	hooks   []*Hook
+
+	faults faultSet
 }
 
-// NewRuntime initializes a new Runtime.
-func NewRuntime(graphic bool, runDir, dataDir, cacheDir string) (*Runtime, error) {
+// DefaultShutdownTimeout is the default time to wait for VMs and pods
+// to shut down gracefully.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// RuntimeOptions are options to create Runtime.
+type RuntimeOptions struct {
+	// Graphic runs QEMU with graphical console.
+	Graphic bool
+	// RunDir is the directory for sockets and the journal.
+	RunDir string
+	// DataDir is the directory to store volumes and temporary files.
+	DataDir string
+	// CacheDir is the directory to cache downloaded images and files.
+	CacheDir string
+
+	// ClusterName namespaces host-global resources, i.e. bridges, tap and
+	// veth devices, network namespaces of pods, and iptables chains, so
+	// that multiple clusters can run on a host.  It must consist of lower
+	// case letters and digits, start with a letter, and be at most 8
+	// characters long.  RunDir and DataDir are used as given; give
+	// different ones to each cluster.  The placemat command does so by
+	// appending the cluster name to them.
+	ClusterName string
+
+	// Seed is mixed into MAC addresses derived for node interfaces.
+	// Give different seeds to clusters that share networks so that
+	// their MAC addresses do not collide.
+	Seed string
+
+	// ShutdownTimeout is the time to wait for VMs and pods to shut down
+	// gracefully when the cluster stops.  After the timeout, they are
+	// killed.  If zero, DefaultShutdownTimeout is used.
+	ShutdownTimeout time.Duration
+
+	// ConsoleLogSize is the size in bytes at which the log file of
+	// a serial console is rotated.  If zero, DefaultConsoleLogSize is used.
+	ConsoleLogSize int64
+	// ConsoleLogBackups is the number of rotated log files to keep for
+	// each serial console.  If zero, DefaultConsoleLogBackups is used.
+	ConsoleLogBackups int
+
+	// MetricsAddr is the address to serve Prometheus metrics while the
+	// cluster is running.  If empty, metrics are not served.
+	MetricsAddr string
+
+	// Loader reads the cluster definition again.  The control API calls
+	// it to reload the running cluster.
+	Loader func() (*Cluster, error)
+
+	// EventWriters are destinations of lifecycle events.  Events are
+	// written as JSON objects, one per line.
+	EventWriters []io.Writer
+
+	// The following hooks are called when resources get ready, including
+	// those added by reloading.  They are called synchronously from the
+	// goroutine that started the resource, so they should return quickly.
+	// In dry-run mode, they are called as the commands are printed.
+
+	// OnNetworkCreated is called when a network is created.
+	OnNetworkCreated func(*Network)
+	// OnNodeStarted is called when QEMU of a node is started.
+	OnNodeStarted func(*NodeVM)
+	// OnBMCRegistered is called when the BMC address of a node is
+	// registered and its IPMI port is listening.
+	OnBMCRegistered func(serial, addr string)
+	// OnPodStarted is called when a pod is started.
+	OnPodStarted func(*Pod)
+
+	// Ready is closed when all the resources of the cluster are started.
+	// It is not closed if Cluster.Start fails before that.
+	Ready chan<- struct{}
+}
+
+// newRuntime creates a Runtime with settings common to NewRuntime and
+// NewDryRunRuntime.
+func newRuntime(opts *RuntimeOptions) (*Runtime, error) {
 	r := &Runtime{
-		graphic: graphic,
-		runDir:  runDir,
-		dataDir: dataDir,
+		graphic:     opts.Graphic,
+		runDir:      opts.RunDir,
+		dataDir:     opts.DataDir,
+		loader:      opts.Loader,
+		metricsAddr: opts.MetricsAddr,
+		seed:        opts.Seed,
+
+		shutdownTimeout: opts.ShutdownTimeout,
+
+		consoleLogSize:    opts.ConsoleLogSize,
+		consoleLogBackups: opts.ConsoleLogBackups,
+
+		onNetworkCreated: opts.OnNetworkCreated,
+		onNodeStarted:    opts.OnNodeStarted,
+		onBMCRegistered:  opts.OnBMCRegistered,
+		onPodStarted:     opts.OnPodStarted,
+		ready:            opts.Ready,
+	}
+	if r.shutdownTimeout == 0 {
+		r.shutdownTimeout = DefaultShutdownTimeout
+	}
+	if r.consoleLogSize == 0 {
+		r.consoleLogSize = DefaultConsoleLogSize
+	}
+	if r.consoleLogBackups == 0 {
+		r.consoleLogBackups = DefaultConsoleLogBackups
+	}
+	for _, w := range opts.EventWriters {
+		if r.events == nil {
+			r.events = new(eventWriter)
+		}
+		r.events.add(w)
 	}
 
 	r.ng.prefix = "pm"
+	if opts.ClusterName != "" {
+		name := opts.ClusterName
+		if len(name) > maxClusterNameLen || !clusterNamePattern.MatchString(name) {
+			return nil, errors.New("invalid cluster name: " + name)
+		}
+		r.clusterName = name
+		r.ng.prefix = "pm" + name + "-"
+	}
+	return r, nil
+}
 
+// NewRuntime initializes a new Runtime.
+// Directories given by opts are created if they do not exist.
+func NewRuntime(opts *RuntimeOptions) (*Runtime, error) {
+	r, err := newRuntime(opts)
+	if err != nil {
+		return nil, err
+	}
+	r.executor = hostExecutor{}
+
+	cacheDir := opts.CacheDir
+	dataDir := opts.DataDir
 	fi, err := os.Stat(cacheDir)
 	switch {
 	case err == nil:
@@ -130,6 +285,81 @@ func NewRuntime(graphic bool, runDir, dataDir, cacheDir string) (*Runtime, error
 	return r, nil
 }
 
+// NewDryRunRuntime initializes a Runtime for dry-run mode.
+//
+// Cluster.Start with the returned Runtime prints commands to w instead of
+// running them, and returns after printing the commands to construct and
+// destroy the cluster.  Unlike NewRuntime, this does not create directories.
+func NewDryRunRuntime(w io.Writer, opts *RuntimeOptions) (*Runtime, error) {
+	r, err := newRuntime(opts)
+	if err != nil {
+		return nil, err
+	}
+	r.imageCache = &cache{dir: filepath.Join(opts.CacheDir, "image_cache")}
+	r.dataCache = &cache{dir: filepath.Join(opts.CacheDir, "data_cache")}
+	r.tempDir = filepath.Join(opts.DataDir, "temp", "dry-run")
+	r.executor = &dryRunExecutor{w: w}
+	r.dryRun = true
+	return r, nil
+}
+
+// note records an operation done without external commands in the
+// dry-run output.  It does nothing unless r is in dry-run mode.
+func (r *Runtime) note(format string, args ...interface{}) {
+	if e, ok := r.executor.(*dryRunExecutor); ok {
+		e.note(format, args...)
+	}
+}
+
+// maxClusterNameLen is the maximum length of a cluster name.
+// Names of generated devices must fit in IFNAMSIZ.
+const maxClusterNameLen = 8
+
+var clusterNamePattern = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+// bridgeName returns the name of the bridge for a network.
+func (r *Runtime) bridgeName(network string) string {
+	if r.clusterName == "" {
+		return network
+	}
+	return r.clusterName + "-" + network
+}
+
+// natChain returns the name of iptables chains for NAT.
+func (r *Runtime) natChain() string {
+	if r.clusterName == "" {
+		return "PLACEMAT"
+	}
+	return "PLACEMAT-" + r.clusterName
+}
+
+// nodeMAC derives the MAC address of the i-th interface of a node from
+// the seed, the cluster name, the node name, and i.  The address is in
+// the locally administered range beginning with QEMU's "52:54".
+func (r *Runtime) nodeMAC(node string, i int) string {
+	h := sha1.Sum([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%d", r.seed, r.clusterName, node, i)))
+	return fmt.Sprintf("52:54:%02x:%02x:%02x:%02x", h[0], h[1], h[2], h[3])
+}
+
+// netnsName returns the name of the network namespace for a pod.
+func (r *Runtime) netnsName(pod string) string {
+	return "pm" + r.clusterName + "_" + pod
+}
+
+// emit sends a lifecycle event to the event writers.
+func (r *Runtime) emit(typ EventType, name string, fields map[string]interface{}) {
+	r.events.emit(typ, name, fields)
+}
+
+// setReady closes the Ready channel given by RuntimeOptions.
+func (r *Runtime) setReady() {
+	r.readyOnce.Do(func() {
+		if r.ready != nil {
+			close(r.ready)
+		}
+	})
+}
+
 func (r *Runtime) nameGenerator() *nameGenerator {
 	return &r.ng
 }
@@ -138,6 +368,26 @@ func (r *Runtime) socketPath(host string) string {
 	return filepath.Join(r.runDir, host+".socket")
 }
 
+func (r *Runtime) serialSocketPath(host string) string {
+	return filepath.Join(r.runDir, host+".serial")
+}
+
+func (r *Runtime) consoleLogPath(host string) string {
+	return filepath.Join(r.dataDir, "console", host+".log")
+}
+
+// ConsoleSocketPath returns the path of the UNIX domain socket to connect
+// to the serial console of a node.  placemat-connect connects to it.
+func (r *Runtime) ConsoleSocketPath(node string) string {
+	return r.socketPath(node)
+}
+
+// ConsoleLogPath returns the path of the log file of the serial console
+// of a node.  Rotated files have suffixes ".1", ".2", and so on.
+func (r *Runtime) ConsoleLogPath(node string) string {
+	return r.consoleLogPath(node)
+}
+
 func (r *Runtime) monitorSocketPath(host string) string {
 	return filepath.Join(r.runDir, host+".monitor")
 }
@@ -146,6 +396,14 @@ func (r *Runtime) guestSocketPath(host string) string {
 	return filepath.Join(r.runDir, host+".guest")
 }
 
+func (r *Runtime) apiSocketPath() string {
+	return filepath.Join(r.runDir, "placemat-api.socket")
+}
+
+func (r *Runtime) volumeDir(host string) string {
+	return filepath.Join(r.dataDir, "volumes", host)
+}
+
 func (r *Runtime) nvramPath(host string) string {
 	return filepath.Join(r.dataDir, "nvram", host+".fd")
 }
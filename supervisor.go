@@ -0,0 +1,328 @@
+package placemat
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/cybozu-go/cmd"
+	"github.com/cybozu-go/log"
+)
+
+// task is a goroutine that runs a node or a pod.
+type task struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// stop cancels the task and waits for it.
+func (t *task) stop() {
+	t.cancel()
+	<-t.done
+}
+
+// nodeTask is a task to run a node.
+type nodeTask struct {
+	*task
+
+	mu sync.Mutex
+	vm *NodeVM
+}
+
+func (t *nodeTask) setVM(vm *NodeVM) {
+	t.mu.Lock()
+	t.vm = vm
+	t.mu.Unlock()
+}
+
+func (t *nodeTask) getVM() *NodeVM {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.vm
+}
+
+type reloadRequest struct {
+	cluster *Cluster
+	result  chan<- error
+}
+
+// supervisor runs nodes and pods of a started Cluster.
+//
+// Each node and pod runs in its own task so that it can be stopped
+// individually when the cluster is reloaded.
+type supervisor struct {
+	ctx     context.Context
+	env     *cmd.Environment
+	cluster *Cluster
+	runtime *Runtime
+	root    string
+	bmc     *bmcServer
+	nodeCh  chan<- bmcInfo
+
+	mu    sync.Mutex
+	nodes map[string]*nodeTask // key: node name
+	pods  map[string]*task     // key: pod name
+	wg    sync.WaitGroup
+
+	reloadCh chan reloadRequest
+	exited   chan struct{}
+}
+
+// newSupervisor creates a supervisor.
+// Tasks are bound to ctx; if a task fails, env is cancelled.
+func newSupervisor(ctx context.Context, env *cmd.Environment, c *Cluster, r *Runtime, root string, bmc *bmcServer, nodeCh chan<- bmcInfo) *supervisor {
+	s := &supervisor{
+		ctx:      ctx,
+		env:      env,
+		cluster:  c,
+		runtime:  r,
+		root:     root,
+		bmc:      bmc,
+		nodeCh:   nodeCh,
+		nodes:    make(map[string]*nodeTask),
+		pods:     make(map[string]*task),
+		reloadCh: make(chan reloadRequest),
+		exited:   make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	c.supervisor = s
+	c.mu.Unlock()
+	return s
+}
+
+// spawn starts f in a new task.
+// Errors are ignored once the task is stopped or the cluster is shutting down.
+func (s *supervisor) spawn(f func(ctx context.Context) error) *task {
+	ctx, cancel := context.WithCancel(s.ctx)
+	t := &task{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(t.done)
+		err := f(ctx)
+		if err != nil && ctx.Err() == nil {
+			s.env.Cancel(err)
+		}
+	}()
+	return t
+}
+
+// startNode starts a QEMU process for the node.
+// QEMU is restarted according to the restart policy of the node.
+// When the task is stopped, the guest is shut down gracefully.
+func (s *supervisor) startNode(n *Node) error {
+	params, err := n.prepare(s.ctx, s.runtime)
+	if err != nil {
+		return err
+	}
+
+	vm, err := n.launch(s.ctx, s.runtime, params, s.nodeCh)
+	if err != nil || vm == nil {
+		return err
+	}
+	s.bmc.registerVM(n.SMBIOS.Serial, vm)
+	n.setLinkVM(vm)
+
+	nt := &nodeTask{vm: vm}
+	nt.task = s.spawn(func(tctx context.Context) error {
+		var b backoff
+		b.start()
+		for {
+			waitCh := waitProcess(vm.proc)
+			var err error
+			select {
+			case <-tctx.Done():
+				killed := vm.shutdown(s.runtime.shutdownTimeout, waitCh)
+				if killed {
+					log.Warn("VM did not shut down in time; killed", map[string]interface{}{
+						"name": n.Name,
+					})
+				}
+				s.runtime.emit(EventVMExited, n.Name, map[string]interface{}{
+					"killed": killed,
+				})
+				return nil
+			case err = <-waitCh:
+			}
+			s.runtime.emit(EventVMExited, n.Name, map[string]interface{}{
+				"error": errorString(err),
+			})
+			vm.release()
+
+			for {
+				if !n.RestartPolicy.shouldRestart(err) {
+					return err
+				}
+				log.Warn("QEMU exited; restarting", map[string]interface{}{
+					"name":      n.Name,
+					log.FnError: errorString(err),
+				})
+				if !b.wait(tctx) {
+					return nil
+				}
+
+				vm, err = n.launch(tctx, s.runtime, params, s.nodeCh)
+				if err == nil && vm == nil {
+					return nil
+				}
+				if err == nil {
+					break
+				}
+			}
+
+			b.start()
+			n.incRestarts()
+			nt.setVM(vm)
+			s.bmc.registerVM(n.SMBIOS.Serial, vm)
+			n.setLinkVM(vm)
+		}
+	})
+
+	s.mu.Lock()
+	s.nodes[n.Name] = nt
+	s.mu.Unlock()
+	return nil
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// stopNode kills the QEMU process of the node and removes the resources
+// created for it, except for volumes.
+func (s *supervisor) stopNode(n *Node) {
+	s.mu.Lock()
+	t, ok := s.nodes[n.Name]
+	delete(s.nodes, n.Name)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Info("stopping node", map[string]interface{}{
+		"name": n.Name,
+	})
+	t.stop()
+	t.getVM().release()
+	s.bmc.removeNode(n.SMBIOS.Serial)
+	n.deleteTaps(s.runtime)
+}
+
+// startPod starts the pod.
+// The pod is restarted according to its restart policy.
+func (s *supervisor) startPod(p *Pod) {
+	t := s.spawn(func(ctx context.Context) error {
+		var b backoff
+		for {
+			b.start()
+			err := p.Start(ctx, s.runtime, s.root)
+			// veths are deleted along with the network namespace.
+			p.forgetVeths()
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !p.RestartPolicy.shouldRestart(err) {
+				return err
+			}
+
+			log.Warn("pod exited; restarting", map[string]interface{}{
+				"name":      p.Name,
+				log.FnError: errorString(err),
+			})
+			if !b.wait(ctx) {
+				return nil
+			}
+			p.incRestarts()
+		}
+	})
+
+	s.mu.Lock()
+	s.pods[p.Name] = t
+	s.mu.Unlock()
+}
+
+// stopPod stops the pod and deletes its network namespace.
+func (s *supervisor) stopPod(p *Pod) {
+	s.mu.Lock()
+	t, ok := s.pods[p.Name]
+	delete(s.pods, p.Name)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Info("stopping pod", map[string]interface{}{
+		"name": p.Name,
+	})
+	t.stop()
+}
+
+// stopAll stops all the tasks.
+func (s *supervisor) stopAll() {
+	s.cluster.mu.Lock()
+	s.cluster.supervisor = nil
+	s.cluster.mu.Unlock()
+
+	s.mu.Lock()
+	for _, t := range s.pods {
+		t.cancel()
+	}
+	for _, t := range s.nodes {
+		t.cancel()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.nodes {
+		t.getVM().release()
+	}
+}
+
+// run serves reload requests until ctx is cancelled.
+func (s *supervisor) run(ctx context.Context) error {
+	defer close(s.exited)
+
+	for {
+		select {
+		case req := <-s.reloadCh:
+			req.result <- s.reload(req.cluster)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Reload applies changes in next to the running cluster.
+//
+// Resources added in next are created, and resources removed in next
+// are destroyed.  Other resources are kept running.  Changes that cannot
+// be applied live, such as modifying the spec of an existing resource,
+// are refused and nothing is changed.  next must be resolved.
+func (c *Cluster) Reload(ctx context.Context, next *Cluster) error {
+	c.mu.RLock()
+	s := c.supervisor
+	c.mu.RUnlock()
+	if s == nil {
+		return errors.New("cluster is not running")
+	}
+
+	ch := make(chan error, 1)
+	select {
+	case s.reloadCh <- reloadRequest{cluster: next, result: ch}:
+	case <-s.exited:
+		return errors.New("cluster is not running")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-ch
+}
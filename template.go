@@ -0,0 +1,340 @@
+package placemat
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const maxIncludeDepth = 16
+
+// origin is the location of a line in a source file.
+type origin struct {
+	file string
+	line int
+}
+
+// srcLine is a line rendered from a template with its origin.
+type srcLine struct {
+	text string
+	origin
+}
+
+// variablesSpec represents a Variables document in YAML.
+type variablesSpec struct {
+	Kind      string            `yaml:"kind"`
+	Variables map[string]string `yaml:"variables"`
+}
+
+// envPrefix is the prefix of references to environment variables.
+const envPrefix = "env."
+
+// condition is the state of an "#@if" directive.
+type condition struct {
+	origin
+	parent bool // true if the enclosing block is active
+	active bool // true if the current branch is active
+	done   bool // true if a branch has been taken
+	inElse bool
+}
+
+// preprocessor renders YAML templates.
+//
+// Templates are YAML files with variable references "${name}" and
+// directives in comment lines beginning with "#@":
+//
+//	#@include PATH
+//	#@if EXPR
+//	#@elif EXPR
+//	#@else
+//	#@end
+//
+// EXPR is "VALUE", "!VALUE", "VALUE == VALUE", or "VALUE != VALUE"
+// after variables are replaced.  A single VALUE is false if it is
+// empty, "0", or "false".  "$${" is rendered as "${".
+//
+// Variables are looked up in the order of vars given to the
+// preprocessor and "kind: Variables" documents read so far.
+// Environment variables are referred to as "${env.NAME}".
+type preprocessor struct {
+	override map[string]string
+	vars     map[string]string
+
+	out      []srcLine
+	docStart int // index in out of the first line of the current document
+	includes []string
+	errs     ErrorList
+}
+
+func newPreprocessor(vars map[string]string) *preprocessor {
+	return &preprocessor{
+		override: vars,
+		vars:     make(map[string]string),
+	}
+}
+
+func (p *preprocessor) error(o origin, err error) {
+	p.errs.add(&SourceError{File: o.file, Line: o.line, Err: err})
+}
+
+func (p *preprocessor) lookup(name string) (string, bool) {
+	if strings.HasPrefix(name, envPrefix) {
+		return os.LookupEnv(name[len(envPrefix):])
+	}
+	if v, ok := p.override[name]; ok {
+		return v, true
+	}
+	if v, ok := p.vars[name]; ok {
+		return v, true
+	}
+	return "", false
+}
+
+// expand replaces variable references in s.
+func (p *preprocessor) expand(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var buf strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i == -1 {
+			buf.WriteString(s)
+			return buf.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			buf.WriteString(s[:i-1])
+			buf.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		buf.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end == -1 {
+			return "", errors.New("unterminated variable reference")
+		}
+		name := strings.TrimSpace(s[i+2 : i+end])
+		v, ok := p.lookup(name)
+		if !ok {
+			return "", errors.New("undefined variable: " + name)
+		}
+		buf.WriteString(v)
+		s = s[i+end+1:]
+	}
+}
+
+func truthy(s string) bool {
+	s = strings.TrimSpace(s)
+	return s != "" && s != "0" && s != "false"
+}
+
+// eval evaluates an expression of "#@if" or "#@elif".
+func (p *preprocessor) eval(expr string) (bool, error) {
+	expr, err := p.expand(expr)
+	if err != nil {
+		return false, err
+	}
+	if i := strings.Index(expr, "=="); i != -1 {
+		return strings.TrimSpace(expr[:i]) == strings.TrimSpace(expr[i+2:]), nil
+	}
+	if i := strings.Index(expr, "!="); i != -1 {
+		return strings.TrimSpace(expr[:i]) != strings.TrimSpace(expr[i+2:]), nil
+	}
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "!") {
+		return !truthy(expr[1:]), nil
+	}
+	return truthy(expr), nil
+}
+
+func isDocumentSeparator(line string) bool {
+	return line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "---\t")
+}
+
+// endDocument is called at the end of each rendered document.
+// If the document is a Variables document, the variables are defined
+// and the document is removed from the output.
+func (p *preprocessor) endDocument() {
+	lines := p.out[p.docStart:]
+	if len(lines) == 0 {
+		return
+	}
+	var buf strings.Builder
+	for _, l := range lines {
+		buf.WriteString(l.text)
+		buf.WriteByte('\n')
+	}
+
+	var base baseConfig
+	if yaml.Unmarshal([]byte(buf.String()), &base) != nil || base.Kind != "Variables" {
+		return
+	}
+
+	d := newDocument(lines)
+	var spec variablesSpec
+	err := yaml.UnmarshalStrict(d.data, &spec)
+	if err != nil {
+		p.errs.add(d.wrap(err))
+	}
+	for k, v := range spec.Variables {
+		p.vars[k] = v
+	}
+	p.out = p.out[:p.docStart]
+}
+
+// include renders a template file.
+func (p *preprocessor) include(file string, o origin) {
+	for _, f := range p.includes {
+		if f == file {
+			p.error(o, errors.New("include cycle: "+file))
+			return
+		}
+	}
+	if len(p.includes) >= maxIncludeDepth {
+		p.error(o, errors.New("too deep include: "+file))
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		p.error(o, err)
+		return
+	}
+	defer f.Close()
+	p.render(f, file)
+}
+
+// render renders a template read from r.  file is the name of the
+// template; it may be empty.
+func (p *preprocessor) render(r io.Reader, file string) {
+	p.includes = append(p.includes, file)
+	defer func() {
+		p.includes = p.includes[:len(p.includes)-1]
+	}()
+
+	var conds []*condition
+	active := func() bool {
+		return len(conds) == 0 || conds[len(conds)-1].active
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16*1024*1024)
+	n := 0
+	for s.Scan() {
+		n++
+		line := s.Text()
+		o := origin{file: file, line: n}
+
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#@") {
+			fields := strings.SplitN(strings.TrimSpace(trimmed[2:]), " ", 2)
+			arg := ""
+			if len(fields) == 2 {
+				arg = strings.TrimSpace(fields[1])
+			}
+
+			switch fields[0] {
+			case "include":
+				if !active() {
+					continue
+				}
+				path, err := p.expand(arg)
+				if err != nil {
+					p.error(o, err)
+					continue
+				}
+				if path == "" {
+					p.error(o, errors.New("include needs a file"))
+					continue
+				}
+				p.include(resolvePath(baseDir(file), path), o)
+			case "if":
+				c := &condition{origin: o, parent: active()}
+				if c.parent {
+					v, err := p.eval(arg)
+					if err != nil {
+						p.error(o, err)
+					}
+					c.active = v
+					c.done = v
+				}
+				conds = append(conds, c)
+			case "elif", "else":
+				if len(conds) == 0 {
+					p.error(o, errors.New(fields[0]+" without if"))
+					continue
+				}
+				c := conds[len(conds)-1]
+				if c.inElse {
+					p.error(o, errors.New(fields[0]+" after else"))
+					continue
+				}
+				c.active = false
+				if !c.parent || c.done {
+					c.inElse = fields[0] == "else"
+					continue
+				}
+				if fields[0] == "else" {
+					c.inElse = true
+					c.active = true
+					c.done = true
+					continue
+				}
+				v, err := p.eval(arg)
+				if err != nil {
+					p.error(o, err)
+				}
+				c.active = v
+				c.done = v
+			case "end":
+				if len(conds) == 0 {
+					p.error(o, errors.New("end without if"))
+					continue
+				}
+				conds = conds[:len(conds)-1]
+			default:
+				p.error(o, errors.New("unknown directive: "+fields[0]))
+			}
+			continue
+		}
+
+		if !active() {
+			continue
+		}
+		if isDocumentSeparator(line) {
+			p.endDocument()
+			p.out = append(p.out, srcLine{text: line, origin: o})
+			p.docStart = len(p.out)
+			continue
+		}
+		text, err := p.expand(line)
+		if err != nil {
+			p.error(o, err)
+			text = line
+		}
+		p.out = append(p.out, srcLine{text: text, origin: o})
+	}
+	if err := s.Err(); err != nil {
+		p.error(origin{file: file}, err)
+	}
+	for _, c := range conds {
+		p.error(c.origin, errors.New("if without end"))
+	}
+}
+
+// renderTemplate renders a YAML template read from r.
+// It returns ErrorList of *SourceError if there are errors.
+func renderTemplate(r io.Reader, file string, vars map[string]string) ([]srcLine, error) {
+	p := newPreprocessor(vars)
+	p.render(r, file)
+	p.endDocument()
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
+	return p.out, nil
+}
@@ -0,0 +1,170 @@
+package placemat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testTemplateRender(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "placemat-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "network.yml"), []byte(`kind: Network
+name: ${network}
+type: internal
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("PLACEMAT_TEST_MEMORY", "2G")
+	defer os.Unsetenv("PLACEMAT_TEST_MEMORY")
+
+	main := filepath.Join(dir, "cluster.yml")
+	err = ioutil.WriteFile(main, []byte(`kind: Variables
+variables:
+  network: net0
+  cpus: "2"
+  role: worker
+---
+#@include network.yml
+---
+kind: Node
+name: ${role}1
+interfaces:
+  - ${network}
+#@if ${role} == boot
+cpu: 1
+#@elif ${role} == worker
+cpu: ${cpus}
+memory: ${env.PLACEMAT_TEST_MEMORY}
+#@else
+cpu: 1
+#@end
+#@if !${role}
+cpu: 1
+#@end
+smbios:
+  serial: $${not-a-variable}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cluster, err := readYaml(f, main, map[string]string{"cpus": "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cluster.Networks) != 1 || cluster.Networks[0].Name != "net0" {
+		t.Fatal("network is not included:", cluster.Networks)
+	}
+	if len(cluster.Nodes) != 1 {
+		t.Fatal("unexpected nodes:", cluster.Nodes)
+	}
+	n := cluster.Nodes[0]
+	if n.Name != "worker1" {
+		t.Error("unexpected name:", n.Name)
+	}
+	if n.CPU != 4 {
+		t.Error("-var should take precedence over Variables:", n.CPU)
+	}
+	if n.Memory != "2G" {
+		t.Error("environment variables should be expanded:", n.Memory)
+	}
+	if _, ok := newPreprocessor(nil).lookup("PLACEMAT_TEST_MEMORY"); ok {
+		t.Error("environment variables should be referred to with env. prefix")
+	}
+	if n.SMBIOS.Serial != "${not-a-variable}" {
+		t.Error("$${ should be rendered as ${:", n.SMBIOS.Serial)
+	}
+}
+
+func testTemplateErrors(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "placemat-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "node.yml"), []byte(`kind: Node
+name: node1
+interfaces:
+  - net0
+cpu: one
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yaml := `kind: Network
+name: ${network}
+type: internal
+---
+#@include node.yml
+#@if yes
+#@else
+#@else
+#@end
+#@unless
+#@if 1
+`
+	main := filepath.Join(dir, "cluster.yml")
+	_, err = readYaml(bytes.NewReader([]byte(yaml)), main, nil)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+
+	expected := []string{
+		main + ":2: undefined variable: network",
+		main + ":8: else after else",
+		main + ":10: unknown directive: unless",
+		main + ":11: if without end",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+
+	yaml = `kind: Network
+name: net0
+type: internal
+---
+#@include node.yml
+`
+	_, err = readYaml(bytes.NewReader([]byte(yaml)), main, nil)
+	errs, ok = err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+	e := filepath.Join(dir, "node.yml") + ":5: cannot unmarshal !!str `one` into int"
+	if len(errs) != 1 || errs[0].Error() != e {
+		t.Errorf("expected %q, actual %v", e, errs)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	t.Run("Render", testTemplateRender)
+	t.Run("Errors", testTemplateErrors)
+}
@@ -2,10 +2,17 @@ package placemat
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
-	k8sYaml "github.com/kubernetes/apimachinery/pkg/util/yaml"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -13,84 +20,402 @@ type baseConfig struct {
 	Kind string `yaml:"kind"`
 }
 
-// ReadYaml reads a yaml file and constructs Cluster
-func ReadYaml(r *bufio.Reader) (*Cluster, error) {
-	var cluster Cluster
+// document is a YAML document rendered from templates.
+type document struct {
+	data []byte
+	src  []origin // the origin of each line in data
+}
+
+func newDocument(lines []srcLine) *document {
+	var buf bytes.Buffer
+	src := make([]origin, len(lines))
+	for i, l := range lines {
+		buf.WriteString(l.text)
+		buf.WriteByte('\n')
+		src[i] = l.origin
+	}
+	return &document{data: buf.Bytes(), src: src}
+}
+
+// origin returns the origin of the 0-based line i in d.
+func (d *document) origin(i int) origin {
+	switch {
+	case len(d.src) == 0:
+		return origin{}
+	case i < 0:
+		i = 0
+	case i >= len(d.src):
+		i = len(d.src) - 1
+	}
+	return d.src[i]
+}
+
+// dir returns the directory to resolve relative paths in d.
+func (d *document) dir() string {
+	return baseDir(d.origin(d.lineOf("kind", "")).file)
+}
+
+func isURL(file string) bool {
+	return strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+}
+
+// baseDir returns the directory to resolve relative paths in file.
+// It returns an empty string for unnamed files and files loaded from URLs,
+// so that their relative paths are relative to the current directory.
+func baseDir(file string) string {
+	if file == "" || isURL(file) {
+		return ""
+	}
+	return filepath.Dir(file)
+}
 
-	y := k8sYaml.NewYAMLReader(r)
-	for {
-		data, err := y.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
+// resolvePath returns p joined to dir if p is a relative path.
+func resolvePath(dir, p string) string {
+	if p == "" || dir == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+var yamlUnknownField = regexp.MustCompile(`^field (\S+) not found`)
+
+// splitDocuments splits rendered lines into documents separated by "---".
+// Documents consisting of only blank lines and comments are skipped.
+func splitDocuments(lines []srcLine) []*document {
+	var docs []*document
+	start := 0
+	empty := true
+
+	flush := func(end int) {
+		if !empty {
+			docs = append(docs, newDocument(lines[start:end]))
 		}
+		start = end + 1
+		empty = true
+	}
 
-		var c baseConfig
-		err = yaml.Unmarshal(data, &c)
-		if err != nil {
-			return nil, err
+	for i, l := range lines {
+		if isDocumentSeparator(l.text) {
+			flush(i)
+			continue
+		}
+		trimmed := strings.TrimSpace(l.text)
+		if len(trimmed) > 0 && trimmed[0] != '#' {
+			empty = false
 		}
+	}
+	flush(len(lines))
+	return docs
+}
 
-		switch c.Kind {
-		case "Network":
-			spec := new(NetworkSpec)
-			err = yaml.Unmarshal(data, spec)
-			if err != nil {
-				return nil, err
-			}
-			network, err := NewNetwork(spec)
-			if err != nil {
-				return nil, err
-			}
-			cluster.Networks = append(cluster.Networks, network)
-		case "Image":
-			spec := new(ImageSpec)
-			err = yaml.Unmarshal(data, spec)
-			if err != nil {
-				return nil, err
-			}
-			image, err := NewImage(spec)
-			if err != nil {
-				return nil, err
-			}
-			cluster.Images = append(cluster.Images, image)
-		case "DataFolder":
-			spec := new(DataFolderSpec)
-			err = yaml.Unmarshal(data, spec)
-			if err != nil {
-				return nil, err
-			}
-			folder, err := NewDataFolder(spec)
-			if err != nil {
-				return nil, err
-			}
-			cluster.DataFolders = append(cluster.DataFolders, folder)
-		case "Node":
-			spec := new(NodeSpec)
-			err = yaml.Unmarshal(data, spec)
-			if err != nil {
-				return nil, err
-			}
-			node, err := NewNode(spec)
-			if err != nil {
-				return nil, err
-			}
-			cluster.Nodes = append(cluster.Nodes, node)
-		case "Pod":
-			spec := new(PodSpec)
-			err = yaml.Unmarshal(data, spec)
-			if err != nil {
-				return nil, err
-			}
-			pod, err := NewPod(spec)
-			if err != nil {
-				return nil, err
+// lineOf returns the 0-based index of the line of field in the document.
+// If value is not empty, this returns the line of value that appears
+// first at or after field.  Nested fields are matched by name too.
+// It returns -1 if field is not found.
+func (d *document) lineOf(field, value string) int {
+	lines := strings.Split(string(d.data), "\n")
+	for i, l := range lines {
+		l = strings.TrimLeft(l, " \t")
+		l = strings.TrimLeft(strings.TrimPrefix(l, "-"), " \t")
+		if !strings.HasPrefix(l, field+":") {
+			continue
+		}
+		if value == "" {
+			return i
+		}
+		for j := i; j < len(lines); j++ {
+			if strings.Contains(lines[j], value) {
+				return j
 			}
-			cluster.Pods = append(cluster.Pods, pod)
-		default:
-			return nil, errors.New("unknown resource: " + c.Kind)
 		}
+		return i
+	}
+	return -1
+}
+
+// sourceError returns SourceError at the 0-based line i in d.
+func (d *document) sourceError(i int, field string, err error) *SourceError {
+	o := d.origin(i)
+	return &SourceError{File: o.file, Line: o.line, Field: field, Err: err}
+}
+
+// wrap converts err to SourceError or ErrorList of SourceError
+// pointing the location in d.
+func (d *document) wrap(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *SourceError:
+		return e
+	case ErrorList:
+		var errs ErrorList
+		for _, err := range e {
+			errs.add(d.wrap(err))
+		}
+		return errs
+	case *fieldError:
+		line := d.lineOf(e.field, e.value)
+		if line == -1 {
+			line = d.lineOf("kind", "")
+		}
+		return d.sourceError(line, e.field, e.err)
+	case *yaml.TypeError:
+		var errs ErrorList
+		for _, msg := range e.Errors {
+			errs.add(d.yamlError(msg))
+		}
+		return errs
+	}
+
+	msg := err.Error()
+	if yamlErrorLine.MatchString(msg) {
+		return d.yamlError(msg)
+	}
+
+	return d.sourceError(d.lineOf("kind", ""), "", err)
+}
+
+func (d *document) yamlError(msg string) error {
+	m := yamlErrorLine.FindStringSubmatch(msg)
+	if m == nil {
+		return d.sourceError(0, "", errors.New(msg))
+	}
+
+	n, _ := strconv.Atoi(m[1])
+	e := d.sourceError(n-1, "", errors.New(m[2]))
+	if f := yamlUnknownField.FindStringSubmatch(m[2]); f != nil {
+		e.Field = f[1]
+		e.Err = errors.New("unknown field")
+	}
+	return e
+}
+
+// decode strictly decodes a document and adds the resource to the cluster.
+func (c *Cluster) decode(d *document) error {
+	var base baseConfig
+	err := yaml.Unmarshal(d.data, &base)
+	if err != nil {
+		return err
+	}
+
+	var res interface{}
+	switch base.Kind {
+	case "Network":
+		spec := new(NetworkSpec)
+		err = yaml.UnmarshalStrict(d.data, spec)
+		if err != nil {
+			return err
+		}
+		network, err := NewNetwork(spec)
+		if err != nil {
+			return err
+		}
+		c.Networks = append(c.Networks, network)
+		res = network
+	case "Link":
+		spec := new(LinkSpec)
+		err = yaml.UnmarshalStrict(d.data, spec)
+		if err != nil {
+			return err
+		}
+		link, err := NewLink(spec)
+		if err != nil {
+			return err
+		}
+		c.Links = append(c.Links, link)
+		res = link
+	case "Image":
+		spec := new(ImageSpec)
+		err = yaml.UnmarshalStrict(d.data, spec)
+		if err != nil {
+			return err
+		}
+		spec.resolvePaths(d.dir())
+		image, err := NewImage(spec)
+		if err != nil {
+			return err
+		}
+		c.Images = append(c.Images, image)
+		res = image
+	case "DataFolder":
+		spec := new(DataFolderSpec)
+		err = yaml.UnmarshalStrict(d.data, spec)
+		if err != nil {
+			return err
+		}
+		spec.resolvePaths(d.dir())
+		folder, err := NewDataFolder(spec)
+		if err != nil {
+			return err
+		}
+		c.DataFolders = append(c.DataFolders, folder)
+		res = folder
+	case "Node":
+		spec := new(NodeSpec)
+		err = yaml.UnmarshalStrict(d.data, spec)
+		if err != nil {
+			return err
+		}
+		spec.resolvePaths(d.dir())
+		node, err := NewNode(spec)
+		if err != nil {
+			return err
+		}
+		c.Nodes = append(c.Nodes, node)
+		res = node
+	case "NodeSet":
+		spec := new(NodeSetSpec)
+		err = yaml.UnmarshalStrict(d.data, spec)
+		if err != nil {
+			return err
+		}
+		nodes, err := spec.expand(d.dir())
+		if err != nil {
+			return err
+		}
+		if c.sources == nil {
+			c.sources = make(map[interface{}]*document)
+		}
+		for _, node := range nodes {
+			c.Nodes = append(c.Nodes, node)
+			c.sources[node] = d
+		}
+		return nil
+	case "Pod":
+		spec := new(PodSpec)
+		err = yaml.UnmarshalStrict(d.data, spec)
+		if err != nil {
+			return err
+		}
+		spec.resolvePaths(d.dir())
+		pod, err := NewPod(spec)
+		if err != nil {
+			return err
+		}
+		c.Pods = append(c.Pods, pod)
+		res = pod
+	case "Hook":
+		spec := new(HookSpec)
+		err = yaml.UnmarshalStrict(d.data, spec)
+		if err != nil {
+			return err
+		}
+		spec.resolvePaths(d.dir())
+		hook, err := NewHook(spec)
+		if err != nil {
+			return err
+		}
+		c.Hooks = append(c.Hooks, hook)
+		res = hook
+	case "ChaosSchedule":
+		spec := new(ChaosScheduleSpec)
+		err = yaml.UnmarshalStrict(d.data, spec)
+		if err != nil {
+			return err
+		}
+		schedule, err := NewChaosSchedule(spec)
+		if err != nil {
+			return err
+		}
+		c.ChaosSchedules = append(c.ChaosSchedules, schedule)
+		res = schedule
+	case "":
+		return &fieldError{field: "kind", err: errors.New("kind is not specified")}
+	default:
+		return &fieldError{field: "kind", value: base.Kind, err: errors.New("unknown resource: " + base.Kind)}
+	}
+
+	if c.sources == nil {
+		c.sources = make(map[interface{}]*document)
+	}
+	c.sources[res] = d
+	return nil
+}
+
+func readYaml(r io.Reader, file string, vars map[string]string) (*Cluster, error) {
+	lines, err := renderTemplate(r, file, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	var cluster Cluster
+	var errs ErrorList
+	for _, d := range splitDocuments(lines) {
+		errs.add(d.wrap(cluster.decode(d)))
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return &cluster, nil
+}
+
+// ReadYaml reads a yaml file and constructs Cluster.
+//
+// The file is rendered as a template before decoding; see docs/template.md.
+// Files included from the template are looked up in the current directory.
+// Every document is decoded strictly; unknown fields are errors.
+// If there are errors, this returns ErrorList of *SourceError.
+func ReadYaml(r *bufio.Reader) (*Cluster, error) {
+	return readYaml(r, "", nil)
+}
+
+// openYaml opens a YAML file at p.  If p is an HTTP or HTTPS URL,
+// the file is downloaded into c every time so that reloading reads
+// the latest one.
+func openYaml(p string, c *cache) (io.ReadCloser, error) {
+	if !isURL(p) {
+		return os.Open(p)
+	}
+
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(c.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = fetchData(context.Background(), u, nil, c)
+	if err != nil {
+		return nil, err
+	}
+	return c.Get(p)
+}
+
+// ReadYamlFiles reads yaml files and constructs Cluster.
+//
+// vars are template variables that take precedence over the variables
+// defined in the files.  Each file is rendered separately.
+//
+// paths may contain HTTP or HTTPS URLs.  They are downloaded into
+// cacheDir each time.  Relative paths in a file are relative to
+// the directory of the file, or the current directory for URLs.
+//
+// Unlike ReadYaml, this reads all files even if some of them have errors
+// and returns all the errors in ErrorList.  The returned errors contain
+// the file names.
+func ReadYamlFiles(paths []string, vars map[string]string, cacheDir string) (*Cluster, error) {
+	c := &cache{dir: filepath.Join(cacheDir, "yaml_cache")}
+
+	var cluster Cluster
+	var errs ErrorList
+	for _, p := range paths {
+		f, err := openYaml(p, c)
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+		part, err := readYaml(f, p, vars)
+		f.Close()
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+		cluster.Append(part)
+	}
+	if len(errs) > 0 {
+		return nil, errs
 	}
 	return &cluster, nil
 }
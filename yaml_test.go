@@ -3,6 +3,12 @@ package placemat
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -55,6 +61,179 @@ apps:
 	}
 }
 
+func testReadYamlErrors(t *testing.T) {
+	t.Parallel()
+	yaml := `# comment
+kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+  - net1
+volumes:
+  - kind: image
+    name: root
+    image: ubuntu
+    copy-on-wirte: true
+---
+
+---
+kind: Foo
+name: foo
+---
+kind: Pod
+name: pod1
+`
+
+	_, err := readYaml(bytes.NewReader([]byte(yaml)), "test.yml", nil)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+
+	expected := []string{
+		"test.yml:15: copy-on-wirte: unknown field",
+		"test.yml:19: kind: unknown resource: Foo",
+		"test.yml:22: apps: no app for pod pod1",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+}
+
+func testResolveErrors(t *testing.T) {
+	t.Parallel()
+	yaml := `kind: Network
+name: net0
+type: internal
+---
+kind: Network
+name: net0
+type: internal
+---
+kind: Node
+name: node1
+interfaces:
+  - net0
+  - net1
+volumes:
+  - kind: image
+    name: root
+    image: ubuntu
+`
+
+	cluster, err := readYaml(bytes.NewReader([]byte(yaml)), "test.yml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Resolve()
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatal("ErrorList is not returned:", err)
+	}
+
+	expected := []string{
+		"test.yml:6: name: duplicate network: net0",
+		"test.yml:13: interfaces: no such network: net1",
+		"test.yml:16: volumes: no such image: ubuntu",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("expected %q, actual %q", e, errs[i].Error())
+		}
+	}
+}
+
+func testReadYamlFiles(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "placemat-yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"images.yml": `kind: Image
+name: ubuntu
+file: images/ubuntu.img
+`,
+		"nodes/node.yml": `kind: Node
+name: node1
+ignition: node1.ign
+volumes:
+  - kind: localds
+    name: seed
+    user-data: seed/user-data.yml
+    network-config: /etc/network-config.yml
+`,
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	served := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		fmt.Fprintf(w, `kind: DataFolder
+name: data
+dir: data%d
+`, served)
+	}))
+	defer s.Close()
+
+	paths := []string{
+		filepath.Join(dir, "images.yml"),
+		filepath.Join(dir, "nodes/node.yml"),
+		s.URL + "/folder.yml",
+	}
+	for i := 0; i < 2; i++ {
+		cluster, err := ReadYamlFiles(paths, nil, filepath.Join(dir, "cache"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p := cluster.Images[0].File; p != filepath.Join(dir, "images/ubuntu.img") {
+			t.Error("unexpected image file:", p)
+		}
+		n := cluster.Nodes[0]
+		if p := n.IgnitionFile; p != filepath.Join(dir, "nodes/node1.ign") {
+			t.Error("unexpected ignition file:", p)
+		}
+		if p := n.Volumes[0].UserData; p != filepath.Join(dir, "nodes/seed/user-data.yml") {
+			t.Error("unexpected user-data:", p)
+		}
+		if p := n.Volumes[0].NetworkConfig; p != "/etc/network-config.yml" {
+			t.Error("absolute path should be kept:", p)
+		}
+		if p := cluster.DataFolders[0].Dir; p != fmt.Sprintf("data%d", i+1) {
+			t.Error("YAML from URL should be downloaded again:", p)
+		}
+	}
+}
+
 func TestYAML(t *testing.T) {
 	t.Run("ReadYaml", testReadYaml)
+	t.Run("ReadYamlErrors", testReadYamlErrors)
+	t.Run("ResolveErrors", testResolveErrors)
+	t.Run("ReadYamlFiles", testReadYamlFiles)
 }